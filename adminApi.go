@@ -0,0 +1,532 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/bootstrap"
+	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/ratelimit"
+	"github.com/symphonyprotocol/p2p/tcp"
+	"github.com/symphonyprotocol/p2p/udp"
+)
+
+var (
+	adminLogger = log.GetLogger("admin")
+	// how long the ping action waits for the pong
+	ADMIN_PING_TIMEOUT = 5 * time.Second
+)
+
+// NodeInfo is the local node as shown by the admin api
+type NodeInfo struct {
+	ID           string   `json:"id"`
+	PublicKey    string   `json:"publicKey"`
+	LocalAddr    string   `json:"localAddr"`
+	LocalIPs     []string `json:"localIPs"`
+	RemoteAddr   string   `json:"remoteAddr"`
+	Reachability string   `json:"reachability"`
+	UpTime       string   `json:"upTime"`
+	RecordSeq    uint64   `json:"recordSeq"`
+}
+
+// PeerInfo is a node of the routing table
+type PeerInfo struct {
+	ID             string    `json:"id"`
+	Distance       int       `json:"distance"`
+	LocalAddr      string    `json:"localAddr"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	Latency        int       `json:"latency"`
+	LastActiveTime time.Time `json:"lastActiveTime"`
+	IntroducedBy   string    `json:"introducedBy,omitempty"`
+}
+
+// BucketInfo is a non-empty bucket of the routing table
+type BucketInfo struct {
+	Distance int        `json:"distance"`
+	Nodes    []PeerInfo `json:"nodes"`
+}
+
+// ConnectionInfo is an open tcp connection
+type ConnectionInfo struct {
+	LocalAddr      string    `json:"localAddr"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	NodeID         string    `json:"nodeId"`
+	IsInbound      bool      `json:"isInbound"`
+	IsRelayed      bool      `json:"isRelayed"`
+	WriteQueue     int       `json:"writeQueue"`
+	LastActiveTime time.Time `json:"lastActiveTime"`
+}
+
+// MiddlewareInfo is the dashboard panel of a middleware
+type MiddlewareInfo struct {
+	Title           string      `json:"title"`
+	Type            string      `json:"type"`
+	HasColumnTitles bool        `json:"hasColumnTitles"`
+	Data            interface{} `json:"data"`
+}
+
+func getNodeInfo(ctx *tcp.P2PContext) NodeInfo {
+	n := ctx.LocalNode()
+	info := NodeInfo{
+		ID:           n.GetID(),
+		PublicKey:    n.GetPublicKey(),
+		LocalAddr:    net.JoinHostPort(n.GetLocalIP().String(), strconv.Itoa(n.GetLocalPort())),
+		LocalIPs:     make([]string, 0),
+		Reachability: n.GetReachability().String(),
+		UpTime:       time.Since(n.GetLaunchTime()).Truncate(time.Second).String(),
+	}
+	for _, ip := range n.GetLocalIPs() {
+		info.LocalIPs = append(info.LocalIPs, ip.String())
+	}
+	if n.GetRemoteIP() != nil {
+		info.RemoteAddr = net.JoinHostPort(n.GetRemoteIP().String(), strconv.Itoa(n.GetRemotePort()))
+	}
+	if record := n.GetRecord(); record != nil {
+		info.RecordSeq = record.Seq
+	}
+	return info
+}
+
+func getPeerInfo(rnode *node.RemoteNode, dist int) PeerInfo {
+	info := PeerInfo{
+		ID:             rnode.GetID(),
+		Distance:       dist,
+		Latency:        rnode.Latency,
+		LastActiveTime: rnode.LastActiveTime,
+		IntroducedBy:   rnode.IntroducedBy,
+	}
+	if rnode.GetLocalIP() != nil {
+		info.LocalAddr = net.JoinHostPort(rnode.GetLocalIP().String(), strconv.Itoa(rnode.GetLocalPort()))
+	}
+	if rnode.GetRemoteIP() != nil {
+		info.RemoteAddr = net.JoinHostPort(rnode.GetRemoteIP().String(), strconv.Itoa(rnode.GetRemotePort()))
+	}
+	return info
+}
+
+// the buckets sorted by distance, only the peeked nodes if the provider is not a KTable
+func getBucketsInfo(ctx *tcp.P2PContext) []BucketInfo {
+	res := make([]BucketInfo, 0)
+	kt, ok := ctx.NodeProvider().(*kad.KTable)
+	if !ok {
+		peers := make([]PeerInfo, 0)
+		for _, rnode := range ctx.NodeProvider().PeekNodes() {
+			peers = append(peers, getPeerInfo(rnode, rnode.Distance))
+		}
+		return append(res, BucketInfo{Distance: -1, Nodes: peers})
+	}
+	for dist, nodes := range kt.GetBucketNodes() {
+		bucket := BucketInfo{Distance: dist, Nodes: make([]PeerInfo, 0, len(nodes))}
+		for _, rnode := range nodes {
+			bucket.Nodes = append(bucket.Nodes, getPeerInfo(rnode, dist))
+		}
+		res = append(res, bucket)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Distance < res[j].Distance })
+	return res
+}
+
+func getConnectionsInfo(ctx *tcp.P2PContext) []ConnectionInfo {
+	res := make([]ConnectionInfo, 0)
+	tcpService, ok := ctx.Network().(*tcp.TLSSecuredTCPService)
+	if !ok {
+		return res
+	}
+	for _, conn := range tcpService.GetTCPConnections() {
+		res = append(res, ConnectionInfo{
+			LocalAddr:      conn.LocalAddr().String(),
+			RemoteAddr:     conn.RemoteAddr().String(),
+			NodeID:         conn.GetNodeID(),
+			IsInbound:      conn.GetIsInBound(),
+			IsRelayed:      conn.GetIsRelayed(),
+			WriteQueue:     conn.GetWriteQueueLen(),
+			LastActiveTime: conn.GetLastActiveTime(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].NodeID < res[j].NodeID })
+	return res
+}
+
+func getMiddlewaresInfo(ctx *tcp.P2PContext) []MiddlewareInfo {
+	res := make([]MiddlewareInfo, 0)
+	for _, m := range ctx.Middlewares() {
+		res = append(res, MiddlewareInfo{
+			Title:           m.DashboardTitle(),
+			Type:            m.DashboardType(),
+			HasColumnTitles: m.DashboardTableHasColumnTitles(),
+			Data:            m.DashboardData(),
+		})
+	}
+	return res
+}
+
+// AdminAPI serves the state of the server and a few actions as json over http.
+// Every request needs the "Authorization: Bearer <token>" header.
+type AdminAPI struct {
+	server   *P2PServer
+	token    string
+	listener net.Listener
+	http     *http.Server
+}
+
+func NewAdminAPI(server *P2PServer, token string) *AdminAPI {
+	return &AdminAPI{server: server, token: token}
+}
+
+func (a *AdminAPI) Start(addr string) error {
+	if a.token == "" {
+		return fmt.Errorf("the admin api needs a token")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/node", a.get(a.handleNode))
+	mux.HandleFunc("/api/buckets", a.get(a.handleBuckets))
+	mux.HandleFunc("/api/netsize", a.get(a.handleNetworkSize))
+	mux.HandleFunc("/api/connections", a.get(a.handleConnections))
+	mux.HandleFunc("/api/middlewares", a.get(a.handleMiddlewares))
+	mux.HandleFunc("/api/bans", a.get(a.handleBans))
+	mux.HandleFunc("/api/traces", a.get(a.handleTraces))
+	mux.HandleFunc("/api/connect", a.post(a.handleConnect))
+	mux.HandleFunc("/api/disconnect", a.post(a.handleDisconnect))
+	mux.HandleFunc("/api/ban", a.post(a.handleBan))
+	mux.HandleFunc("/api/unban", a.post(a.handleUnban))
+	mux.HandleFunc("/api/lookup", a.post(a.handleLookup))
+	mux.HandleFunc("/api/ping", a.post(a.handlePing))
+	a.listener = listener
+	a.http = &http.Server{Handler: a.auth(mux)}
+	go func() {
+		if err := a.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			adminLogger.Error("admin api stopped: %v", err)
+		}
+	}()
+	adminLogger.Info("serving the admin api at http://%v/api/", listener.Addr())
+	return nil
+}
+
+func (a *AdminAPI) Close() {
+	if a.http != nil {
+		a.http.Close()
+	}
+}
+
+// the token from the env variable wins over config.ADMIN_TOKEN
+func adminToken() string {
+	if token := strings.TrimSpace(os.Getenv(config.ADMIN_TOKEN_ENV)); token != "" {
+		return token
+	}
+	return config.ADMIN_TOKEN
+}
+
+func (a *AdminAPI) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminAPI) get(handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return a.method(http.MethodGet, handler)
+}
+
+func (a *AdminAPI) post(handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return a.method(http.MethodPost, handler)
+}
+
+func (a *AdminAPI) method(method string, handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %v", method))
+			return
+		}
+		if a.server.GetP2PContext() == nil {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("the server is starting"))
+			return
+		}
+		res, err := handler(r)
+		if err != nil {
+			status := http.StatusBadRequest
+			if apiErr, ok := err.(adminError); ok {
+				status = apiErr.status
+			}
+			writeError(w, status, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e adminError) Error() string { return e.msg }
+
+func notFound(format string, args ...interface{}) error {
+	return adminError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// the body of the actions
+type adminRequest struct {
+	// a node id, or "id@ip:port" for nodes not in the table yet
+	Node string `json:"node"`
+	IP   string `json:"ip"`
+	// ban duration like "1h", forever when empty
+	Duration string `json:"duration"`
+	// hex id the lookup walks to, random when empty
+	Target string `json:"target"`
+}
+
+func readRequest(r *http.Request) (adminRequest, error) {
+	var req adminRequest
+	if r.ContentLength == 0 {
+		return req, nil
+	}
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16)).Decode(&req)
+	return req, err
+}
+
+func (a *AdminAPI) ktable() (*kad.KTable, error) {
+	kt, ok := a.server.ktable.(*kad.KTable)
+	if !ok {
+		return nil, adminError{http.StatusNotImplemented, "the node provider is not a KTable"}
+	}
+	return kt, nil
+}
+
+func (a *AdminAPI) limiters() []*ratelimit.Limiter {
+	res := []*ratelimit.Limiter{a.server.tcpService.GetRateLimiter()}
+	if udpService, ok := a.server.udpService.(*udp.UDPService); ok {
+		res = append(res, udpService.GetRateLimiter())
+	}
+	return res
+}
+
+// the node of the table, or a new one for "id@ip:port"
+func (a *AdminAPI) resolveNode(spec string) (*node.RemoteNode, error) {
+	kt, err := a.ktable()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(spec, "@") {
+		if rnode := kt.Search(spec); rnode != nil {
+			return rnode, nil
+		}
+		return nil, notFound("node %v is not in the table, use id@ip:port", spec)
+	}
+	snode, err := bootstrap.ParseNodeSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if rnode := kt.Search(snode.ID); rnode != nil {
+		return rnode, nil
+	}
+	id, _ := hex.DecodeString(snode.ID)
+	ip := net.ParseIP(snode.IP)
+	return node.NewRemoteNode(id, ip, snode.Port, ip, snode.Port), nil
+}
+
+func (a *AdminAPI) handleNode(r *http.Request) (interface{}, error) {
+	return map[string]interface{}{
+		"node":    getNodeInfo(a.server.GetP2PContext()),
+		"autonat": a.server.GetReachability(),
+		"netsize": a.server.GetNetworkSize(),
+	}, nil
+}
+
+func (a *AdminAPI) handleBuckets(r *http.Request) (interface{}, error) {
+	// the buckets of the ktable even when the contexts broadcast over the hyparview
+	return getBucketsInfo(a.server.GetP2PContext().WithNodeProvider(a.server.ktable)), nil
+}
+
+func (a *AdminAPI) handleNetworkSize(r *http.Request) (interface{}, error) {
+	return a.server.GetNetworkSize(), nil
+}
+
+func (a *AdminAPI) handleConnections(r *http.Request) (interface{}, error) {
+	return getConnectionsInfo(a.server.GetP2PContext()), nil
+}
+
+func (a *AdminAPI) handleMiddlewares(r *http.Request) (interface{}, error) {
+	return getMiddlewaresInfo(a.server.GetP2PContext()), nil
+}
+
+func (a *AdminAPI) handleBans(r *http.Request) (interface{}, error) {
+	bans := make(map[string]time.Time)
+	for _, l := range a.limiters() {
+		for key, until := range l.GetBans() {
+			bans[key] = until
+		}
+	}
+	return bans, nil
+}
+
+// the traced message ids, or the propagation tree of ?id=
+func (a *AdminAPI) handleTraces(r *http.Request) (interface{}, error) {
+	collector := a.server.GetTraceCollector()
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return collector.GetMessageIDs(), nil
+	}
+	tree := collector.GetTree(id)
+	if tree == nil {
+		return nil, notFound("message %v was not traced", id)
+	}
+	return tree, nil
+}
+
+func (a *AdminAPI) handleConnect(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	rnode, err := a.resolveNode(req.Node)
+	if err != nil {
+		return nil, err
+	}
+	kt, _ := a.ktable()
+	kt.Introduce(rnode)
+	ip, port := rnode.GetSendEndpoint(a.server.node, node.ENDPOINT_TCP)
+	conn, err := a.server.tcpService.GetConnection(ip, port, rnode.GetID())
+	if err != nil {
+		return nil, adminError{http.StatusBadGateway, err.Error()}
+	}
+	return map[string]string{"nodeId": rnode.GetID(), "remoteAddr": conn.RemoteAddr().String()}, nil
+}
+
+func (a *AdminAPI) handleDisconnect(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if !a.server.tcpService.Disconnect(req.Node) {
+		return nil, notFound("no connection to %v", req.Node)
+	}
+	return map[string]bool{"disconnected": true}, nil
+}
+
+// a banned node is also dropped from the table and disconnected
+func (a *AdminAPI) handleBan(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Node == "" && req.IP == "" {
+		return nil, fmt.Errorf("node or ip is required")
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		if d, err = time.ParseDuration(req.Duration); err != nil {
+			return nil, err
+		}
+	}
+	if req.IP != "" {
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", req.IP)
+		}
+		for _, l := range a.limiters() {
+			l.Ban(ip.String(), d)
+		}
+	}
+	if req.Node != "" {
+		for _, l := range a.limiters() {
+			l.Ban(req.Node, d)
+		}
+		a.server.tcpService.Disconnect(req.Node)
+		if kt, err := a.ktable(); err == nil {
+			kt.Remove(req.Node)
+		}
+	}
+	adminLogger.Info("banned node %q ip %q for %v", req.Node, req.IP, req.Duration)
+	return map[string]bool{"banned": true}, nil
+}
+
+func (a *AdminAPI) handleUnban(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{req.Node, req.IP} {
+		if key == "" {
+			continue
+		}
+		if ip := net.ParseIP(key); ip != nil {
+			key = ip.String()
+		}
+		for _, l := range a.limiters() {
+			l.Unban(key)
+		}
+	}
+	return map[string]bool{"unbanned": true}, nil
+}
+
+func (a *AdminAPI) handleLookup(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	kt, err := a.ktable()
+	if err != nil {
+		return nil, err
+	}
+	target := make([]byte, len(a.server.node.GetIDBytes()))
+	if req.Target != "" {
+		if target, err = hex.DecodeString(req.Target); err != nil || len(target) == 0 {
+			return nil, fmt.Errorf("invalid target %q", req.Target)
+		}
+	} else {
+		rand.Read(target)
+	}
+	if !kt.Lookup(target) {
+		return nil, adminError{http.StatusConflict, "no node to ask yet"}
+	}
+	return map[string]string{"target": hex.EncodeToString(target)}, nil
+}
+
+func (a *AdminAPI) handlePing(r *http.Request) (interface{}, error) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	rnode, err := a.resolveNode(req.Node)
+	if err != nil {
+		return nil, err
+	}
+	kt, _ := a.ktable()
+	rtt, err := kt.Ping(rnode, ADMIN_PING_TIMEOUT)
+	if err != nil {
+		return nil, adminError{http.StatusGatewayTimeout, err.Error()}
+	}
+	return map[string]interface{}{"nodeId": rnode.GetID(), "latencyMs": float64(rtt) / float64(time.Millisecond)}, nil
+}
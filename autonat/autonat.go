@@ -0,0 +1,371 @@
+package autonat
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	logger = log.GetLogger("autonat")
+
+	AUTONAT_START_DELAY = 10 * time.Second
+	// checks are repeated quickly until the reachability is known
+	AUTONAT_INTERVAL       = 10 * time.Minute
+	AUTONAT_RETRY_INTERVAL = 30 * time.Second
+	// peers asked to dial back per check
+	AUTONAT_PEERS = 5
+	// distinct peers agreeing on a result
+	AUTONAT_QUORUM = 3
+	// votes older than this are forgotten
+	AUTONAT_VOTE_TTL = time.Hour
+
+	AUTONAT_DIAL_TIMEOUT     = 5 * time.Second
+	AUTONAT_RESPONSE_TIMEOUT = 15 * time.Second
+	// the dial-back may arrive after the response
+	AUTONAT_DIALBACK_GRACE = 2 * time.Second
+	// dial-backs served per minute, so that we can't be used to flood others
+	AUTONAT_SERVER_RATE = 30
+)
+
+// ITCPProber checks that a tcp endpoint accepts connections
+type ITCPProber interface {
+	Probe(ip net.IP, port int, timeout time.Duration) error
+}
+
+type vote struct {
+	udp bool
+	tcp bool
+	at  time.Time
+}
+
+// the votes on one address, by peer
+type addrVotes struct {
+	ip      net.IP
+	udpPort int
+	tcpPort int
+	byPeer  map[string]*vote
+}
+
+func (v *addrVotes) String() string {
+	return fmt.Sprintf("%v/tcp:%v", net.JoinHostPort(v.ip.String(), strconv.Itoa(v.udpPort)), v.tcpPort)
+}
+
+// a dial-back we asked for
+type request struct {
+	peerID  string
+	udpPort int
+	tcpPort int
+	udpOK   bool
+}
+
+// Status is the reachability decided so far
+type Status struct {
+	Reachability node.Reachability
+	TCPReachable bool
+	// the proven address when public
+	Address string
+	// distinct peers which reported on the address
+	Votes int
+}
+
+// AutoNAT asks peers to dial back to our observed addresses and decides by quorum whether we are reachable.
+// It also serves the dial-backs asked by others.
+type AutoNAT struct {
+	localNode *node.LocalNode
+	network   models.INetwork
+	ktable    *kad.KTable
+	prober    ITCPProber
+
+	mux      sync.Mutex
+	pending  map[string]*request
+	votes    map[string]*addrVotes
+	status   Status
+	served   int
+	servedAt time.Time
+}
+
+func NewAutoNAT(localNode *node.LocalNode, network models.INetwork, ktable *kad.KTable, prober ITCPProber) *AutoNAT {
+	a := &AutoNAT{
+		localNode: localNode,
+		network:   network,
+		ktable:    ktable,
+		prober:    prober,
+		pending:   make(map[string]*request),
+		votes:     make(map[string]*addrVotes),
+	}
+	network.RegisterCallback(AUTONAT_DIAGRAM_CATEGORY, a.callback)
+	return a
+}
+
+func (a *AutoNAT) Start() {
+	go a.loop()
+}
+
+func (a *AutoNAT) GetStatus() Status {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.status
+}
+
+func (a *AutoNAT) GetReachability() node.Reachability {
+	return a.GetStatus().Reachability
+}
+
+func (a *AutoNAT) loop() {
+	time.Sleep(AUTONAT_START_DELAY)
+	for {
+		a.check()
+		if a.GetReachability() == node.REACHABILITY_UNKNOWN {
+			time.Sleep(AUTONAT_RETRY_INTERVAL)
+		} else {
+			time.Sleep(AUTONAT_INTERVAL)
+		}
+	}
+}
+
+// ask a few peers to dial back to the most observed candidate address
+func (a *AutoNAT) check() {
+	a.decide()
+	candidates := a.localNode.GetCandidateAddrs()
+	if len(candidates) == 0 {
+		logger.Debug("no observed address to check yet")
+		return
+	}
+	candidate := candidates[0]
+	tcpPort := candidate.TCPPort
+	if tcpPort == 0 {
+		tcpPort = candidate.Port
+	}
+	for _, peer := range a.pickPeers() {
+		nonce := utils.NewUUID()
+		a.mux.Lock()
+		a.pending[nonce] = &request{peerID: peer.GetID(), udpPort: candidate.Port, tcpPort: tcpPort}
+		a.mux.Unlock()
+		time.AfterFunc(AUTONAT_RESPONSE_TIMEOUT, func() {
+			a.mux.Lock()
+			delete(a.pending, nonce)
+			a.mux.Unlock()
+		})
+
+		req := DialRequestDiagram{
+			UDPDiagram: a.newDiagram(AUTONAT_DIAGRAM_REQUEST),
+			Nonce:      nonce,
+			UDPPort:    candidate.Port,
+			TCPPort:    tcpPort,
+		}
+		ip, port := peer.GetSendIPWithPort(a.localNode)
+		a.network.Send(ip, port, utils.DiagramToBytes(req), peer.GetID())
+		logger.Debug("ask %v to dial back to %v", peer.GetID(), candidate.IP)
+	}
+}
+
+// random active peers outside our NAT, one per ip
+func (a *AutoNAT) pickPeers() []*node.RemoteNode {
+	nodes := a.ktable.GetActiveNodes()
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	res := make([]*node.RemoteNode, 0, AUTONAT_PEERS)
+	ips := make(map[string]bool)
+	for _, n := range nodes {
+		if len(res) >= AUTONAT_PEERS {
+			break
+		}
+		ip := n.GetRemoteIP()
+		if ip == nil || a.localNode.IsOwnRemoteIP(ip) || ips[ip.String()] {
+			continue
+		}
+		ips[ip.String()] = true
+		res = append(res, n)
+	}
+	return res
+}
+
+func (a *AutoNAT) callback(p models.ICallbackParams) {
+	params, ok := p.(models.UDPCallbackParams)
+	if !ok {
+		return
+	}
+	switch params.Diagram.GetDType() {
+	case AUTONAT_DIAGRAM_REQUEST:
+		var req DialRequestDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &req); err == nil {
+			go a.dialBack(req, params.GetUDPRemoteAddr())
+		}
+	case AUTONAT_DIAGRAM_DIALBACK:
+		var back DialBackDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &back); err == nil {
+			a.mux.Lock()
+			if r, ok := a.pending[back.Nonce]; ok && r.peerID == back.NodeID {
+				r.udpOK = true
+			}
+			a.mux.Unlock()
+		}
+	case AUTONAT_DIAGRAM_RESPONSE:
+		var resp DialResponseDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &resp); err == nil {
+			a.responded(resp)
+		}
+	}
+}
+
+// server side, dial back to the address the request came from and never to others
+func (a *AutoNAT) dialBack(req DialRequestDiagram, addr *net.UDPAddr) {
+	if !a.allowDialBack() {
+		logger.Debug("too many dial-back requests, drop the one from %v", req.NodeID)
+		return
+	}
+	resp := DialResponseDiagram{
+		UDPDiagram: a.newDiagram(AUTONAT_DIAGRAM_RESPONSE),
+		Nonce:      req.Nonce,
+		ObservedIP: addr.IP.String(),
+	}
+
+	// from a fresh socket, the NAT of the requester has not seen it yet
+	back := DialBackDiagram{
+		UDPDiagram: a.newDiagram(AUTONAT_DIAGRAM_DIALBACK),
+		Nonce:      req.Nonce,
+	}
+	if conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.IP, Port: req.UDPPort}); err == nil {
+		conn.Write(utils.DiagramToBytes(back))
+		conn.Close()
+	} else {
+		resp.Error = err.Error()
+	}
+
+	if a.prober != nil && req.TCPPort > 0 {
+		if err := a.prober.Probe(addr.IP, req.TCPPort, AUTONAT_DIAL_TIMEOUT); err == nil {
+			resp.TCPOK = true
+		} else {
+			logger.Trace("tcp dial-back to %v:%v failed: %v", addr.IP, req.TCPPort, err)
+		}
+	}
+	a.network.Send(addr.IP, addr.Port, utils.DiagramToBytes(resp), req.NodeID)
+}
+
+func (a *AutoNAT) allowDialBack() bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if time.Since(a.servedAt) > time.Minute {
+		a.served = 0
+		a.servedAt = time.Now()
+	}
+	if a.served >= AUTONAT_SERVER_RATE {
+		return false
+	}
+	a.served++
+	return true
+}
+
+// client side, count the vote once the dial-back had the chance to arrive
+func (a *AutoNAT) responded(resp DialResponseDiagram) {
+	a.mux.Lock()
+	r, ok := a.pending[resp.Nonce]
+	a.mux.Unlock()
+	if !ok || r.peerID != resp.NodeID {
+		return
+	}
+	ip := net.ParseIP(resp.ObservedIP)
+	if ip == nil {
+		return
+	}
+	time.AfterFunc(AUTONAT_DIALBACK_GRACE, func() {
+		a.mux.Lock()
+		delete(a.pending, resp.Nonce)
+		addr := &addrVotes{ip: ip, udpPort: r.udpPort, tcpPort: r.tcpPort, byPeer: make(map[string]*vote)}
+		if existing, ok := a.votes[addr.String()]; ok {
+			addr = existing
+		} else {
+			a.votes[addr.String()] = addr
+		}
+		addr.byPeer[r.peerID] = &vote{udp: r.udpOK, tcp: resp.TCPOK, at: time.Now()}
+		a.mux.Unlock()
+		logger.Debug("%v dialed back to %v: udp %v, tcp %v", r.peerID, addr, r.udpOK, resp.TCPOK)
+		a.decide()
+	})
+}
+
+// public when a quorum reached one address, private when a quorum failed on all of them
+func (a *AutoNAT) decide() {
+	a.mux.Lock()
+	var best *addrVotes
+	bestYes, bestTCPYes, bestVotes := 0, 0, 0
+	failed := make(map[string]bool)
+	for key, addr := range a.votes {
+		yes, no, tcpYes := 0, 0, 0
+		for peerID, v := range addr.byPeer {
+			if time.Since(v.at) > AUTONAT_VOTE_TTL {
+				delete(addr.byPeer, peerID)
+				continue
+			}
+			if v.udp {
+				yes++
+			} else {
+				no++
+				failed[peerID] = true
+			}
+			if v.tcp {
+				tcpYes++
+			}
+		}
+		if len(addr.byPeer) == 0 {
+			delete(a.votes, key)
+			continue
+		}
+		if yes >= AUTONAT_QUORUM && yes > no && yes > bestYes {
+			best, bestYes, bestTCPYes, bestVotes = addr, yes, tcpYes, yes+no
+		}
+	}
+
+	old := a.status
+	switch {
+	case best != nil:
+		a.status = Status{Reachability: node.REACHABILITY_PUBLIC, TCPReachable: bestTCPYes >= AUTONAT_QUORUM, Address: best.String(), Votes: bestVotes}
+	case len(failed) >= AUTONAT_QUORUM:
+		a.status = Status{Reachability: node.REACHABILITY_PRIVATE, Votes: len(failed)}
+	default:
+		a.status = Status{Reachability: node.REACHABILITY_UNKNOWN}
+	}
+	status := a.status
+	a.mux.Unlock()
+
+	switch status.Reachability {
+	case node.REACHABILITY_PUBLIC:
+		tcpPort := best.tcpPort
+		if !status.TCPReachable {
+			tcpPort = 0
+		}
+		a.localNode.ConfirmRemoteAddr(best.ip, best.udpPort, tcpPort)
+	case node.REACHABILITY_PRIVATE:
+		a.localNode.RevokeRemoteAddrs()
+	}
+	a.localNode.SetReachability(status.Reachability)
+	if old.Reachability != status.Reachability || old.Address != status.Address {
+		logger.Info("reachability is %v %v", status.Reachability, status.Address)
+	}
+}
+
+func (a *AutoNAT) newDiagram(dType string) models.UDPDiagram {
+	ts := time.Now().Unix()
+	return models.UDPDiagram{
+		NetworkDiagram: models.NetworkDiagram{
+			ID:        utils.NewUUID(),
+			NodeID:    a.localNode.GetID(),
+			Timestamp: ts,
+			DCategory: AUTONAT_DIAGRAM_CATEGORY,
+			DType:     dType,
+			Version:   models.UDP_DIAGRAM_VERSION,
+		},
+		Expire:    ts + int64(models.DEFAULT_TIMEOUT),
+		LocalAddr: a.localNode.GetLocalIP().String(),
+		LocalPort: a.localNode.GetLocalPort(),
+	}
+}
@@ -0,0 +1,35 @@
+package autonat
+
+import (
+	"github.com/symphonyprotocol/p2p/models"
+)
+
+var (
+	AUTONAT_DIAGRAM_CATEGORY = "AUTONAT"
+	AUTONAT_DIAGRAM_REQUEST  = "DIALREQ"
+	AUTONAT_DIAGRAM_DIALBACK = "DIALBACK"
+	AUTONAT_DIAGRAM_RESPONSE = "DIALRESP"
+)
+
+// asks a peer to dial us back at the ip it sees the request from, on these ports
+type DialRequestDiagram struct {
+	models.UDPDiagram
+	Nonce   string
+	UDPPort int
+	TCPPort int
+}
+
+// sent to the udp port from another socket of the peer, receiving it proves the port is reachable
+type DialBackDiagram struct {
+	models.UDPDiagram
+	Nonce string
+}
+
+// the result of the dial-backs as seen by the peer
+type DialResponseDiagram struct {
+	models.UDPDiagram
+	Nonce      string
+	ObservedIP string
+	TCPOK      bool
+	Error      string
+}
@@ -0,0 +1,126 @@
+package bootstrap
+
+import (
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+var (
+	logger = log.GetLogger("bootstrap")
+
+	// first retry delay when the table is still empty, doubled on every failed round
+	DEFAULT_MIN_BACKOFF = 2 * time.Second
+	DEFAULT_MAX_BACKOFF = 2 * time.Minute
+	// how often to check whether the table became empty again
+	DEFAULT_CHECK_INTERVAL = 10 * time.Second
+)
+
+// ISource provides bootnodes from somewhere: a file, the environment, DNS...
+type ISource interface {
+	Name() string
+	Load() ([]config.StaticNode, error)
+}
+
+// Bootstrapper combines several sources and keeps seeding the node table until it is populated.
+// The fallback source is only consulted when all the other sources come back empty.
+type Bootstrapper struct {
+	sources       []ISource
+	fallback      ISource
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	CheckInterval time.Duration
+}
+
+func NewBootstrapper(fallback ISource, sources ...ISource) *Bootstrapper {
+	return &Bootstrapper{
+		sources:       sources,
+		fallback:      fallback,
+		MinBackoff:    DEFAULT_MIN_BACKOFF,
+		MaxBackoff:    DEFAULT_MAX_BACKOFF,
+		CheckInterval: DEFAULT_CHECK_INTERVAL,
+	}
+}
+
+// env overrides first, then the config file and dns seeds, the hard-coded list as fallback
+func NewDefaultBootstrapper() *Bootstrapper {
+	b := NewBootstrapper(NewStaticSource())
+	b.AddSource(NewEnvSource(config.BOOTNODES_ENV))
+	b.AddSource(NewFileSource(config.CONFIG_FILE))
+	for _, domain := range config.DNS_SEEDS {
+		b.AddSource(NewDNSSource(domain))
+	}
+	for _, domain := range splitList(getEnv(config.DNS_SEEDS_ENV)) {
+		b.AddSource(NewDNSSource(domain))
+	}
+	return b
+}
+
+// sources added earlier win when the same node id shows up in several sources
+func (b *Bootstrapper) AddSource(src ISource) {
+	b.sources = append(b.sources, src)
+}
+
+// Prepend a source so it takes priority over all the existing ones, e.g. cli flags
+func (b *Bootstrapper) PrependSource(src ISource) {
+	b.sources = append([]ISource{src}, b.sources...)
+}
+
+func (b *Bootstrapper) Load() []config.StaticNode {
+	nodes := make([]config.StaticNode, 0)
+	seen := make(map[string]bool)
+	collect := func(src ISource) {
+		loaded, err := src.Load()
+		if err != nil {
+			logger.Debug("bootstrap source %v failed: %v", src.Name(), err)
+			return
+		}
+		logger.Trace("bootstrap source %v got %v nodes", src.Name(), len(loaded))
+		for _, n := range loaded {
+			if seen[n.ID] {
+				continue
+			}
+			seen[n.ID] = true
+			nodes = append(nodes, n)
+		}
+	}
+
+	for _, src := range b.sources {
+		collect(src)
+	}
+	if len(nodes) == 0 && b.fallback != nil {
+		collect(b.fallback)
+	}
+	return nodes
+}
+
+// Run blocks and seeds the table whenever populated() reports false, retrying with exponential backoff.
+func (b *Bootstrapper) Run(populated func() bool, seed func([]config.StaticNode), quit <-chan struct{}) {
+	backoff := b.MinBackoff
+	for {
+		wait := b.CheckInterval
+		if !populated() {
+			nodes := b.Load()
+			if len(nodes) == 0 {
+				logger.Warn("no bootnodes available, retry in %v", backoff)
+			} else {
+				logger.Debug("seeding table with %v bootnodes, next check in %v", len(nodes), backoff)
+				seed(nodes)
+			}
+			wait = backoff
+			backoff *= 2
+			if backoff > b.MaxBackoff {
+				backoff = b.MaxBackoff
+			}
+		} else {
+			backoff = b.MinBackoff
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+var (
+	DNS_LOOKUP_TIMEOUT = 5 * time.Second
+	// optional prefix of the TXT record values, e.g. "symnode=id@ip:port"
+	DNS_TXT_PREFIX = "symnode="
+)
+
+// DNSSource reads bootnodes from the TXT records of a domain.
+// Each record holds one or more "id@ip:port" specs.
+type DNSSource struct {
+	domain   string
+	resolver *net.Resolver
+}
+
+func NewDNSSource(domain string) *DNSSource {
+	return &DNSSource{domain: domain, resolver: net.DefaultResolver}
+}
+
+// use a specific dns server (host:port) instead of the system one, e.g. a local stand-in
+func NewDNSSourceWithServer(domain string, server string) *DNSSource {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{Timeout: DNS_LOOKUP_TIMEOUT}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return &DNSSource{domain: domain, resolver: resolver}
+}
+
+func (d *DNSSource) Name() string { return "dns:" + d.domain }
+
+func (d *DNSSource) Load() ([]config.StaticNode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_LOOKUP_TIMEOUT)
+	defer cancel()
+	records, err := d.resolver.LookupTXT(ctx, d.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make([]string, 0)
+	for _, record := range records {
+		for _, spec := range splitList(record) {
+			specs = append(specs, strings.TrimPrefix(spec, DNS_TXT_PREFIX))
+		}
+	}
+	return parseNodeSpecs(specs)
+}
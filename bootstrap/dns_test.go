@@ -0,0 +1,147 @@
+package bootstrap
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+const (
+	testID1 = "c4ef0694fee0cdf78eab30c83b325293047e0b27511b92e8e206b199b24f13ea"
+	testID2 = "e9fa8677cdff28ccc9a0f27d74b032e62deba74c5adc05b394a90182e596726d"
+)
+
+// dnsStandIn answers the TXT queries of the domains in records over udp, the others with NXDOMAIN
+type dnsStandIn struct {
+	conn    *net.UDPConn
+	records map[string][]string
+}
+
+func newDNSStandIn(t *testing.T, records map[string][]string) *dnsStandIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsStandIn{conn: conn, records: records}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func (s *dnsStandIn) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *dnsStandIn) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (s *dnsStandIn) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil
+	}
+	// the question: labels, type and class
+	labels := make([]string, 0)
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+	end := i + 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(query[i+1 : i+3])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	records, ok := s.records[name]
+	resp := make([]byte, 12, 512)
+	copy(resp[0:2], query[0:2])
+	// response, authoritative, recursion desired and available
+	flags := uint16(0x8000 | 0x0400 | 0x0100 | 0x0080)
+	if !ok {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	resp = append(resp, question...)
+	if !ok || qtype != 16 {
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(records)))
+	for _, record := range records {
+		// a pointer to the name of the question, TXT, IN, ttl 60
+		resp = append(resp, 0xc0, 12, 0, 16, 0, 1, 0, 0, 0, 60)
+		rdata := []byte{byte(len(record))}
+		rdata = append(rdata, record...)
+		resp = append(resp, byte(len(rdata)>>8), byte(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func TestDNSSourceLoad(t *testing.T) {
+	server := newDNSStandIn(t, map[string][]string{
+		"seed.symphony.test": {
+			DNS_TXT_PREFIX + testID1 + "@10.0.0.1:32768",
+			testID2 + "@10.0.0.2:32769, " + testID2 + "@[::1]:32770",
+			"v=spf1 -all",
+		},
+	})
+	nodes, err := NewDNSSourceWithServer("seed.symphony.test.", server.addr()).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("got %v nodes, want 3: %v", len(nodes), nodes)
+	}
+	if nodes[0].ID != testID1 || nodes[0].IP != "10.0.0.1" || nodes[0].Port != 32768 {
+		t.Errorf("the prefix is not stripped: %+v", nodes[0])
+	}
+	if nodes[1].ID != testID2 || nodes[1].Port != 32769 {
+		t.Errorf("first spec of a list: %+v", nodes[1])
+	}
+	if nodes[2].IP != "::1" || nodes[2].Port != 32770 {
+		t.Errorf("ipv6 spec: %+v", nodes[2])
+	}
+}
+
+func TestDNSSourceNotFound(t *testing.T) {
+	server := newDNSStandIn(t, map[string][]string{})
+	if nodes, err := NewDNSSourceWithServer("missing.symphony.test.", server.addr()).Load(); err == nil {
+		t.Fatalf("expected an error, got %v", nodes)
+	}
+}
+
+func TestBootstrapperDNSPriority(t *testing.T) {
+	server := newDNSStandIn(t, map[string][]string{
+		"seed.symphony.test": {testID1 + "@10.0.0.1:1", testID2 + "@10.0.0.2:2"},
+	})
+	b := NewBootstrapper(nil, NewListSource("flag", []string{testID1 + "@192.168.1.1:3"}), NewDNSSourceWithServer("seed.symphony.test.", server.addr()))
+	nodes := b.Load()
+	if len(nodes) != 2 {
+		t.Fatalf("got %v nodes, want 2: %v", len(nodes), nodes)
+	}
+	// the node in both sources comes from the first one
+	if nodes[0].ID != testID1 || nodes[0].IP != "192.168.1.1" {
+		t.Errorf("the earlier source should win: %+v", nodes[0])
+	}
+	if nodes[1].ID != testID2 || nodes[1].IP != "10.0.0.2" {
+		t.Errorf("the dns node is missing: %+v", nodes[1])
+	}
+}
@@ -0,0 +1,124 @@
+package bootstrap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+// the hard-coded list in config
+type StaticSource struct{}
+
+func NewStaticSource() *StaticSource { return &StaticSource{} }
+
+func (s *StaticSource) Name() string { return "static" }
+
+func (s *StaticSource) Load() ([]config.StaticNode, error) {
+	return config.DefaultStaticNodes().Nodes, nil
+}
+
+// a json file in the same format as ~/.symchaincfg
+type FileSource struct {
+	path string
+}
+
+func NewFileSource(path string) *FileSource { return &FileSource{path: path} }
+
+func (f *FileSource) Name() string { return "file:" + f.path }
+
+func (f *FileSource) Load() ([]config.StaticNode, error) {
+	nodes, err := config.LoadStaticNodesFromFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return nodes.Nodes, nil
+}
+
+// a fixed list of "id@ip:port" specs, used for cli flags
+type ListSource struct {
+	name  string
+	specs []string
+}
+
+func NewListSource(name string, specs []string) *ListSource {
+	return &ListSource{name: name, specs: specs}
+}
+
+// parse a comma separated flag value like "id1@1.2.3.4:32768,id2@5.6.7.8:32768"
+func NewFlagSource(value string) *ListSource {
+	return NewListSource("flag", splitList(value))
+}
+
+func (l *ListSource) Name() string { return l.name }
+
+func (l *ListSource) Load() ([]config.StaticNode, error) {
+	return parseNodeSpecs(l.specs)
+}
+
+// a comma separated list read from an environment variable on every load
+type EnvSource struct {
+	variable string
+}
+
+func NewEnvSource(variable string) *EnvSource { return &EnvSource{variable: variable} }
+
+func (e *EnvSource) Name() string { return "env:" + e.variable }
+
+func (e *EnvSource) Load() ([]config.StaticNode, error) {
+	return parseNodeSpecs(splitList(getEnv(e.variable)))
+}
+
+// ParseNodeSpec parses "id@ip:port", ipv6 addresses need brackets: "id@[::1]:32768"
+func ParseNodeSpec(spec string) (config.StaticNode, error) {
+	var n config.StaticNode
+	parts := strings.SplitN(strings.TrimSpace(spec), "@", 2)
+	if len(parts) != 2 {
+		return n, fmt.Errorf("invalid node spec %q, expected id@ip:port", spec)
+	}
+	if id, err := hex.DecodeString(parts[0]); err != nil || len(id) == 0 {
+		return n, fmt.Errorf("invalid node id in %q", spec)
+	}
+	host, portStr, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		return n, fmt.Errorf("invalid address in %q: %v", spec, err)
+	}
+	if net.ParseIP(host) == nil {
+		return n, fmt.Errorf("invalid ip in %q", spec)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return n, fmt.Errorf("invalid port in %q", spec)
+	}
+	n.ID = parts[0]
+	n.IP = host
+	n.Port = port
+	return n, nil
+}
+
+func parseNodeSpecs(specs []string) ([]config.StaticNode, error) {
+	nodes := make([]config.StaticNode, 0, len(specs))
+	for _, spec := range specs {
+		n, err := ParseNodeSpec(spec)
+		if err != nil {
+			logger.Warn("%v", err)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func getEnv(variable string) string {
+	return os.Getenv(variable)
+}
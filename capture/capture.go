@@ -0,0 +1,158 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+)
+
+var logger = log.GetLogger("capture")
+
+var (
+	DIRECTION_IN  = "in"
+	DIRECTION_OUT = "out"
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+
+	// records longer than this are skipped by the reader, far above any diagram
+	MAX_RECORD_SIZE = 16 * 1024 * 1024
+)
+
+// Packet is one diagram on the wire as written to a capture file, one json object per line
+type Packet struct {
+	// unix nanoseconds
+	Time      int64  `json:"time"`
+	Transport string `json:"transport"`
+	Direction string `json:"direction"`
+	// the remote "ip:port"
+	Peer   string `json:"peer"`
+	NodeID string `json:"nodeId,omitempty"`
+	// the gzip+json bytes as sent, base64 in the file
+	Data []byte `json:"data"`
+}
+
+func (p *Packet) GetTime() time.Time { return time.Unix(0, p.Time) }
+
+// Recorder appends the packets to a capture file, it is safe to share between the services
+type Recorder struct {
+	mux    sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	count  uint64
+	closed bool
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("capturing the traffic to %v", path)
+	return &Recorder{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Record copies data, the caller may reuse it. A nil recorder records nothing.
+func (r *Recorder) Record(transport string, direction string, peer net.Addr, nodeID string, data []byte) {
+	if r == nil {
+		return
+	}
+	p := Packet{
+		Time:      time.Now().UnixNano(),
+		Transport: transport,
+		Direction: direction,
+		NodeID:    nodeID,
+		Data:      data,
+	}
+	if peer != nil {
+		p.Peer = peer.String()
+	}
+	line, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.closed {
+		return
+	}
+	r.writer.Write(append(line, '\n'))
+	// flushed right away so that a crash keeps the packets leading to it
+	if err := r.writer.Flush(); err != nil {
+		logger.Error("write capture: %v", err)
+	}
+	r.count++
+}
+
+// GetCount returns the packets recorded so far
+func (r *Recorder) GetCount() uint64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.count
+}
+
+func (r *Recorder) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.writer.Flush()
+	return r.file.Close()
+}
+
+// Reader reads the packets of a capture file in order
+type Reader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	line    int
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_SIZE)
+	return &Reader{scanner: scanner}
+}
+
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := NewReader(file)
+	reader.closer = file
+	return reader, nil
+}
+
+// Next returns io.EOF after the last packet, lines which can't be parsed are skipped
+func (r *Reader) Next() (*Packet, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+		var p Packet
+		if err := json.Unmarshal(r.scanner.Bytes(), &p); err != nil {
+			logger.Warn("skip line %v of the capture: %v", r.line, err)
+			continue
+		}
+		return &p, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *Reader) Close() error {
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Diagram returns the json of the packet, the multipart chunks of tcp are not joined
+func (p *Packet) Diagram() ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p.Data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// the header every diagram has
+type header struct {
+	ID          string
+	NodeID      string
+	DCategory   string
+	DType       string
+	ChunkNo     int
+	ChunksCount int
+}
+
+// Print writes a summary line and the indented diagram of the packet
+func Print(w io.Writer, p *Packet) error {
+	fmt.Fprintf(w, "%v %v %-3v %-21v %v bytes",
+		p.GetTime().Format("2006-01-02 15:04:05.000000"), p.Transport, p.Direction, p.Peer, len(p.Data))
+	data, err := p.Diagram()
+	if err != nil {
+		_, err = fmt.Fprintf(w, " undecodable: %v\n", err)
+		return err
+	}
+	var h header
+	if err := json.Unmarshal(data, &h); err == nil {
+		fmt.Fprintf(w, " %v/%v id=%v node=%v", h.DCategory, h.DType, h.ID, h.NodeID)
+		if h.ChunksCount > 0 {
+			fmt.Fprintf(w, " chunk=%v/%v", h.ChunkNo+1, h.ChunksCount)
+		}
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "  ", "  "); err != nil {
+		indented.Reset()
+		indented.Write(data)
+	}
+	_, err = fmt.Fprintf(w, "\n  %s\n", indented.Bytes())
+	return err
+}
+
+// Filter selects the packets to print or replay, empty fields match everything
+type Filter struct {
+	Transport string
+	Direction string
+	Peer      string
+	NodeID    string
+	Category  string
+}
+
+func (f Filter) Match(p *Packet) bool {
+	if (f.Transport != "" && f.Transport != p.Transport) ||
+		(f.Direction != "" && f.Direction != p.Direction) ||
+		(f.Peer != "" && f.Peer != p.Peer) ||
+		(f.NodeID != "" && f.NodeID != p.NodeID) {
+		return false
+	}
+	if f.Category != "" {
+		data, err := p.Diagram()
+		if err != nil {
+			return false
+		}
+		var h header
+		if json.Unmarshal(data, &h) != nil || h.DCategory != f.Category {
+			return false
+		}
+	}
+	return true
+}
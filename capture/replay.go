@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// IInjector takes a recorded inbound packet as if it came from peer
+type IInjector interface {
+	Inject(data []byte, peer string, nodeID string) error
+}
+
+// Replay feeds the inbound packets matching the filter to the injector of their transport.
+// speed 1 keeps the recorded gaps, 2 halves them, 0 replays as fast as possible.
+// A nil injector skips its transport. Returns the packets injected.
+func Replay(r *Reader, filter Filter, udp IInjector, tcp IInjector, speed float64) (int, error) {
+	filter.Direction = DIRECTION_IN
+	injected := 0
+	var last int64
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return injected, nil
+		}
+		if err != nil {
+			return injected, err
+		}
+		if !filter.Match(p) {
+			continue
+		}
+		injector := udp
+		if p.Transport == TRANSPORT_TCP {
+			injector = tcp
+		}
+		if injector == nil {
+			continue
+		}
+		if speed > 0 && last != 0 && p.Time > last {
+			time.Sleep(time.Duration(float64(p.Time-last) / speed))
+		}
+		last = p.Time
+		if err := injector.Inject(p.Data, p.Peer, p.NodeID); err != nil {
+			logger.Warn("skip packet from %v: %v", p.Peer, err)
+			continue
+		}
+		injected++
+	}
+}
+
+// Sink takes the packets a replaying node sends, in place of the network
+type Sink func(transport string, peer net.Addr, nodeID string, data []byte)
+
+// DiscardSink drops the packets
+func DiscardSink(transport string, peer net.Addr, nodeID string, data []byte) {}
+
+// LogSink logs a line per packet and drops it
+func LogSink(transport string, peer net.Addr, nodeID string, data []byte) {
+	summary := fmt.Sprintf("%v %v bytes to %v", transport, len(data), peer)
+	p := &Packet{Data: data}
+	var h header
+	if diagram, err := p.Diagram(); err == nil && json.Unmarshal(diagram, &h) == nil {
+		summary += fmt.Sprintf(" %v/%v id=%v", h.DCategory, h.DType, h.ID)
+	}
+	logger.Debug("replay discards %v", summary)
+}
@@ -35,10 +35,42 @@ var (
 	DEFAULT_UDP_PORT = 32768
 	DEFAULT_TCP_PORT = 32768
 	DEFAULT_NET_WORK = "MINOR"
+	// listen on all addresses of both ip families instead of the outbound ip only
+	DUAL_STACK = true
+	// act as a circuit relay for unreachable peers when this node is public
+	RELAY_SERVICE_ENABLED = true
+	// reserve a slot on public relays when this node is not public
+	RELAY_CLIENT_ENABLED = true
+	// map the ports on the gateway with PCP, NAT-PMP or UPnP
+	NAT_ENABLED = true
+	// "ip" or "ip:port" of the PCP / NAT-PMP gateway, the default route when empty
+	NAT_GATEWAY = ""
+	// url of the UPnP device description, searched by SSDP when empty
+	NAT_UPNP_LOCATION = ""
+	// find the nodes on the local network with a multicast beacon, off as it announces the node to the whole lan
+	LAN_DISCOVERY_ENABLED = false
+	LAN_MULTICAST_ADDR    = "239.255.77.77:32767"
+	// "host:port" serving the prometheus metrics at /metrics, disabled when empty
+	METRICS_ADDR = ""
+	// "host:port" of the admin http api, disabled when empty. Keep it on a loopback address
+	ADMIN_ADDR = ""
+	// bearer token of the admin api, the env variable overrides it. The api is not served without one
+	ADMIN_TOKEN     = ""
+	ADMIN_TOKEN_ENV = "SYMCHAIN_ADMIN_TOKEN"
+	// file recording every udp and tcp diagram sent and received, disabled when empty
+	CAPTURE_FILE = ""
+	// the nodes the contexts broadcast and gossip to, "kad" for one node per bucket or "hyparview" for the active view
+	BROADCAST_OVERLAY = "kad"
 	
 	CURRENT_USER, _ = user.Current()
 	LEVEL_DB_FILE = CURRENT_USER.HomeDir + "/.symchaindb"
 	CONFIG_FILE = CURRENT_USER.HomeDir + "/.symchaincfg"
+
+	// comma separated bootnodes in "id@ip:port" format, overrides the config file
+	BOOTNODES_ENV = "SYMCHAIN_BOOTNODES"
+	// comma separated domains whose TXT records list bootnodes
+	DNS_SEEDS_ENV = "SYMCHAIN_DNS_SEEDS"
+	DNS_SEEDS     = []string{}
 )
 
 type StaticNodes struct {
@@ -53,15 +85,28 @@ type StaticNode struct {
 }
 
 func LoadStaticNodes() StaticNodes {
-	var nodes StaticNodes
-	nodeList, err := ioutil.ReadFile(CONFIG_FILE)
+	nodes, err := LoadStaticNodesFromFile(CONFIG_FILE)
 	if err != nil {
-		err = json.Unmarshal(staticNodeList, &nodes)
-	} else {
-		err = json.Unmarshal(nodeList, &nodes)
+		return DefaultStaticNodes()
 	}
-	if err != nil {
+	return nodes
+}
+
+// the hard-coded node list shipped with the binary
+func DefaultStaticNodes() StaticNodes {
+	var nodes StaticNodes
+	if err := json.Unmarshal(staticNodeList, &nodes); err != nil {
 		panic(err)
 	}
 	return nodes
 }
+
+func LoadStaticNodesFromFile(path string) (StaticNodes, error) {
+	var nodes StaticNodes
+	nodeList, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nodes, err
+	}
+	err = json.Unmarshal(nodeList, &nodes)
+	return nodes, err
+}
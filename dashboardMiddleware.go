@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"fmt"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
@@ -9,12 +10,15 @@ import (
 
 	ui "github.com/strawhatboy/termui"
 	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/netsize"
 	"github.com/symphonyprotocol/p2p/tcp"
 )
 
 var dmLogger = log.GetLogger("dashboard")
 
 type DashboardMiddleware struct {
+	// P2PServer.SizeEstimator(), the network size is left out when nil
+	SizeEstimator *netsize.Estimator
 }
 
 func (d *DashboardMiddleware) Handle(ctx *tcp.P2PContext) {
@@ -93,10 +97,15 @@ func (d *DashboardMiddleware) Start(ctx *tcp.P2PContext) {
 			ls.Rows = [][]string{
 				[]string{"Id:", localNode.GetID()},
 				[]string{"PubKey:", localNode.GetPublicKey()},
-				[]string{"Local Address:", fmt.Sprintf("%v:%v", localNode.GetLocalIP().String(), localNode.GetLocalPort())},
-				[]string{"Remote Address:", fmt.Sprintf("%v:%v", localNode.GetRemoteIP().String(), localNode.GetRemotePort())},
+				[]string{"Local Address:", net.JoinHostPort(localNode.GetLocalIP().String(), strconv.Itoa(localNode.GetLocalPort()))},
+				[]string{"Local IPs:", fmt.Sprintf("%v", localNode.GetLocalIPs())},
+				[]string{"Remote Address:", net.JoinHostPort(localNode.GetRemoteIP().String(), strconv.Itoa(localNode.GetRemotePort()))},
+				[]string{"Reachability:", localNode.GetReachability().String()},
 				[]string{"Up time:", fmt.Sprintf("%v", uptime)},
 			}
+			if size := getNetworkSize(d.SizeEstimator); size != nil {
+				ls.Rows = append(ls.Rows, []string{"Network size:", size.String()})
+			}
 
 			ls.Height = len(ls.Rows) + 2
 			ls.Analysis()
@@ -109,7 +118,7 @@ func (d *DashboardMiddleware) Start(ctx *tcp.P2PContext) {
 				tUdpPeers.Rows = append(tUdpPeers.Rows, []string{
 					" ",
 					peer.GetID(),
-					fmt.Sprintf("%v:%v", peer.GetRemoteIP().String(), peer.GetRemotePort()),
+					net.JoinHostPort(peer.GetRemoteIP().String(), strconv.Itoa(peer.GetRemotePort())),
 					strconv.Itoa(peer.Latency),
 					fmt.Sprintf("%v", peer.LastActiveTime),
 				})
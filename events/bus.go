@@ -0,0 +1,90 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// buffered events per subscription, more are dropped for that subscriber
+	DEFAULT_BUFFER_SIZE = 64
+)
+
+// Bus hands every published event to the subscriptions interested in its type.
+// Publishing never blocks, a subscriber that falls behind loses events.
+type Bus struct {
+	mux  sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+type Subscription struct {
+	bus     *Bus
+	ch      chan IEvent
+	types   map[string]bool
+	dropped uint64
+	once    sync.Once
+}
+
+// Subscribe receives the events of the given types, all of them without types.
+// A bufferSize <= 0 takes DEFAULT_BUFFER_SIZE.
+func (b *Bus) Subscribe(bufferSize int, types ...string) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	s := &Subscription{bus: b, ch: make(chan IEvent, bufferSize)}
+	if len(types) > 0 {
+		s.types = make(map[string]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish stamps the event and delivers it, a nil bus drops it
+func (b *Bus) Publish(e IEvent) {
+	if b == nil {
+		return
+	}
+	if s, ok := e.(stamper); ok {
+		s.stamp()
+	}
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	for s := range b.subs {
+		if s.types != nil && !s.types[e.EventType()] {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Events is closed when the subscription is closed
+func (s *Subscription) Events() <-chan IEvent {
+	return s.ch
+}
+
+// Dropped counts the events lost because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mux.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mux.Unlock()
+		close(s.ch)
+	})
+}
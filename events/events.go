@@ -0,0 +1,132 @@
+package events
+
+import (
+	"net"
+	"time"
+)
+
+// EVENT_* are the types subscribers filter on
+var (
+	EVENT_PEER_DISCOVERED     = "PeerDiscovered"
+	EVENT_BUCKET_NODE_ADDED   = "BucketNodeAdded"
+	EVENT_BUCKET_NODE_EVICTED = "BucketNodeEvicted"
+	EVENT_CONNECTION_OPENED   = "ConnectionOpened"
+	EVENT_CONNECTION_CLOSED   = "ConnectionClosed"
+	EVENT_IDENTIFY_COMPLETED  = "IdentifyCompleted"
+	EVENT_ADDRESS_CHANGED     = "AddressChanged"
+	EVENT_NAT_STATUS_CHANGED  = "NATStatusChanged"
+	EVENT_MESSAGE_DROPPED     = "MessageDropped"
+)
+
+// IEvent is implemented by all the events, subscribers switch on the concrete type
+type IEvent interface {
+	EventType() string
+	EventTime() time.Time
+}
+
+// At is embedded by the events and set when they are published
+type At struct {
+	Time time.Time
+}
+
+func (a At) EventTime() time.Time { return a.Time }
+
+func (a *At) stamp() {
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+}
+
+type stamper interface {
+	stamp()
+}
+
+// PeerDiscovered is a node which was not in the table, published once it is added to its bucket
+type PeerDiscovered struct {
+	At
+	NodeID string
+	IP     net.IP
+	Port   int
+	// how we learnt about it, e.g. "contact", "findnode" or "introduce"
+	Source string
+}
+
+func (e *PeerDiscovered) EventType() string { return EVENT_PEER_DISCOVERED }
+
+type BucketNodeAdded struct {
+	At
+	NodeID   string
+	Distance int
+}
+
+func (e *BucketNodeAdded) EventType() string { return EVENT_BUCKET_NODE_ADDED }
+
+type BucketNodeEvicted struct {
+	At
+	NodeID   string
+	Distance int
+	Reason   string
+}
+
+func (e *BucketNodeEvicted) EventType() string { return EVENT_BUCKET_NODE_EVICTED }
+
+type ConnectionOpened struct {
+	At
+	NodeID     string
+	RemoteAddr string
+	IsInbound  bool
+	IsRelayed  bool
+}
+
+func (e *ConnectionOpened) EventType() string { return EVENT_CONNECTION_OPENED }
+
+type ConnectionClosed struct {
+	At
+	NodeID     string
+	RemoteAddr string
+	IsInbound  bool
+	IsRelayed  bool
+	Reason     string
+}
+
+func (e *ConnectionClosed) EventType() string { return EVENT_CONNECTION_CLOSED }
+
+// IdentifyCompleted is a node which sent us a valid signed record
+type IdentifyCompleted struct {
+	At
+	NodeID       string
+	Seq          uint64
+	Capabilities []string
+}
+
+func (e *IdentifyCompleted) EventType() string { return EVENT_IDENTIFY_COMPLETED }
+
+// AddressChanged is a change of the advertised remote address, Revoked if we stopped advertising it
+type AddressChanged struct {
+	At
+	IP      net.IP
+	Port    int
+	TCPPort int
+	Revoked bool
+}
+
+func (e *AddressChanged) EventType() string { return EVENT_ADDRESS_CHANGED }
+
+type NATStatusChanged struct {
+	At
+	Reachability string
+	Previous     string
+}
+
+func (e *NATStatusChanged) EventType() string { return EVENT_NAT_STATUS_CHANGED }
+
+// MessageDropped is a message which never reached its handler
+type MessageDropped struct {
+	At
+	Transport string
+	Category  string
+	From      string
+	Reason    string
+}
+
+func (e *MessageDropped) EventType() string { return EVENT_MESSAGE_DROPPED }
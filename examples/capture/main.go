@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p"
+	"github.com/symphonyprotocol/p2p/capture"
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+var (
+	fTransport = flag.String("transport", "", "only the packets of this transport, udp or tcp")
+	fDirection = flag.String("direction", "", "only the packets of this direction when decoding, in or out")
+	fPeer      = flag.String("peer", "", "only the packets from or to this ip:port")
+	fNode      = flag.String("node", "", "only the packets of this node id")
+	fCategory  = flag.String("category", "", "only the diagrams of this category")
+	fSpeed     = flag.Float64("speed", 1, "replay speed, 2 halves the recorded gaps, 0 replays as fast as possible")
+	fPort      = flag.Int("port", 0, "udp and tcp port of the replaying node, the default port when 0")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %v [flags] decode|replay <capture file>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	filter := capture.Filter{
+		Transport: *fTransport,
+		Direction: *fDirection,
+		Peer:      *fPeer,
+		NodeID:    *fNode,
+		Category:  *fCategory,
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "decode":
+		err = decode(flag.Arg(1), filter)
+	case "replay":
+		err = replay(flag.Arg(1), filter)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func decode(path string, filter capture.Filter) error {
+	reader, err := capture.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for {
+		p, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if filter.Match(p) {
+			if err := capture.Print(os.Stdout, p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// feed the recorded inbound traffic to a node which only logs what it would send
+func replay(path string, filter capture.Filter) error {
+	log.SetGlobalLevel(log.TRACE)
+	log.Configure(map[string]([]log.Appender){
+		"default": []log.Appender{log.NewConsoleAppender()},
+	})
+	if *fPort != 0 {
+		config.DEFAULT_UDP_PORT = *fPort
+		config.DEFAULT_TCP_PORT = *fPort
+	}
+	srv := p2p.NewP2PServer()
+	srv.Use(&p2p.BlockSyncMiddleware{})
+	srv.Use(p2p.NewFileTransferMiddleware())
+	srv.StartReplay(capture.LogSink)
+	n, err := srv.Replay(path, filter, *fSpeed)
+	fmt.Printf("replayed %v packets\n", n)
+	return err
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/nat"
+	"github.com/symphonyprotocol/p2p/bootstrap"
+	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/encrypt"
+	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/ratelimit"
+	"github.com/symphonyprotocol/p2p/udp"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	fBootnodes = flag.String("bootnodes", "", "comma separated bootnodes in id@ip:port format, the configured ones when empty")
+	fPort      = flag.Int("port", 0, "udp port of the crawler, a free one when 0")
+	fOut       = flag.String("out", "crawl.json", "write the nodes to this json file, - for stdout")
+	fDot       = flag.String("dot", "crawl.dot", "write the graph to this GraphViz file, nothing when empty")
+	fParallel  = flag.Int("parallel", 16, "nodes queried at the same time")
+	fTimeout   = flag.Duration("timeout", 2*time.Second, "wait this long for an answer")
+	fMax       = flag.Int("max", 100000, "stop enqueuing once this many nodes are known")
+	fRate      = flag.Float64("rate", 20, "requests per second sent to one node, below the KTABLE limit of 30 per ip")
+	fEmpty     = flag.Int("empty", 8, "stop querying a node after this many buckets in a row gave no new nodes")
+)
+
+// CrawlNode is a node found by the crawl, Reachable if it answered our ping
+type CrawlNode struct {
+	ID           string          `json:"id"`
+	Addr         string          `json:"addr"`
+	LocalAddr    string          `json:"localAddr,omitempty"`
+	Endpoints    []node.Endpoint `json:"endpoints,omitempty"`
+	Signed       bool            `json:"signed"`
+	Seq          uint64          `json:"seq,omitempty"`
+	NetworkID    string          `json:"networkId,omitempty"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	Relays       []string        `json:"relays,omitempty"`
+	Version      int             `json:"version,omitempty"`
+	Reachable    bool            `json:"reachable"`
+	LatencyMs    float64         `json:"latencyMs"`
+	// the nodes of its ktable it gave us, in the order they were first seen
+	Neighbours []string `json:"neighbours"`
+	// hops from the bootnodes
+	Depth int `json:"depth"`
+	// the connected component of the reachable nodes it belongs to, -1 if it is not reachable
+	Component int `json:"component"`
+	// the nodes which gave it to us
+	FoundBy []string `json:"foundBy,omitempty"`
+}
+
+type CrawlResult struct {
+	Started   time.Time `json:"started"`
+	Duration  string    `json:"duration"`
+	Bootnodes []string  `json:"bootnodes"`
+	Total     int       `json:"total"`
+	Reachable int       `json:"reachable"`
+	// the sizes of the connected components, more than one means the network is partitioned
+	Components []int        `json:"components"`
+	Nodes      []*CrawlNode `json:"nodes"`
+}
+
+type crawler struct {
+	id        string
+	localIP   net.IP
+	localPort int
+	network   *udp.UDPService
+
+	mux   sync.Mutex
+	waits map[string]chan []byte
+	nodes map[string]*CrawlNode
+	wg    sync.WaitGroup
+	queue chan *CrawlNode
+}
+
+func newCrawler(port int) (*crawler, error) {
+	if port == 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, err
+		}
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+	}
+	localIP := net.ParseIP("127.0.0.1")
+	if ipStr, err := nat.GetOutbountIP(); err == nil {
+		localIP = net.ParseIP(ipStr)
+	}
+	// a throwaway identity, the nodes put the crawler into their tables but drop it once it stops answering pings
+	privKey := encrypt.GenerateNodeKey()
+	c := &crawler{
+		id:        hex.EncodeToString(encrypt.PublicKeyToNodeId(privKey.PublicKey)),
+		localIP:   localIP,
+		localPort: port,
+		waits:     make(map[string]chan []byte),
+		nodes:     make(map[string]*CrawlNode),
+		queue:     make(chan *CrawlNode, 1024),
+	}
+	c.network = udp.NewUDPService(c.id, nil, port)
+	// the answers are ours, many nodes behind one ip would hit the default limits
+	c.network.SetRateLimiter(ratelimit.NewLimiter(ratelimit.Policy{}))
+	c.network.RegisterCallback(kad.KTABLE_DIAGRAM_CATEGORY, c.callback)
+	c.network.Start()
+	return c, nil
+}
+
+func (c *crawler) callback(p models.ICallbackParams) {
+	params, ok := p.(models.UDPCallbackParams)
+	if !ok {
+		return
+	}
+	c.mux.Lock()
+	wait, ok := c.waits[params.Diagram.GetID()]
+	c.mux.Unlock()
+	if !ok {
+		// pings and lookups of the nodes which picked us up, we won't stay
+		return
+	}
+	data := make([]byte, len(params.Data))
+	copy(data, params.Data)
+	select {
+	case wait <- data:
+	default:
+	}
+}
+
+func (c *crawler) newDiagram(dType string) models.UDPDiagram {
+	ts := time.Now().Unix()
+	return models.UDPDiagram{
+		NetworkDiagram: models.NetworkDiagram{
+			ID:        utils.NewUUID(),
+			NodeID:    c.id,
+			Timestamp: ts,
+			DCategory: kad.KTABLE_DIAGRAM_CATEGORY,
+			DType:     dType,
+			Version:   models.UDP_DIAGRAM_VERSION,
+		},
+		Expire:    ts + int64(models.DEFAULT_TIMEOUT),
+		LocalAddr: c.localIP.String(),
+		LocalPort: c.localPort,
+	}
+}
+
+// send diag to addr and hand the answers to done until it returns true or the timeout passes, false on the timeout
+func (c *crawler) request(addr *net.UDPAddr, nodeID string, id string, diag interface{}, done func(data []byte) bool) bool {
+	wait := make(chan []byte, 16)
+	c.mux.Lock()
+	c.waits[id] = wait
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		delete(c.waits, id)
+		c.mux.Unlock()
+	}()
+	c.network.Send(addr.IP, addr.Port, utils.DiagramToBytes(diag), nodeID)
+	timeout := time.After(*fTimeout)
+	for {
+		select {
+		case data := <-wait:
+			if done(data) {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func (c *crawler) ping(n *CrawlNode, addr *net.UDPAddr) {
+	ping := kad.PingDiagram{UDPDiagram: c.newDiagram(kad.KTABLE_DIAGRAM_PING)}
+	sent := time.Now()
+	c.request(addr, n.ID, ping.ID, ping, func(data []byte) bool {
+		var pong kad.PongDiagram
+		if utils.BytesToUDPDiagram(data, &pong) != nil || pong.DType != kad.KTABLE_DIAGRAM_PONG || pong.NodeID != n.ID {
+			return false
+		}
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		n.Reachable = true
+		n.LatencyMs = float64(time.Since(sent).Microseconds()) / 1000
+		n.Version = pong.Version
+		n.LocalAddr = net.JoinHostPort(pong.LocalAddr, strconv.Itoa(pong.LocalPort))
+		if pong.Record != nil && pong.Record.ID == n.ID && node.NewRemoteNodeFromRecord(pong.Record) != nil {
+			applyRecord(n, pong.Record)
+		}
+		return true
+	})
+}
+
+// the neighbours closest to target in the ktable of n, an empty target asks for the ones closest to us.
+// False if not all the parts of the answer came in time
+func (c *crawler) findNode(n *CrawlNode, addr *net.UDPAddr, target string) ([]kad.NodeDiagram, bool) {
+	fn := kad.FindNodeDiagram{UDPDiagram: c.newDiagram(kad.KTABLE_DIAGRAM_FINDNODE), Target: target}
+	nodes := make([]kad.NodeDiagram, 0)
+	parts := make(map[int]bool)
+	answered := c.request(addr, n.ID, fn.ID, fn, func(data []byte) bool {
+		var resp kad.FindNodeRespDiagram
+		if utils.BytesToUDPDiagram(data, &resp) != nil || resp.DType != kad.KTABLE_DIAGRAM_FINDNODERESP || parts[resp.Part] {
+			return false
+		}
+		parts[resp.Part] = true
+		nodes = append(nodes, resp.Nodes...)
+		return resp.Total == 0 || len(parts) >= resp.Total
+	})
+	return nodes, answered
+}
+
+func (c *crawler) visit(n *CrawlNode) {
+	addr, err := net.ResolveUDPAddr("udp", n.Addr)
+	if err != nil {
+		return
+	}
+	c.ping(n, addr)
+	if !n.Reachable {
+		return
+	}
+	// the requests to one node are paced below its rate limit, else it drops them and they look empty
+	pace := time.NewTicker(time.Duration(float64(time.Second) / *fRate))
+	defer pace.Stop()
+	empty := 0
+	for _, target := range bucketTargets(n.ID) {
+		if empty >= *fEmpty {
+			break
+		}
+		added := 0
+		// a lost request is tried once more
+		for attempt := 0; attempt < 2; attempt++ {
+			<-pace.C
+			nodes, answered := c.findNode(n, addr, target)
+			for _, nd := range nodes {
+				if c.found(n, nd) {
+					added++
+				}
+			}
+			if answered {
+				break
+			}
+		}
+		if added == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+	}
+}
+
+// record a neighbour of from and enqueue it the first time it is seen, true if from didn't give it before
+func (c *crawler) found(from *CrawlNode, nd kad.NodeDiagram) bool {
+	neighbour := &CrawlNode{ID: nd.NodeID, Depth: from.Depth + 1, Component: -1, LatencyMs: -1, Neighbours: make([]string, 0)}
+	if nd.Record != nil {
+		if node.NewRemoteNodeFromRecord(nd.Record) == nil || nd.Record.ID != nd.NodeID {
+			return false
+		}
+		applyRecord(neighbour, nd.Record)
+	}
+	if neighbour.Addr == "" && nd.RemoteIP != "" {
+		neighbour.Addr = net.JoinHostPort(nd.RemoteIP, strconv.Itoa(nd.RemotePort))
+	}
+	if neighbour.Addr == "" || neighbour.ID == c.id {
+		return false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if containsString(from.Neighbours, neighbour.ID) {
+		return false
+	}
+	from.Neighbours = append(from.Neighbours, neighbour.ID)
+	if existing, ok := c.nodes[neighbour.ID]; ok {
+		if !containsString(existing.FoundBy, from.ID) {
+			existing.FoundBy = append(existing.FoundBy, from.ID)
+		}
+		return true
+	}
+	if len(c.nodes) < *fMax {
+		neighbour.FoundBy = []string{from.ID}
+		c.nodes[neighbour.ID] = neighbour
+		c.enqueue(neighbour)
+	}
+	return true
+}
+
+// needs the lock, the queue is drained by the workers so it doesn't block for long
+func (c *crawler) enqueue(n *CrawlNode) {
+	c.wg.Add(1)
+	go func() { c.queue <- n }()
+}
+
+func (c *crawler) crawl(bootnodes []config.StaticNode) {
+	c.mux.Lock()
+	for _, bn := range bootnodes {
+		if _, ok := c.nodes[bn.ID]; ok {
+			continue
+		}
+		n := &CrawlNode{ID: bn.ID, Addr: net.JoinHostPort(bn.IP, strconv.Itoa(bn.Port)), Component: -1, LatencyMs: -1, Neighbours: make([]string, 0)}
+		c.nodes[n.ID] = n
+		c.enqueue(n)
+	}
+	c.mux.Unlock()
+
+	for i := 0; i < *fParallel; i++ {
+		go func() {
+			for n := range c.queue {
+				c.visit(n)
+				c.mux.Lock()
+				known := len(c.nodes)
+				c.mux.Unlock()
+				fmt.Fprintf(os.Stderr, "visited %v (%v, reachable: %v, neighbours: %v), %v nodes known\n", shortID(n.ID), n.Addr, n.Reachable, len(n.Neighbours), known)
+				c.wg.Done()
+			}
+		}()
+	}
+	c.wg.Wait()
+	close(c.queue)
+}
+
+func (c *crawler) result(started time.Time, bootnodes []config.StaticNode) *CrawlResult {
+	res := &CrawlResult{
+		Started:    started,
+		Duration:   time.Since(started).Truncate(time.Millisecond).String(),
+		Bootnodes:  make([]string, 0),
+		Components: make([]int, 0),
+		Nodes:      make([]*CrawlNode, 0, len(c.nodes)),
+	}
+	for _, bn := range bootnodes {
+		res.Bootnodes = append(res.Bootnodes, bn.ID)
+	}
+	for _, n := range c.nodes {
+		res.Nodes = append(res.Nodes, n)
+		if n.Reachable {
+			res.Reachable++
+		}
+	}
+	res.Total = len(res.Nodes)
+	sort.Slice(res.Nodes, func(i, j int) bool {
+		if res.Nodes[i].Depth != res.Nodes[j].Depth {
+			return res.Nodes[i].Depth < res.Nodes[j].Depth
+		}
+		return res.Nodes[i].ID < res.Nodes[j].ID
+	})
+	res.Components = c.components(res.Nodes)
+	return res
+}
+
+// label the connected components of the reachable nodes, the edges taken both ways, the largest first
+func (c *crawler) components(nodes []*CrawlNode) []int {
+	edges := make(map[string][]string)
+	for _, n := range nodes {
+		if !n.Reachable {
+			continue
+		}
+		for _, id := range n.Neighbours {
+			if neighbour, ok := c.nodes[id]; ok && neighbour.Reachable {
+				edges[n.ID] = append(edges[n.ID], id)
+				edges[id] = append(edges[id], n.ID)
+			}
+		}
+	}
+	var members [][]*CrawlNode
+	for _, n := range nodes {
+		if !n.Reachable || n.Component >= 0 {
+			continue
+		}
+		component := []*CrawlNode{n}
+		n.Component = len(members)
+		for i := 0; i < len(component); i++ {
+			for _, id := range edges[component[i].ID] {
+				if neighbour := c.nodes[id]; neighbour.Component < 0 {
+					neighbour.Component = n.Component
+					component = append(component, neighbour)
+				}
+			}
+		}
+		members = append(members, component)
+	}
+	sort.SliceStable(members, func(i, j int) bool { return len(members[i]) > len(members[j]) })
+	sizes := make([]int, 0, len(members))
+	for i, component := range members {
+		for _, n := range component {
+			n.Component = i
+		}
+		sizes = append(sizes, len(component))
+	}
+	return sizes
+}
+
+func writeJSON(path string, res *CrawlResult) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// a directed graph, an edge from every node to the neighbours it gave us. The nodes which didn't answer
+// are dashed and the components other than the largest one are filled
+func writeDot(path string, res *CrawlResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintln(f, "digraph network {")
+	fmt.Fprintln(f, "\tnode [shape=box, fontname=monospace, fontsize=10];")
+	for _, n := range res.Nodes {
+		label := fmt.Sprintf("%v\n%v", shortID(n.ID), n.Addr)
+		if n.Reachable {
+			label += fmt.Sprintf("\n%.1fms", n.LatencyMs)
+		}
+		attrs := fmt.Sprintf("label=%q", label)
+		if !n.Reachable {
+			attrs += ", style=dashed, color=gray"
+		} else if n.Component > 0 {
+			attrs += fmt.Sprintf(", style=filled, fillcolor=\"/pastel19/%v\"", n.Component%9+1)
+		}
+		fmt.Fprintf(f, "\t%q [%v];\n", n.ID, attrs)
+	}
+	for _, n := range res.Nodes {
+		for _, id := range n.Neighbours {
+			fmt.Fprintf(f, "\t%q -> %q;\n", n.ID, id)
+		}
+	}
+	fmt.Fprintln(f, "}")
+	return nil
+}
+
+func applyRecord(n *CrawlNode, record *node.NodeRecord) {
+	n.Signed = true
+	n.Seq = record.Seq
+	n.NetworkID = record.NetworkID
+	n.Endpoints = record.Endpoints
+	n.Capabilities = record.Capabilities
+	n.Relays = record.Relays
+	if n.Addr == "" {
+		if ep, ok := record.GetEndpoint(node.ENDPOINT_UDP, node.ENDPOINT_SCOPE_REMOTE); ok {
+			n.Addr = net.JoinHostPort(ep.IP, strconv.Itoa(ep.Port))
+		}
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 16 {
+		return id[:16]
+	}
+	return id
+}
+
+// a FINDNODE target per bucket of the node, the buckets are keyed by the first byte of the distance
+// so a target with id[0]^d in front gets the nodes of bucket d. The farthest first, half of the ids fall
+// into the buckets 128-255 and the close ones are mostly empty
+func bucketTargets(nodeID string) []string {
+	id, err := hex.DecodeString(nodeID)
+	if err != nil || len(id) == 0 {
+		// the node answers with the nodes closest to us
+		return []string{""}
+	}
+	targets := make([]string, 0, 256)
+	for d := 255; d >= 0; d-- {
+		target := append([]byte{}, id...)
+		target[0] ^= byte(d)
+		targets = append(targets, hex.EncodeToString(target))
+	}
+	return targets
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	flag.Parse()
+	if *fRate <= 0 {
+		fmt.Fprintln(os.Stderr, "the rate must be positive")
+		os.Exit(1)
+	}
+	b := bootstrap.NewDefaultBootstrapper()
+	if *fBootnodes != "" {
+		b.PrependSource(bootstrap.NewFlagSource(*fBootnodes))
+	}
+	bootnodes := b.Load()
+	if len(bootnodes) == 0 {
+		fmt.Fprintln(os.Stderr, "no bootnodes")
+		os.Exit(1)
+	}
+	c, err := newCrawler(*fPort)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	started := time.Now()
+	c.crawl(bootnodes)
+	res := c.result(started, bootnodes)
+	fmt.Fprintf(os.Stderr, "%v nodes, %v reachable, components %v, in %v\n", res.Total, res.Reachable, res.Components, res.Duration)
+
+	if err := writeJSON(*fOut, res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *fDot != "" {
+		if err := writeDot(*fDot, res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"strconv"
 
-	//"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/config"
 	"github.com/symphonyprotocol/p2p"
+	"github.com/symphonyprotocol/p2p/bootstrap"
 	"github.com/symphonyprotocol/p2p/encrypt"
 	"github.com/symphonyprotocol/p2p/kad"
 	"github.com/symphonyprotocol/p2p/node"
@@ -13,6 +14,9 @@ import (
 	"github.com/symphonyprotocol/log"
 
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	//"github.com/symphonyprotocol/p2p/udp"
 	//"math/big"
@@ -21,6 +25,11 @@ import (
 
 var (
 	fDashboard = flag.Bool("dashboard", false, "show dashboard in terminal instead of logs")
+	fBootnodes = flag.String("bootnodes", "", "comma separated bootnodes in id@ip:port format")
+	fDNSSeed   = flag.String("dnsseed", "", "domain whose TXT records list the bootnodes")
+	fWebDashboard = flag.String("webdashboard", "", "serve the dashboard to browsers at this address, e.g. 127.0.0.1:8080")
+	fCapture   = flag.String("capture", "", "record the traffic to this file, read it with examples/capture")
+	fLAN       = flag.Bool("lan", false, "find the nodes on the local network with a multicast beacon")
 )
 
 func getId() []byte {
@@ -55,13 +64,35 @@ func initLogger() {
 }
 
 func initialServer() {
+	if *fCapture != "" {
+		config.CAPTURE_FILE = *fCapture
+	}
+	config.LAN_DISCOVERY_ENABLED = *fLAN
 	srv := p2p.NewP2PServer()
+	if *fDNSSeed != "" {
+		srv.UseBootstrapSource(bootstrap.NewDNSSource(*fDNSSeed))
+	}
+	if *fBootnodes != "" {
+		srv.UseBootstrapSource(bootstrap.NewFlagSource(*fBootnodes))
+	}
 	srv.Use(&p2p.BlockSyncMiddleware{})
 	srv.Use(p2p.NewFileTransferMiddleware())
+	if *fWebDashboard != "" {
+		// before the terminal dashboard, whose Start blocks
+		srv.Use(p2p.NewWebDashboardMiddleware(*fWebDashboard, srv.SizeEstimator()))
+	}
 	if *fDashboard {
 		// use dashboard
-		srv.Use(&p2p.DashboardMiddleware{})
+		srv.Use(&p2p.DashboardMiddleware{SizeEstimator: srv.SizeEstimator()})
 	}
+	// delete the port mappings on the gateway before exiting, their leases would outlive us otherwise
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+		os.Exit(0)
+	}()
 	srv.Start()
 
 	// try to dial to each other
@@ -0,0 +1,50 @@
+package hyparview
+
+import (
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+)
+
+var (
+	HYPARVIEW_DIAGRAM_CATEGORY     = "HYPARVIEW"
+	HYPARVIEW_DIAGRAM_JOIN         = "JOIN"
+	HYPARVIEW_DIAGRAM_FORWARD_JOIN = "FORWARDJOIN"
+	HYPARVIEW_DIAGRAM_NEIGHBOR     = "NEIGHBOR"
+	HYPARVIEW_DIAGRAM_NEIGHBOR_RES = "NEIGHBORRESP"
+	HYPARVIEW_DIAGRAM_DISCONNECT   = "DISCONNECT"
+	HYPARVIEW_DIAGRAM_SHUFFLE      = "SHUFFLE"
+	HYPARVIEW_DIAGRAM_SHUFFLE_RES  = "SHUFFLERESP"
+	HYPARVIEW_DIAGRAM_KEEPALIVE    = "KEEPALIVE"
+)
+
+// every diagram carries the signed record of its sender, JOIN, DISCONNECT and KEEPALIVE carry nothing else
+type HyParViewDiagram struct {
+	models.UDPDiagram
+	Record *node.NodeRecord `json:",omitempty"`
+}
+
+// ForwardJoinDiagram walks the joining node through the overlay for TTL hops
+type ForwardJoinDiagram struct {
+	HyParViewDiagram
+	Joining *node.NodeRecord
+	TTL     int
+}
+
+// NeighborDiagram asks to be taken into the active view, a high priority request comes from a node with an empty one
+type NeighborDiagram struct {
+	HyParViewDiagram
+	HighPriority bool `json:",omitempty"`
+}
+
+type NeighborRespDiagram struct {
+	HyParViewDiagram
+	Accepted bool
+}
+
+// ShuffleDiagram walks for TTL hops, the last node answers the origin with as many passive nodes
+type ShuffleDiagram struct {
+	HyParViewDiagram
+	Origin *node.NodeRecord `json:",omitempty"`
+	TTL    int              `json:",omitempty"`
+	Nodes  []*node.NodeRecord
+}
@@ -0,0 +1,542 @@
+package hyparview
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/udp"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	logger = log.GetLogger("hyparview")
+
+	// the peers we exchange with, kept small, and the ones kept in reserve to replace them
+	ACTIVE_VIEW_SIZE  = 5
+	PASSIVE_VIEW_SIZE = 30
+	// hops of a forwarded join, it enters the passive views at PASSIVE_RANDOM_WALK_LENGTH hops left
+	ACTIVE_RANDOM_WALK_LENGTH  = 6
+	PASSIVE_RANDOM_WALK_LENGTH = 3
+
+	SHUFFLE_INTERVAL = 30 * time.Second
+	// the nodes of each view sent with a shuffle, they are cut when the packet gets too big
+	SHUFFLE_ACTIVE_NODES  = 2
+	SHUFFLE_PASSIVE_NODES = 3
+	// active peers send each other a keepalive this often, a peer silent for 3 intervals has failed
+	KEEPALIVE_INTERVAL = 5 * time.Second
+	// a neighbor request not answered in this time is given up
+	NEIGHBOR_TIMEOUT = 3 * time.Second
+)
+
+// IContactSource gives the nodes to join through, implemented by kad.KTable
+type IContactSource interface {
+	GetActiveNodes() []*node.RemoteNode
+}
+
+type activePeer struct {
+	rnode    *node.RemoteNode
+	lastSeen time.Time
+}
+
+// HyParView keeps a small active view of random peers and a larger passive view to heal it.
+// The active views are symmetric, a failed peer is replaced from the passive view, and the passive
+// views are refreshed by shuffles walking the overlay.
+type HyParView struct {
+	network   models.INetwork
+	localNode *node.LocalNode
+	contacts  IContactSource
+
+	mux     sync.Mutex
+	active  map[string]*activePeer
+	passive map[string]*node.RemoteNode
+	// neighbor requests waiting for an answer
+	pending map[string]time.Time
+}
+
+func NewHyParView(localNode *node.LocalNode, network models.INetwork, contacts IContactSource) *HyParView {
+	h := &HyParView{
+		network:   network,
+		localNode: localNode,
+		contacts:  contacts,
+		active:    make(map[string]*activePeer),
+		passive:   make(map[string]*node.RemoteNode),
+		pending:   make(map[string]time.Time),
+	}
+	network.RegisterCallback(HYPARVIEW_DIAGRAM_CATEGORY, h.callback)
+	return h
+}
+
+func (h *HyParView) Start() {
+	go h.loop()
+}
+
+// PeekNodes returns the active view
+func (h *HyParView) PeekNodes() []*node.RemoteNode {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	nodes := make([]*node.RemoteNode, 0, len(h.active))
+	for _, peer := range h.active {
+		nodes = append(nodes, peer.rnode)
+	}
+	return nodes
+}
+
+// GetNearbyNodes returns up to max nodes of the active view, there is no distance in the overlay
+func (h *HyParView) GetNearbyNodes(max int) []*node.RemoteNode {
+	nodes := h.PeekNodes()
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	if max < len(nodes) {
+		return nodes[:max]
+	}
+	return nodes
+}
+
+// GetActiveNodes returns the active view, like PeekNodes
+func (h *HyParView) GetActiveNodes() []*node.RemoteNode {
+	return h.PeekNodes()
+}
+
+// GetPassiveNodes returns the passive view
+func (h *HyParView) GetPassiveNodes() []*node.RemoteNode {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	nodes := make([]*node.RemoteNode, 0, len(h.passive))
+	for _, rnode := range h.passive {
+		nodes = append(nodes, rnode)
+	}
+	return nodes
+}
+
+func (h *HyParView) GetLocalNode() *node.LocalNode {
+	return h.localNode
+}
+
+// Search looks in both views, nil if the node is in none
+func (h *HyParView) Search(nodeID string) *node.RemoteNode {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if peer, ok := h.active[nodeID]; ok {
+		return peer.rnode
+	}
+	return h.passive[nodeID]
+}
+
+func (h *HyParView) loop() {
+	lastShuffle := time.Now()
+	for {
+		h.expire()
+		if len(h.PeekNodes()) == 0 {
+			h.join()
+		}
+		h.fill()
+		if time.Since(lastShuffle) >= SHUFFLE_INTERVAL {
+			h.shuffle()
+			lastShuffle = time.Now()
+		}
+		for _, rnode := range h.PeekNodes() {
+			h.send(rnode, h.newDiagram(HYPARVIEW_DIAGRAM_KEEPALIVE))
+		}
+		time.Sleep(KEEPALIVE_INTERVAL)
+	}
+}
+
+// join through a random node of the contacts, retried every round while the active view is empty
+func (h *HyParView) join() {
+	contacts := h.contacts.GetActiveNodes()
+	if len(contacts) == 0 {
+		return
+	}
+	contact := contacts[rand.Intn(len(contacts))]
+	logger.Debug("join through %v", contact.GetID())
+	h.send(contact, h.newDiagram(HYPARVIEW_DIAGRAM_JOIN))
+}
+
+// drop the silent active peers and the unanswered neighbor requests
+func (h *HyParView) expire() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for id, peer := range h.active {
+		if time.Since(peer.lastSeen) > 3*KEEPALIVE_INTERVAL {
+			logger.Debug("active peer %v failed", id)
+			delete(h.active, id)
+		}
+	}
+	for id, ts := range h.pending {
+		if time.Since(ts) > NEIGHBOR_TIMEOUT {
+			delete(h.pending, id)
+			delete(h.passive, id)
+		}
+	}
+}
+
+// ask passive nodes to become active while the active view is not full
+func (h *HyParView) fill() {
+	h.mux.Lock()
+	missing := ACTIVE_VIEW_SIZE - len(h.active) - len(h.pending)
+	highPriority := len(h.active) == 0
+	var candidates []*node.RemoteNode
+	for id, rnode := range h.passive {
+		if _, ok := h.pending[id]; !ok {
+			candidates = append(candidates, rnode)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if missing < len(candidates) {
+		candidates = candidates[:maxInt(missing, 0)]
+	}
+	for _, rnode := range candidates {
+		h.pending[rnode.GetID()] = time.Now()
+	}
+	h.mux.Unlock()
+	for _, rnode := range candidates {
+		diag := &NeighborDiagram{HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_NEIGHBOR), HighPriority: highPriority}
+		h.send(rnode, diag)
+	}
+}
+
+// send some of our nodes on a random walk, the last node answers with some of its passive view
+func (h *HyParView) shuffle() {
+	h.mux.Lock()
+	var target *node.RemoteNode
+	for _, peer := range h.active {
+		target = peer.rnode
+		break
+	}
+	nodes := h.sample(SHUFFLE_ACTIVE_NODES, SHUFFLE_PASSIVE_NODES, "")
+	h.mux.Unlock()
+	if target == nil {
+		return
+	}
+	diag := &ShuffleDiagram{
+		HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_SHUFFLE),
+		Origin:           h.localNode.GetRecord(),
+		TTL:              ACTIVE_RANDOM_WALK_LENGTH,
+		Nodes:            nodes,
+	}
+	h.sendNodes(target, diag)
+}
+
+func (h *HyParView) callback(p models.ICallbackParams) {
+	params, ok := p.(models.UDPCallbackParams)
+	if !ok {
+		return
+	}
+	var base HyParViewDiagram
+	if err := utils.BytesToUDPDiagram(params.Data, &base); err != nil {
+		return
+	}
+	sender := h.toRemoteNode(base.Record, base.NodeID, params.GetUDPRemoteAddr())
+	if sender == nil || sender.GetID() == h.localNode.GetID() {
+		return
+	}
+	h.mux.Lock()
+	if peer, ok := h.active[sender.GetID()]; ok {
+		peer.lastSeen = time.Now()
+	}
+	h.mux.Unlock()
+
+	switch base.DType {
+	case HYPARVIEW_DIAGRAM_JOIN:
+		h.handleJoin(sender)
+	case HYPARVIEW_DIAGRAM_FORWARD_JOIN:
+		var diag ForwardJoinDiagram
+		if utils.BytesToUDPDiagram(params.Data, &diag) == nil {
+			h.handleForwardJoin(sender, &diag)
+		}
+	case HYPARVIEW_DIAGRAM_NEIGHBOR:
+		var diag NeighborDiagram
+		if utils.BytesToUDPDiagram(params.Data, &diag) == nil {
+			h.handleNeighbor(sender, diag.HighPriority)
+		}
+	case HYPARVIEW_DIAGRAM_NEIGHBOR_RES:
+		var diag NeighborRespDiagram
+		if utils.BytesToUDPDiagram(params.Data, &diag) == nil {
+			h.handleNeighborResp(sender, diag.Accepted)
+		}
+	case HYPARVIEW_DIAGRAM_DISCONNECT:
+		h.mux.Lock()
+		if _, ok := h.active[sender.GetID()]; ok {
+			delete(h.active, sender.GetID())
+			h.addPassive(sender)
+		}
+		h.mux.Unlock()
+	case HYPARVIEW_DIAGRAM_SHUFFLE:
+		var diag ShuffleDiagram
+		if utils.BytesToUDPDiagram(params.Data, &diag) == nil {
+			h.handleShuffle(sender, &diag)
+		}
+	case HYPARVIEW_DIAGRAM_SHUFFLE_RES:
+		var diag ShuffleDiagram
+		if utils.BytesToUDPDiagram(params.Data, &diag) == nil {
+			h.mux.Lock()
+			h.integrate(diag.Nodes)
+			h.mux.Unlock()
+		}
+	}
+}
+
+// the contact takes the new node and walks it through the overlay from each of its active peers
+func (h *HyParView) handleJoin(joining *node.RemoteNode) {
+	h.mux.Lock()
+	h.addActive(joining)
+	var targets []*node.RemoteNode
+	for id, peer := range h.active {
+		if id != joining.GetID() {
+			targets = append(targets, peer.rnode)
+		}
+	}
+	h.mux.Unlock()
+	h.send(joining, &NeighborRespDiagram{HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_NEIGHBOR_RES), Accepted: true})
+	for _, rnode := range targets {
+		h.send(rnode, &ForwardJoinDiagram{
+			HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_FORWARD_JOIN),
+			Joining:          joining.GetRecord(),
+			TTL:              ACTIVE_RANDOM_WALK_LENGTH,
+		})
+	}
+}
+
+func (h *HyParView) handleForwardJoin(sender *node.RemoteNode, diag *ForwardJoinDiagram) {
+	joining := h.toRemoteNode(diag.Joining, "", nil)
+	if joining == nil || joining.GetID() == h.localNode.GetID() {
+		return
+	}
+	h.mux.Lock()
+	if diag.TTL <= 1 || len(h.active) <= 1 {
+		_, known := h.active[joining.GetID()]
+		h.addActive(joining)
+		h.mux.Unlock()
+		// the joining node learns about us, high priority as it can't refuse a node that walked to us
+		if !known {
+			h.send(joining, &NeighborDiagram{HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_NEIGHBOR), HighPriority: true})
+		}
+		return
+	}
+	if diag.TTL == PASSIVE_RANDOM_WALK_LENGTH {
+		h.addPassive(joining)
+	}
+	var next *node.RemoteNode
+	for id, peer := range h.active {
+		if id != sender.GetID() && id != joining.GetID() {
+			next = peer.rnode
+			break
+		}
+	}
+	h.mux.Unlock()
+	if next == nil {
+		return
+	}
+	h.send(next, &ForwardJoinDiagram{
+		HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_FORWARD_JOIN),
+		Joining:          diag.Joining,
+		TTL:              diag.TTL - 1,
+	})
+}
+
+func (h *HyParView) handleNeighbor(sender *node.RemoteNode, highPriority bool) {
+	h.mux.Lock()
+	_, known := h.active[sender.GetID()]
+	accepted := known || highPriority || len(h.active) < ACTIVE_VIEW_SIZE
+	if accepted {
+		h.addActive(sender)
+	}
+	h.mux.Unlock()
+	h.send(sender, &NeighborRespDiagram{HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_NEIGHBOR_RES), Accepted: accepted})
+}
+
+func (h *HyParView) handleNeighborResp(sender *node.RemoteNode, accepted bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.pending, sender.GetID())
+	if accepted {
+		h.addActive(sender)
+	} else {
+		h.addPassive(sender)
+	}
+}
+
+func (h *HyParView) handleShuffle(sender *node.RemoteNode, diag *ShuffleDiagram) {
+	origin := h.toRemoteNode(diag.Origin, "", nil)
+	if origin == nil || origin.GetID() == h.localNode.GetID() {
+		return
+	}
+	h.mux.Lock()
+	if diag.TTL > 1 && len(h.active) > 1 {
+		var next *node.RemoteNode
+		for id, peer := range h.active {
+			if id != sender.GetID() && id != origin.GetID() {
+				next = peer.rnode
+				break
+			}
+		}
+		h.mux.Unlock()
+		if next != nil {
+			fwd := *diag
+			fwd.HyParViewDiagram = *h.newDiagram(HYPARVIEW_DIAGRAM_SHUFFLE)
+			fwd.TTL = diag.TTL - 1
+			h.sendNodes(next, &fwd)
+			return
+		}
+		h.mux.Lock()
+	}
+	// the walk ends here, answer with as many passive nodes as we got
+	reply := h.sample(0, len(diag.Nodes), origin.GetID())
+	h.integrate(diag.Nodes)
+	h.mux.Unlock()
+	h.sendNodes(origin, &ShuffleDiagram{HyParViewDiagram: *h.newDiagram(HYPARVIEW_DIAGRAM_SHUFFLE_RES), Nodes: reply})
+}
+
+// the following need the lock
+
+func (h *HyParView) addActive(rnode *node.RemoteNode) {
+	id := rnode.GetID()
+	if id == h.localNode.GetID() {
+		return
+	}
+	if peer, ok := h.active[id]; ok {
+		peer.lastSeen = time.Now()
+		return
+	}
+	if len(h.active) >= ACTIVE_VIEW_SIZE {
+		h.dropRandomActive()
+	}
+	delete(h.passive, id)
+	delete(h.pending, id)
+	h.active[id] = &activePeer{rnode: rnode, lastSeen: time.Now()}
+	logger.Debug("%v joined the active view", id)
+}
+
+// the dropped peer is told so that the views stay symmetric
+func (h *HyParView) dropRandomActive() {
+	for id, peer := range h.active {
+		delete(h.active, id)
+		h.addPassive(peer.rnode)
+		go h.send(peer.rnode, h.newDiagram(HYPARVIEW_DIAGRAM_DISCONNECT))
+		return
+	}
+}
+
+func (h *HyParView) addPassive(rnode *node.RemoteNode) {
+	id := rnode.GetID()
+	if id == h.localNode.GetID() {
+		return
+	}
+	if _, ok := h.active[id]; ok {
+		return
+	}
+	if _, ok := h.passive[id]; !ok && len(h.passive) >= PASSIVE_VIEW_SIZE {
+		for victim := range h.passive {
+			if _, waiting := h.pending[victim]; !waiting {
+				delete(h.passive, victim)
+				break
+			}
+		}
+	}
+	h.passive[id] = rnode
+}
+
+func (h *HyParView) integrate(records []*node.NodeRecord) {
+	for _, record := range records {
+		if rnode := h.toRemoteNode(record, "", nil); rnode != nil {
+			h.addPassive(rnode)
+		}
+	}
+}
+
+// our record, and the records of some random active and passive nodes other than exclude
+func (h *HyParView) sample(activeCount int, passiveCount int, exclude string) []*node.NodeRecord {
+	var records []*node.NodeRecord
+	// ourselves and activeCount of the active view, none of them when it is 0
+	if activeCount > 0 {
+		records = append(records, h.localNode.GetRecord())
+		for id, peer := range h.active {
+			if len(records) > activeCount {
+				break
+			}
+			if id != exclude && peer.rnode.GetRecord() != nil {
+				records = append(records, peer.rnode.GetRecord())
+			}
+		}
+	}
+	passive := 0
+	for id, rnode := range h.passive {
+		if passive >= passiveCount {
+			break
+		}
+		if id != exclude && rnode.GetRecord() != nil {
+			records = append(records, rnode.GetRecord())
+			passive++
+		}
+	}
+	return records
+}
+
+// a node from its signed record, or from the address it sent from when it has none
+func (h *HyParView) toRemoteNode(record *node.NodeRecord, nodeID string, from *net.UDPAddr) *node.RemoteNode {
+	if record != nil {
+		if nodeID != "" && record.ID != nodeID {
+			return nil
+		}
+		return node.NewRemoteNodeFromRecord(record)
+	}
+	if from == nil {
+		return nil
+	}
+	id, err := hex.DecodeString(nodeID)
+	if err != nil || len(id) == 0 {
+		return nil
+	}
+	return node.NewRemoteNode(id, from.IP, from.Port, from.IP, from.Port)
+}
+
+func (h *HyParView) newDiagram(dType string) *HyParViewDiagram {
+	ts := time.Now().Unix()
+	return &HyParViewDiagram{
+		UDPDiagram: models.UDPDiagram{
+			NetworkDiagram: models.NetworkDiagram{
+				ID:        utils.NewUUID(),
+				NodeID:    h.localNode.GetID(),
+				Timestamp: ts,
+				DCategory: HYPARVIEW_DIAGRAM_CATEGORY,
+				DType:     dType,
+				Version:   models.UDP_DIAGRAM_VERSION,
+			},
+			Expire:    ts + int64(models.DEFAULT_TIMEOUT),
+			LocalAddr: h.localNode.GetLocalIP().String(),
+			LocalPort: h.localNode.GetLocalPort(),
+		},
+		Record: h.localNode.GetRecord(),
+	}
+}
+
+// leave nodes out of a shuffle until it fits into a packet
+func (h *HyParView) sendNodes(rnode *node.RemoteNode, diag *ShuffleDiagram) {
+	data := utils.DiagramToBytes(diag)
+	for udp.CheckPayload(data) != nil && len(diag.Nodes) > 0 {
+		diag.Nodes = diag.Nodes[:len(diag.Nodes)-1]
+		data = utils.DiagramToBytes(diag)
+	}
+	h.sendBytes(rnode, data)
+}
+
+func (h *HyParView) send(rnode *node.RemoteNode, diag interface{}) {
+	h.sendBytes(rnode, utils.DiagramToBytes(diag))
+}
+
+func (h *HyParView) sendBytes(rnode *node.RemoteNode, data []byte) {
+	ip, port := rnode.GetSendIPWithPort(h.localNode)
+	h.network.Send(ip, port, data, rnode.GetID())
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -2,13 +2,15 @@ package kad
 
 import (
 	"sync"
+	"time"
 
 	"github.com/symphonyprotocol/p2p/node"
 )
 
 type KBucket struct {
-	mux   sync.RWMutex
-	nodes []*node.RemoteNode
+	mux         sync.RWMutex
+	nodes       []*node.RemoteNode
+	lastUpdated time.Time
 }
 
 func NewKBucket() *KBucket {
@@ -18,7 +20,9 @@ func NewKBucket() *KBucket {
 }
 
 func (b *KBucket) GetAll() []*node.RemoteNode {
-	return b.nodes
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return append([]*node.RemoteNode{}, b.nodes...)
 }
 
 func (b *KBucket) Add(remoteNode *node.RemoteNode) bool {
@@ -26,11 +30,19 @@ func (b *KBucket) Add(remoteNode *node.RemoteNode) bool {
 	defer b.mux.Unlock()
 	if len(b.nodes) < BUCKETS_SIZE {
 		b.nodes = append(b.nodes, remoteNode)
+		b.lastUpdated = time.Now()
 		return true
 	}
 	return false
 }
 
+// the last time a node was added or refreshed in this bucket
+func (b *KBucket) LastUpdated() time.Time {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.lastUpdated
+}
+
 func (b *KBucket) Peek() *node.RemoteNode {
 	b.mux.RLock()
 	defer b.mux.RUnlock()
@@ -52,6 +64,8 @@ func (b *KBucket) Search(nodeID string) *node.RemoteNode {
 }
 
 func (b *KBucket) Size() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
 	return len(b.nodes)
 }
 
@@ -83,7 +97,8 @@ func (b *KBucket) Remove(remoteNode *node.RemoteNode) {
 
 func (b *KBucket) MoveToTail(remoteNode *node.RemoteNode) {
 	b.mux.Lock()
-	b.mux.Unlock()
+	defer b.mux.Unlock()
+	b.lastUpdated = time.Now()
 	if len(b.nodes) <= 1 {
 		return
 	}
@@ -94,8 +109,8 @@ func (b *KBucket) MoveToTail(remoteNode *node.RemoteNode) {
 			break
 		}
 	}
-	if len(b.nodes) == (rIndex + 1) {
+	if rIndex == -1 || len(b.nodes) == (rIndex+1) {
 		return
 	}
-	b.nodes = append(b.nodes[rIndex+1:], remoteNode)
+	b.nodes = append(append(b.nodes[:rIndex], b.nodes[rIndex+1:]...), remoteNode)
 }
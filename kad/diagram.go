@@ -2,6 +2,7 @@ package kad
 
 import (
 	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
 )
 
 var (
@@ -12,29 +13,38 @@ var (
 	KTABLE_DIAGRAM_FINDNODERESP = "FINDNODERESP"
 )
 
+// ping and pong identify the sender with its signed record
 type PingDiagram struct {
 	models.UDPDiagram
+	Record *node.NodeRecord `json:",omitempty"`
 }
 
 type PongDiagram struct {
 	models.UDPDiagram
 	RemoteAddr string
 	RemotePort int
+	Record     *node.NodeRecord `json:",omitempty"`
 }
 
 type FindNodeDiagram struct {
 	models.UDPDiagram
+	Target string // hex node id to look up, the sender itself if empty
 }
 
+// long neighbour lists are split, Part counts from 0 and Total is 0 when the response is not split
 type FindNodeRespDiagram struct {
 	models.UDPDiagram
 	Nodes []NodeDiagram
+	Part  int `json:",omitempty"`
+	Total int `json:",omitempty"`
 }
 
+// the address fields are unsigned and only used when the record is missing and ACCEPT_UNSIGNED_NODES is set
 type NodeDiagram struct {
 	NodeID     string
 	RemoteIP   string
 	RemotePort int
 	LocalAddr  string
 	LocalPort  int
+	Record     *node.NodeRecord `json:",omitempty"`
 }
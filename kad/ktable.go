@@ -12,7 +12,10 @@ import (
 	"github.com/symphonyprotocol/log"
 	"github.com/symphonyprotocol/p2p/models"
 
+	"github.com/symphonyprotocol/p2p/bootstrap"
 	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/events"
+	"github.com/symphonyprotocol/p2p/metrics"
 	"github.com/symphonyprotocol/p2p/node"
 	"github.com/symphonyprotocol/p2p/utils"
 )
@@ -20,6 +23,8 @@ import (
 var (
 	//BUCKETS_TOTAL = 256
 	BUCKETS_SIZE = 8
+	// accept forwarded nodes without a signed record, their addresses can be forged
+	ACCEPT_UNSIGNED_NODES = false
 	logger = log.GetLogger("ktable").SetLevel(log.INFO)
 	pingTime 			sync.Map
 	pingExpectedNodeIds	sync.Map
@@ -39,35 +44,70 @@ type waitReply struct {
 }
 
 type KTable struct {
-	network   models.INetwork
-	localNode *node.LocalNode
-	buckets   map[int]*KBucket
-	waitlist  sync.Map
+	network      models.INetwork
+	localNode    *node.LocalNode
+	mux          sync.RWMutex
+	buckets      map[int]*KBucket
+	waitlist     sync.Map
+	bootstrapper *bootstrap.Bootstrapper
+	lookups      sync.Map // map[string]*lookup, keyed by FINDNODE message id
+	partials     sync.Map // map[string]*partialResp, split FINDNODERESPs being reassembled
+	pongWaiters  sync.Map // map[string]chan time.Duration, keyed by PING message id
+	lastLookup   map[int]time.Time
 }
 
 func NewKTable(localNode *node.LocalNode, network models.INetwork) *KTable {
 	buckets := make(map[int]*KBucket)
 	kt := &KTable{
-		network:   network,
-		localNode: localNode,
-		buckets:   buckets,
+		network:      network,
+		localNode:    localNode,
+		buckets:      buckets,
+		bootstrapper: bootstrap.NewDefaultBootstrapper(),
+		lastLookup:   make(map[int]time.Time),
 	}
-	kt.loadInitNodes()
 	network.RegisterCallback(KTABLE_DIAGRAM_CATEGORY, kt.callback)
 	return kt
 }
 
-func (t *KTable) loadInitNodes() {
-	staticNodes := initialStaticNodes()
-	for _, node := range staticNodes {
-		if node.GetID() == t.localNode.GetID() {
+// use before start
+func (t *KTable) SetBootstrapper(b *bootstrap.Bootstrapper) {
+	t.bootstrapper = b
+}
+
+func (t *KTable) GetBootstrapper() *bootstrap.Bootstrapper {
+	return t.bootstrapper
+}
+
+// add the bootnodes and ping them right away, they only stay if they answer
+func (t *KTable) seed(staticNodes []config.StaticNode) {
+	for _, rnode := range toRemoteNodes(staticNodes) {
+		if rnode.GetID() == t.localNode.GetID() {
 			continue
 		}
-		t.add(node)
+		t.add(rnode, SOURCE_BOOTSTRAP)
+		t.ping(rnode)
 	}
 }
 
-func (t *KTable) add(remoteNode *node.RemoteNode) {
+// populated means at least one node has talked to us, unverified bootnodes don't count
+func (t *KTable) populated() bool {
+	for _, rnode := range t.PeekNodes() {
+		if !rnode.LastActiveTime.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// SOURCE_* tell the PeerDiscovered subscribers how a node was found
+var (
+	SOURCE_BOOTSTRAP = "bootstrap"
+	SOURCE_CONTACT   = "contact"
+	SOURCE_FINDNODE  = "findnode"
+	SOURCE_INTRODUCE = "introduce"
+)
+
+func (t *KTable) add(remoteNode *node.RemoteNode, source string) {
 	if t.localNode.GetID() == remoteNode.GetID() {
 		return
 	}
@@ -75,22 +115,106 @@ func (t *KTable) add(remoteNode *node.RemoteNode) {
 		dist := distance(t.localNode.GetIDBytes(), remoteNode.GetIDBytes())
 		remoteNode.Distance = dist
 	}
-	if bucket, ok := t.buckets[remoteNode.Distance]; ok {
-		if bucket.Search(remoteNode.GetID()) == nil {
-			bucket.Add(remoteNode)
-		} else {
-			bucket.MoveToTail(remoteNode)
-		}
+	bucket := t.getOrCreateBucket(remoteNode.Distance)
+	if bucket.Search(remoteNode.GetID()) == nil {
+		t.addToBucket(bucket, remoteNode, source)
 	} else {
-		bucket := NewKBucket()
-		bucket.Add(remoteNode)
-		t.buckets[remoteNode.Distance] = bucket
+		bucket.MoveToTail(remoteNode)
+	}
+}
+
+// add a node which is not in the bucket yet and tell the subscribers
+func (t *KTable) addToBucket(bucket *KBucket, remoteNode *node.RemoteNode, source string) bool {
+	if !bucket.Add(remoteNode) {
+		return false
+	}
+	bus := t.localNode.Events()
+	bus.Publish(&events.PeerDiscovered{NodeID: remoteNode.GetID(), IP: remoteNode.GetRemoteIP(), Port: remoteNode.GetRemotePort(), Source: source})
+	bus.Publish(&events.BucketNodeAdded{NodeID: remoteNode.GetID(), Distance: remoteNode.Distance})
+	return true
+}
+
+func (t *KTable) getBucket(dist int) (*KBucket, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	bucket, ok := t.buckets[dist]
+	return bucket, ok
+}
+
+func (t *KTable) getOrCreateBucket(dist int) *KBucket {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	bucket, ok := t.buckets[dist]
+	if !ok {
+		bucket = NewKBucket()
+		t.buckets[dist] = bucket
+	}
+	return bucket
+}
+
+// a snapshot of the buckets which is safe to range over
+func (t *KTable) getBuckets() map[int]*KBucket {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	buckets := make(map[int]*KBucket, len(t.buckets))
+	for dist, bucket := range t.buckets {
+		buckets[dist] = bucket
+	}
+	return buckets
+}
+
+// GetBucketSizes returns the number of nodes per non-empty bucket, keyed by distance
+func (t *KTable) GetBucketSizes() map[int]int {
+	sizes := make(map[int]int)
+	for dist, bucket := range t.getBuckets() {
+		if size := bucket.Size(); size > 0 {
+			sizes[dist] = size
+		}
+	}
+	return sizes
+}
+
+// GetBucketNodes returns the nodes of the non-empty buckets, keyed by distance
+func (t *KTable) GetBucketNodes() map[int][]*node.RemoteNode {
+	res := make(map[int][]*node.RemoteNode)
+	for dist, bucket := range t.getBuckets() {
+		if nodes := bucket.GetAll(); len(nodes) > 0 {
+			res[dist] = nodes
+		}
+	}
+	return res
+}
+
+// AddNode puts a node into its bucket if there is room
+func (t *KTable) AddNode(remoteNode *node.RemoteNode) {
+	t.add(remoteNode, SOURCE_INTRODUCE)
+}
+
+// Introduce adds a node found out of band, e.g. on the lan, and pings it unless it already talked to us
+func (t *KTable) Introduce(remoteNode *node.RemoteNode) {
+	if existing := t.Search(remoteNode.GetID()); existing != nil && !existing.LastActiveTime.IsZero() {
+		return
+	}
+	t.add(remoteNode, SOURCE_INTRODUCE)
+	t.ping(remoteNode)
+}
+
+// GetActiveNodes returns all the nodes which have talked to us
+func (t *KTable) GetActiveNodes() []*node.RemoteNode {
+	remotes := make([]*node.RemoteNode, 0)
+	for _, bucket := range t.getBuckets() {
+		for _, rnode := range bucket.GetAll() {
+			if !rnode.LastActiveTime.IsZero() {
+				remotes = append(remotes, rnode)
+			}
+		}
 	}
+	return remotes
 }
 
 func (t *KTable) PeekNodes() []*node.RemoteNode {
 	remotes := make([]*node.RemoteNode, 0)
-	for _, bucket := range t.buckets {
+	for _, bucket := range t.getBuckets() {
 		node := bucket.Peek()
 		if node != nil {
 			remotes = append(remotes, node)
@@ -117,13 +241,14 @@ func (t *KTable) GetLocalNode() *node.LocalNode {
 	return t.localNode
 }
 
-func (t *KTable) offline(nodeID string) {
+func (t *KTable) offline(nodeID string, reason string) {
 	logger.Debug("node offline %v", nodeID)
 	id, _ := hex.DecodeString(nodeID)
 	dist := distance(t.localNode.GetIDBytes(), id)
-	if bucket, ok := t.buckets[dist]; ok {
+	if bucket, ok := t.getBucket(dist); ok {
 		if rnode := bucket.Search(nodeID); rnode != nil {
 			bucket.Remove(rnode)
+			t.localNode.Events().Publish(&events.BucketNodeEvicted{NodeID: nodeID, Distance: dist, Reason: reason})
 		}
 	}
 }
@@ -136,7 +261,7 @@ func (t *KTable) refresh(nodeID string, localIP string, localPort int, remoteIP
 	id, _ := hex.DecodeString(nodeID)
 	dist := distance(t.localNode.GetIDBytes(), id)
 	logger.Trace("refresh exist node %v：%v:%v -> %v:%v, %v", nodeID, localIP, localPort, remoteIP, remotePort, dist)
-	if bucket, ok := t.buckets[dist]; ok {
+	if bucket, ok := t.getBucket(dist); ok {
 		rnode := bucket.Search(nodeID)
 		if rnode != nil {
 			//logger.Trace("refresh exist node：%v, %v, %v", remoteIP, remotePort, dist)
@@ -147,7 +272,8 @@ func (t *KTable) refresh(nodeID string, localIP string, localPort int, remoteIP
 			localAddr := net.ParseIP(localIP)
 			remoteAddr := net.ParseIP(remoteIP)
 			rnode = node.NewRemoteNode(id, localAddr, localPort, remoteAddr, remotePort)
-			if bucket.Add(rnode) {
+			rnode.Distance = dist
+			if t.addToBucket(bucket, rnode, SOURCE_CONTACT) {
 				return
 			}
 			//logger.Trace("refresh to ping first node")
@@ -159,9 +285,42 @@ func (t *KTable) refresh(nodeID string, localIP string, localPort int, remoteIP
 		remoteAddr := net.ParseIP(remoteIP)
 		rnode := node.NewRemoteNode(id, localAddr, localPort, remoteAddr, remotePort)
 		rnode.Distance = dist
-		bucket := NewKBucket()
-		bucket.Add(rnode)
-		t.buckets[dist] = bucket
+		t.addToBucket(t.getOrCreateBucket(dist), rnode, SOURCE_CONTACT)
+	}
+}
+
+// a record forwarded by another node, only the newest valid record is taken
+func (t *KTable) refreshWithRecord(record *node.NodeRecord, introducer string) {
+	if record.ID == t.localNode.GetID() {
+		return
+	}
+	if rnode := t.Search(record.ID); rnode != nil {
+		rnode.ApplyRecord(record)
+		return
+	}
+	if rnode := node.NewRemoteNodeFromRecord(record); rnode != nil {
+		rnode.IntroducedBy = introducer
+		t.add(rnode, SOURCE_FINDNODE)
+	}
+}
+
+// a record sent by the node itself, the address we observed still wins for replies
+func (t *KTable) identify(nodeID string, record *node.NodeRecord, observed *net.UDPAddr) {
+	if record == nil {
+		return
+	}
+	if record.ID != nodeID {
+		logger.Warn("node %v sent a record of %v, drop it", nodeID, record.ID)
+		return
+	}
+	rnode := t.Search(nodeID)
+	if rnode == nil {
+		return
+	}
+	if rnode.ApplyRecord(record) {
+		logger.Trace("identified node %v with record seq %v", nodeID, record.Seq)
+		t.localNode.Events().Publish(&events.IdentifyCompleted{NodeID: nodeID, Seq: record.Seq, Capabilities: record.Capabilities})
+		rnode.RefreshNode(rnode.GetLocalIP().String(), rnode.GetLocalPort(), observed.IP.String(), observed.Port, -1)
 	}
 }
 
@@ -181,9 +340,33 @@ func (t *KTable) send(rnode *node.RemoteNode, data []byte) {
 	t.network.Send(ip, port, data, rnode.GetID())
 }
 
+// Remove drops a node from its bucket
+func (t *KTable) Remove(nodeID string) {
+	t.offline(nodeID, "removed")
+}
+
+// Ping sends a PING and waits for the PONG, returns the round trip time
+func (t *KTable) Ping(rnode *node.RemoteNode, timeout time.Duration) (time.Duration, error) {
+	// the waiter must be there before the pong can arrive
+	waiter := make(chan time.Duration, 1)
+	id := utils.NewUUID()
+	t.pongWaiters.Store(id, waiter)
+	defer t.pongWaiters.Delete(id)
+	t.pingWithID(rnode, id)
+	select {
+	case rtt := <-waiter:
+		return rtt, nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("no pong from %v within %v", rnode.GetID(), timeout)
+	}
+}
+
 func (t *KTable) ping(rnode *node.RemoteNode) {
+	t.pingWithID(rnode, utils.NewUUID())
+}
+
+func (t *KTable) pingWithID(rnode *node.RemoteNode, id string) {
 	//t.network.Ping(rnode.GetID(), rnode.GetIP(), rnode.GetPort(), nil)
-	id := utils.NewUUID()
 	ts := time.Now().Unix()
 	exprie := ts + int64(models.DEFAULT_TIMEOUT)
 	ping := PingDiagram{
@@ -200,6 +383,7 @@ func (t *KTable) ping(rnode *node.RemoteNode) {
 			LocalAddr: t.localNode.GetLocalIP().String(),
 			LocalPort: t.localNode.GetLocalPort(),
 		},
+		Record: t.localNode.GetRecord(),
 	}
 	t.send(rnode, utils.DiagramToBytes(ping))
 	pingTime.Store(id, time.Now())
@@ -211,9 +395,8 @@ func (t *KTable) ping(rnode *node.RemoteNode) {
 func (t *KTable) pongAction(data []byte) {
 	var pong PongDiagram
 	utils.BytesToUDPDiagram(data, &pong)
-	if t.localNode.GetRemoteIP().String() != pong.RemoteAddr || t.localNode.GetRemotePort() != pong.RemotePort {
-		t.localNode.SetRemoteIPPort(pong.RemoteAddr, pong.RemotePort)
-	}
+	// only a vote, the address is advertised after dial-backs proved it
+	t.localNode.AddObservedAddr(pong.RemoteAddr, pong.RemotePort, pong.NodeID)
 }
 
 func (t *KTable) pong(diagram models.UDPDiagram, remoteAddr *net.UDPAddr) {
@@ -235,13 +418,14 @@ func (t *KTable) pong(diagram models.UDPDiagram, remoteAddr *net.UDPAddr) {
 		},
 		RemoteAddr: remoteAddr.IP.String(),
 		RemotePort: remoteAddr.Port,
+		Record:     t.localNode.GetRecord(),
 	}
 	rnode := node.NewRemoteNode([]byte(diagram.NodeID), net.ParseIP(diagram.LocalAddr), diagram.LocalPort, remoteAddr.IP, remoteAddr.Port)
 	t.send(rnode, utils.DiagramToBytes(pong))
 	logger.Trace("echo pong to %v:%v", rnode.GetRemoteIP().String(), rnode.GetRemotePort())
 }
 
-func (t *KTable) findNode(rnode *node.RemoteNode) {
+func (t *KTable) findNode(rnode *node.RemoteNode, target []byte) string {
 	id := utils.NewUUID()
 	ts := time.Now().Unix()
 	exprie := ts + int64(models.DEFAULT_TIMEOUT)
@@ -259,14 +443,19 @@ func (t *KTable) findNode(rnode *node.RemoteNode) {
 			LocalAddr: t.localNode.GetLocalIP().String(),
 			LocalPort: t.localNode.GetLocalPort(),
 		},
+		Target: hex.EncodeToString(target),
 	}
 	t.send(rnode, utils.DiagramToBytes(fn))
 	t.addWaitReply(id, ts, exprie, rnode)
 	logger.Trace("send find node to %v:%v", rnode.GetRemoteIP().String(), rnode.GetRemotePort())
+	return id
 }
 
-func (t *KTable) findNodeAction(msgID string, nodeID string, ip net.IP, port int) {
-	nodes := t.findNodeFromBuckets(nodeID)
+func (t *KTable) findNodeAction(msgID string, nodeID string, target string, ip net.IP, port int) {
+	if len(target) == 0 {
+		target = nodeID
+	}
+	nodes := t.findNodeFromBuckets(target)
 	nodeDiagrams := make([]NodeDiagram, 0)
 	for _, n := range nodes {
 		nd := NodeDiagram{
@@ -275,6 +464,7 @@ func (t *KTable) findNodeAction(msgID string, nodeID string, ip net.IP, port int
 			LocalPort:  n.GetLocalPort(),
 			RemoteIP:   n.GetRemoteIP().String(),
 			RemotePort: n.GetRemotePort(),
+			Record:     n.GetRecord(),
 		}
 		nodeDiagrams = append(nodeDiagrams, nd)
 	}
@@ -296,7 +486,9 @@ func (t *KTable) findNodeAction(msgID string, nodeID string, ip net.IP, port int
 		},
 		Nodes: nodeDiagrams,
 	}
-	t.network.Send(ip, port, utils.DiagramToBytes(resp), nodeID)
+	for _, packet := range splitFindNodeResp(resp) {
+		t.network.Send(ip, port, packet, nodeID)
+	}
 	logger.Trace("echo find node resp to %v:%v", ip.String(), port)
 }
 
@@ -308,7 +500,7 @@ func (t *KTable) findNodeFromBuckets(nodeID string) []*node.RemoteNode {
 	i = dist
 	j = dist + 1
 	for i >= 0 || j < 256 {
-		if bucket, ok := t.buckets[i]; i >= 0 && ok {
+		if bucket, ok := t.getBucket(i); i >= 0 && ok {
 			inodes := bucket.GetAll()
 			for _, ind := range inodes {
 				if len(nodes) < BUCKETS_SIZE {
@@ -319,7 +511,7 @@ func (t *KTable) findNodeFromBuckets(nodeID string) []*node.RemoteNode {
 			}
 		}
 		i--
-		if bucket, ok := t.buckets[j]; j < 256 && ok {
+		if bucket, ok := t.getBucket(j); j < 256 && ok {
 			jnodes := bucket.GetAll()
 			for _, jnd := range jnodes {
 				if len(nodes) < BUCKETS_SIZE {
@@ -337,12 +529,15 @@ func (t *KTable) findNodeFromBuckets(nodeID string) []*node.RemoteNode {
 	return nodes
 }
 
-func (t *KTable) findNodeResp(data []byte) {
-	var resp FindNodeRespDiagram
-	utils.BytesToUDPDiagram(data, &resp)
+func (t *KTable) findNodeResp(resp FindNodeRespDiagram) {
 	for _, n := range resp.Nodes {
-		t.refresh(n.NodeID, n.LocalAddr, n.LocalPort, n.RemoteIP, n.RemotePort, -1)
+		if n.Record != nil {
+			t.refreshWithRecord(n.Record, resp.NodeID)
+		} else if ACCEPT_UNSIGNED_NODES {
+			t.refresh(n.NodeID, n.LocalAddr, n.LocalPort, n.RemoteIP, n.RemotePort, -1)
+		}
 	}
+	t.continueLookup(resp.ID, resp.NodeID, resp.Nodes)
 	logger.Trace("recieve find node resp")
 }
 
@@ -359,7 +554,15 @@ func (t *KTable) callback(p models.ICallbackParams) {
 		latency := -1
 		if params.Diagram.GetDType() == KTABLE_DIAGRAM_PONG {
 			if lastTime, ok := pingTime.Load(params.Diagram.GetID()); ok {
-				latency = int(time.Since(lastTime.(time.Time)) / time.Millisecond)
+				rtt := time.Since(lastTime.(time.Time))
+				latency = int(rtt / time.Millisecond)
+				metrics.ObservePing(rtt.Seconds())
+				if waiter, ok := t.pongWaiters.Load(params.Diagram.GetID()); ok {
+					select {
+					case waiter.(chan time.Duration) <- rtt:
+					default:
+					}
+				}
 				logger.Debug("recieve pong from %v, %v:%v - latency: %vms", params.GetUDPDiagram().GetNodeID(), params.GetUDPRemoteAddr().IP.String(), params.GetUDPRemoteAddr().Port, latency)
 				pingTime.Delete(params.Diagram.GetID())
 			}
@@ -367,33 +570,43 @@ func (t *KTable) callback(p models.ICallbackParams) {
 			if expectedNodeId, ok := pingExpectedNodeIds.Load(params.Diagram.GetID()); ok && expectedNodeId != params.GetUDPDiagram().GetNodeID() {
 				// boom
 				logger.Warn("The node %v is obsolete, remove it", expectedNodeId)
-				t.offline(expectedNodeId.(string))
+				t.offline(expectedNodeId.(string), "obsolete")
 			}
 		}
 		logger.Debug("recieved %v from node %v", params.Diagram.GetDType(), params.GetUDPDiagram().GetNodeID())
 		t.refresh(params.Diagram.GetNodeID(), params.GetUDPDiagram().LocalAddr, params.GetUDPDiagram().LocalPort, params.GetUDPRemoteAddr().IP.String(), params.GetUDPRemoteAddr().Port, latency)
 		switch params.Diagram.GetDType() {
+		case KTABLE_DIAGRAM_PING, KTABLE_DIAGRAM_PONG:
+			var ping PingDiagram
+			utils.BytesToUDPDiagram(params.Data, &ping)
+			t.identify(params.Diagram.GetNodeID(), ping.Record, params.GetUDPRemoteAddr())
+		}
+		switch params.Diagram.GetDType() {
 		case KTABLE_DIAGRAM_PING:
 			t.pong(params.GetUDPDiagram(), params.GetUDPRemoteAddr())
 		case KTABLE_DIAGRAM_PONG:
 			t.pongAction(params.Data)
 		case KTABLE_DIAGRAM_FINDNODE:
-			t.findNodeAction(params.Diagram.GetID(), params.Diagram.GetNodeID(), params.GetUDPRemoteAddr().IP, params.GetUDPRemoteAddr().Port)
+			var fn FindNodeDiagram
+			utils.BytesToUDPDiagram(params.Data, &fn)
+			t.findNodeAction(params.Diagram.GetID(), params.Diagram.GetNodeID(), fn.Target, params.GetUDPRemoteAddr().IP, params.GetUDPRemoteAddr().Port)
 		case KTABLE_DIAGRAM_FINDNODERESP:
-			t.findNodeResp(params.Data)
+			t.receiveFindNodeResp(params.Data)
 		default:
 		}
 	}
 }
 
 func (t *KTable) timeoutCallback(wait waitReply) {
-	t.offline(wait.RemoteNode.GetID())
+	t.lookups.Delete(wait.MesageID)
+	t.offline(wait.RemoteNode.GetID(), "timeout")
 }
 
 func (t *KTable) Start() {
+	go t.bootstrapper.Run(t.populated, t.seed, nil)
 	go t.loopPing()
 	go t.loopTimeout()
-	go t.loopFindNode()
+	go t.loopRefresh()
 }
 
 func (t *KTable) loopTimeout() {
@@ -429,9 +642,6 @@ func (t *KTable) loopTimeout() {
 func (t *KTable) loopPing() {
 	for {
 		nodes := t.PeekNodes()
-		if len(nodes) == 0 {
-			t.loadInitNodes()
-		}
 		for _, rnode := range nodes {
 			t.ping(rnode)
 		}
@@ -439,21 +649,9 @@ func (t *KTable) loopPing() {
 	}
 }
 
-func (t *KTable) loopFindNode() {
-	time.Sleep(12 * time.Second)
-	for {
-		nodes := t.PeekNodes()
-		for _, rnode := range nodes {
-			t.findNode(rnode)
-		}
-		time.Sleep(60 * time.Second)
-	}
-}
-
-func initialStaticNodes() []*node.RemoteNode {
+func toRemoteNodes(nodes []config.StaticNode) []*node.RemoteNode {
 	remoteNodes := make([]*node.RemoteNode, 0)
-	nodes := config.LoadStaticNodes()
-	for _, snode := range nodes.Nodes {
+	for _, snode := range nodes {
 		id, _ := hex.DecodeString(snode.ID)
 		ip := net.ParseIP(snode.IP)
 		rnode := node.NewRemoteNode(id, ip, snode.Port, ip, snode.Port)
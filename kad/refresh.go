@@ -0,0 +1,179 @@
+package kad
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/node"
+)
+
+var (
+	// buckets not touched within this interval get a random-target lookup
+	BUCKET_REFRESH_INTERVAL       = time.Hour
+	BUCKET_REFRESH_CHECK_INTERVAL = time.Minute
+	// wait for the bootnodes before the self lookup
+	SELF_LOOKUP_DELAY = 5 * time.Second
+	// spread the refresh of many stale buckets, e.g. right after startup, over several rounds
+	BUCKET_REFRESH_MAX_PER_ROUND = 32
+
+	// parallel FINDNODE queries per lookup step
+	LOOKUP_ALPHA = 3
+	// max FINDNODE queries a single lookup may send
+	LOOKUP_MAX_QUERIES = 16
+)
+
+// an iterative lookup, every response triggers queries to the closest nodes not asked yet
+type lookup struct {
+	mux     sync.Mutex
+	target  []byte
+	asked   map[string]bool
+	queries int
+}
+
+// Lookup walks the table towards the target id, the nodes found on the way are added to the buckets.
+// Returns false if there is no node to ask yet.
+func (t *KTable) Lookup(target []byte) bool {
+	candidates := t.findNodeFromBuckets(hex.EncodeToString(target))
+	if len(candidates) == 0 {
+		return false
+	}
+	l := &lookup{
+		target: target,
+		asked:  make(map[string]bool),
+	}
+	t.markLookup(distance(t.localNode.GetIDBytes(), target))
+	t.queryLookup(l, candidates)
+	return true
+}
+
+func (t *KTable) queryLookup(l *lookup, candidates []*node.RemoteNode) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return Closer(l.target, candidates[i].GetIDBytes(), candidates[j].GetIDBytes())
+	})
+
+	sent := 0
+	for _, rnode := range candidates {
+		if sent >= LOOKUP_ALPHA || l.queries >= LOOKUP_MAX_QUERIES {
+			break
+		}
+		if l.asked[rnode.GetID()] || rnode.GetID() == t.localNode.GetID() {
+			continue
+		}
+		l.asked[rnode.GetID()] = true
+		l.queries++
+		sent++
+		msgID := t.findNode(rnode, l.target)
+		t.lookups.Store(msgID, l)
+	}
+}
+
+// the lookup goes on through the nodes of the response whether they made it into the table or not,
+// a full bucket would stop it otherwise
+func (t *KTable) continueLookup(msgID string, introducer string, nodes []NodeDiagram) {
+	obj, ok := t.lookups.Load(msgID)
+	if !ok {
+		return
+	}
+	t.lookups.Delete(msgID)
+	l := obj.(*lookup)
+
+	candidates := make([]*node.RemoteNode, 0, len(nodes))
+	for _, n := range nodes {
+		if rnode := t.Search(n.NodeID); rnode != nil {
+			candidates = append(candidates, rnode)
+			continue
+		}
+		if n.Record == nil || n.Record.ID != n.NodeID {
+			continue
+		}
+		if rnode := node.NewRemoteNodeFromRecord(n.Record); rnode != nil {
+			rnode.IntroducedBy = introducer
+			candidates = append(candidates, rnode)
+		}
+	}
+	t.queryLookup(l, candidates)
+}
+
+// Search returns nil if the node is not in the table
+func (t *KTable) Search(nodeID string) *node.RemoteNode {
+	id, err := hex.DecodeString(nodeID)
+	if err != nil || len(id) == 0 {
+		return nil
+	}
+	if bucket, ok := t.getBucket(distance(t.localNode.GetIDBytes(), id)); ok {
+		return bucket.Search(nodeID)
+	}
+	return nil
+}
+
+func (t *KTable) markLookup(dist int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.lastLookup[dist] = time.Now()
+}
+
+// a bucket is stale when neither a node in it was refreshed nor a lookup into it ran recently.
+// The empty ones are stale too, every bucket covers 1/256 of the ids and a lookup into it may fill it,
+// BUCKET_REFRESH_MAX_PER_ROUND spreads them over the rounds.
+func (t *KTable) staleBuckets() []int {
+	buckets := t.getBuckets()
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	stale := make([]int, 0)
+	for dist := 0; dist < 256; dist++ {
+		touched := t.lastLookup[dist]
+		if bucket, ok := buckets[dist]; ok && bucket.LastUpdated().After(touched) {
+			touched = bucket.LastUpdated()
+		}
+		if time.Since(touched) > BUCKET_REFRESH_INTERVAL {
+			stale = append(stale, dist)
+		}
+	}
+	return stale
+}
+
+func (t *KTable) loopRefresh() {
+	time.Sleep(SELF_LOOKUP_DELAY)
+	for !t.Lookup(t.localNode.GetIDBytes()) {
+		time.Sleep(SELF_LOOKUP_DELAY)
+	}
+	for {
+		time.Sleep(BUCKET_REFRESH_CHECK_INTERVAL)
+		for i, dist := range t.staleBuckets() {
+			if i >= BUCKET_REFRESH_MAX_PER_ROUND {
+				break
+			}
+			logger.Trace("refresh bucket %v", dist)
+			t.Lookup(randomIDInBucket(t.localNode.GetIDBytes(), dist))
+		}
+	}
+}
+
+// a random id whose distance to the local id falls into the given bucket
+func randomIDInBucket(localID []byte, dist int) []byte {
+	id := make([]byte, len(localID))
+	rand.Read(id)
+	id[0] = localID[0] ^ byte(dist)
+	return id
+}
+
+// Closer tells whether a is closer to the target than b by full xor distance
+func Closer(target, a, b []byte) bool {
+	da := make([]byte, len(target))
+	db := make([]byte, len(target))
+	for i := range target {
+		if i < len(a) {
+			da[i] = target[i] ^ a[i]
+		}
+		if i < len(b) {
+			db[i] = target[i] ^ b[i]
+		}
+	}
+	return bytes.Compare(da, db) < 0
+}
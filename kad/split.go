@@ -0,0 +1,113 @@
+package kad
+
+import (
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/udp"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	// a response missing parts after this is taken with the parts we got
+	FINDNODERESP_REASSEMBLY_TIMEOUT = 2 * time.Second
+)
+
+// the parts of a split FINDNODERESP received so far
+type partialResp struct {
+	mux   sync.Mutex
+	first FindNodeRespDiagram
+	parts map[int][]NodeDiagram
+	done  bool
+}
+
+// split the nodes into as many responses as needed to keep each packet within udp.MAX_UDP_PAYLOAD
+func splitFindNodeResp(resp FindNodeRespDiagram) [][]byte {
+	nodes := resp.Nodes
+	// the part numbers are not known yet, size with the largest ones
+	resp.Part, resp.Total = len(nodes), len(nodes)
+	chunks := make([][]NodeDiagram, 0)
+	current := make([]NodeDiagram, 0)
+	for _, n := range nodes {
+		resp.Nodes = append(current, n)
+		if udp.CheckPayload(utils.DiagramToBytes(resp)) == nil {
+			current = resp.Nodes
+			continue
+		}
+		if len(current) == 0 {
+			logger.Error("node %v alone exceeds the udp payload limit, leave it out", n.NodeID)
+			continue
+		}
+		chunks = append(chunks, current)
+		current = []NodeDiagram{n}
+		resp.Nodes = current
+		if udp.CheckPayload(utils.DiagramToBytes(resp)) != nil {
+			logger.Error("node %v alone exceeds the udp payload limit, leave it out", n.NodeID)
+			current = make([]NodeDiagram, 0)
+		}
+	}
+	if len(current) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, current)
+	}
+
+	packets := make([][]byte, 0, len(chunks))
+	for i, chunk := range chunks {
+		resp.Nodes = chunk
+		resp.Part, resp.Total = i, len(chunks)
+		if len(chunks) == 1 {
+			resp.Part, resp.Total = 0, 0
+		}
+		packets = append(packets, utils.DiagramToBytes(resp))
+	}
+	return packets
+}
+
+// reassemble the parts of a response, the complete one is handled once
+func (t *KTable) receiveFindNodeResp(data []byte) {
+	var resp FindNodeRespDiagram
+	if err := utils.BytesToUDPDiagram(data, &resp); err != nil {
+		return
+	}
+	if resp.Total <= 1 {
+		t.findNodeResp(resp)
+		return
+	}
+	if resp.Part < 0 || resp.Part >= resp.Total || resp.Total > BUCKETS_SIZE {
+		logger.Debug("drop part %v/%v of response %v", resp.Part, resp.Total, resp.ID)
+		return
+	}
+
+	key := resp.ID + "/" + resp.NodeID
+	obj, loaded := t.partials.LoadOrStore(key, &partialResp{first: resp, parts: make(map[int][]NodeDiagram)})
+	partial := obj.(*partialResp)
+	if !loaded {
+		time.AfterFunc(FINDNODERESP_REASSEMBLY_TIMEOUT, func() { t.completeFindNodeResp(key, partial, true) })
+	}
+	partial.mux.Lock()
+	partial.parts[resp.Part] = resp.Nodes
+	complete := len(partial.parts) >= partial.first.Total
+	partial.mux.Unlock()
+	if complete {
+		t.completeFindNodeResp(key, partial, false)
+	}
+}
+
+func (t *KTable) completeFindNodeResp(key string, partial *partialResp, timeout bool) {
+	partial.mux.Lock()
+	if partial.done {
+		partial.mux.Unlock()
+		return
+	}
+	partial.done = true
+	resp := partial.first
+	resp.Nodes = make([]NodeDiagram, 0)
+	for i := 0; i < resp.Total; i++ {
+		resp.Nodes = append(resp.Nodes, partial.parts[i]...)
+	}
+	if timeout {
+		logger.Debug("response %v got %v of %v parts", resp.ID, len(partial.parts), resp.Total)
+	}
+	partial.mux.Unlock()
+	t.partials.Delete(key)
+	t.findNodeResp(resp)
+}
@@ -0,0 +1,165 @@
+package lan
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/udp"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	logger = log.GetLogger("lan")
+
+	LAN_DIAGRAM_CATEGORY = "LAN"
+	LAN_DIAGRAM_BEACON   = "BEACON"
+
+	LAN_BEACON_INTERVAL  = 10 * time.Second
+	LAN_READ_BUFFER_SIZE = 8192
+	// a failing read is retried after a pause doubling up to this, e.g. while the interface is down
+	LAN_READ_RETRY_MAX = 10 * time.Second
+)
+
+// announces the node on the lan, the record proves the id and carries the ports
+type BeaconDiagram struct {
+	models.UDPDiagram
+	Record *node.NodeRecord
+}
+
+// Discovery finds the nodes on the local network with a udp multicast beacon and feeds them to the table.
+// Only ipv4 multicast is used, ipv6-only lans still need a bootnode.
+type Discovery struct {
+	localNode *node.LocalNode
+	ktable    *kad.KTable
+	group     *net.UDPAddr
+	conn      *net.UDPConn
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDiscovery(localNode *node.LocalNode, ktable *kad.KTable) (*Discovery, error) {
+	group, err := net.ResolveUDPAddr("udp4", config.LAN_MULTICAST_ADDR)
+	if err != nil {
+		return nil, err
+	}
+	return &Discovery{
+		localNode: localNode,
+		ktable:    ktable,
+		group:     group,
+		quit:      make(chan struct{}),
+	}, nil
+}
+
+func (d *Discovery) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, d.group)
+	if err != nil {
+		return err
+	}
+	conn.SetReadBuffer(LAN_READ_BUFFER_SIZE)
+	d.conn = conn
+	logger.Info("lan discovery on %v", d.group)
+	go d.loopRead()
+	go d.loopBeacon()
+	return nil
+}
+
+func (d *Discovery) Close() {
+	d.closeOnce.Do(func() {
+		close(d.quit)
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	})
+}
+
+func (d *Discovery) loopBeacon() {
+	ticker := time.NewTicker(LAN_BEACON_INTERVAL)
+	defer ticker.Stop()
+	for {
+		d.beacon()
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Discovery) beacon() {
+	ts := time.Now().Unix()
+	beacon := BeaconDiagram{
+		UDPDiagram: models.UDPDiagram{
+			NetworkDiagram: models.NetworkDiagram{
+				ID:        utils.NewUUID(),
+				NodeID:    d.localNode.GetID(),
+				Timestamp: ts,
+				DCategory: LAN_DIAGRAM_CATEGORY,
+				DType:     LAN_DIAGRAM_BEACON,
+				Version:   models.UDP_DIAGRAM_VERSION,
+			},
+			Expire:    ts + int64(models.DEFAULT_TIMEOUT),
+			LocalAddr: d.localNode.GetLocalIP().String(),
+			LocalPort: d.localNode.GetLocalPort(),
+		},
+		Record: d.localNode.GetRecord(),
+	}
+	data := utils.DiagramToBytes(beacon)
+	if err := udp.CheckPayload(data); err != nil {
+		logger.Error("beacon not sent: %v", err)
+		return
+	}
+	if _, err := d.conn.WriteToUDP(data, d.group); err != nil {
+		logger.Debug("send beacon error: %v", err)
+	}
+}
+
+func (d *Discovery) loopRead() {
+	buf := make([]byte, LAN_READ_BUFFER_SIZE)
+	retry := time.Duration(0)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			retry *= 2
+			if retry == 0 {
+				retry = 100 * time.Millisecond
+			} else if retry > LAN_READ_RETRY_MAX {
+				retry = LAN_READ_RETRY_MAX
+			}
+			logger.Debug("read beacon error, retry in %v: %v", retry, err)
+			select {
+			case <-d.quit:
+				return
+			case <-time.After(retry):
+			}
+			continue
+		}
+		retry = 0
+		var beacon BeaconDiagram
+		if err := utils.BytesToUDPDiagram(buf[:n], &beacon); err != nil {
+			continue
+		}
+		d.found(beacon, addr)
+	}
+}
+
+// the beacon comes from the node's lan address, the udp port is taken from the diagram
+func (d *Discovery) found(beacon BeaconDiagram, addr *net.UDPAddr) {
+	if beacon.DCategory != LAN_DIAGRAM_CATEGORY || beacon.Record == nil || beacon.NodeID == d.localNode.GetID() {
+		return
+	}
+	if beacon.Record.ID != beacon.NodeID || beacon.LocalPort == 0 {
+		return
+	}
+	rnode := node.NewLANRemoteNode(beacon.Record, addr.IP, beacon.LocalPort, d.localNode)
+	if rnode == nil {
+		return
+	}
+	logger.Trace("found %v on the lan at %v", beacon.NodeID, addr.IP)
+	d.ktable.Introduce(rnode)
+}
@@ -0,0 +1,298 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a metric writes its samples in the prometheus text format
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds the metrics served together
+type Registry struct {
+	mux     sync.RWMutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// a metric registered twice replaces the first one
+func (r *Registry) register(m metric) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.metrics[m.name()] = m
+}
+
+// WriteText writes all the metrics in the prometheus text exposition format, sorted by name
+func (r *Registry) WriteText(w io.Writer) {
+	r.mux.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mux.RUnlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type desc struct {
+	metricName string
+	help       string
+	labelNames []string
+}
+
+func (d desc) name() string { return d.metricName }
+
+func (d desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.metricName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.metricName, kind)
+}
+
+// {a="1",b="2"}, empty without labels
+func (d desc) labels(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, name := range d.labelNames {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, escapeLabel(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// label values are joined into a map key
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func split(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys(m map[string]*float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// CounterVec only goes up, one value per combination of label values
+type CounterVec struct {
+	desc
+	mux    sync.Mutex
+	values map[string]*float64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, labelNames}, values: make(map[string]*float64)}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	k := key(labelValues)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	value, ok := c.values[k]
+	if !ok {
+		value = new(float64)
+		c.values[k] = value
+	}
+	*value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.metricName, c.labels(split(k)), formatFloat(*c.values[k]))
+	}
+}
+
+// GaugeVec goes up and down
+type GaugeVec struct {
+	desc
+	mux    sync.Mutex
+	values map[string]*float64
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{desc: desc{name, help, labelNames}, values: make(map[string]*float64)}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	k := key(labelValues)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	value, ok := g.values[k]
+	if !ok {
+		value = new(float64)
+		g.values[k] = value
+	}
+	*value = v
+}
+
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	k := key(labelValues)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	value, ok := g.values[k]
+	if !ok {
+		value = new(float64)
+		g.values[k] = value
+	}
+	*value += v
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%v%v %v\n", g.metricName, g.labels(split(k)), formatFloat(*g.values[k]))
+	}
+}
+
+// EmitFunc reports one sample of a func metric
+type EmitFunc func(value float64, labelValues ...string)
+
+// funcMetric is computed when scraped, e.g. from the state of another component
+type funcMetric struct {
+	desc
+	kind    string
+	collect func(emit EmitFunc)
+}
+
+// NewGaugeFunc calls collect on every scrape
+func (r *Registry) NewGaugeFunc(name string, help string, labelNames []string, collect func(emit EmitFunc)) {
+	r.register(&funcMetric{desc: desc{name, help, labelNames}, kind: "gauge", collect: collect})
+}
+
+// NewCounterFunc calls collect on every scrape, for counters kept by another component
+func (r *Registry) NewCounterFunc(name string, help string, labelNames []string, collect func(emit EmitFunc)) {
+	r.register(&funcMetric{desc: desc{name, help, labelNames}, kind: "counter", collect: collect})
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	f.header(w, f.kind)
+	f.collect(func(value float64, labelValues ...string) {
+		fmt.Fprintf(w, "%v%v %v\n", f.metricName, f.labels(labelValues), formatFloat(value))
+	})
+}
+
+// HistogramVec counts observations into cumulative buckets
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mux     sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// buckets are the upper bounds in increasing order, +Inf is added
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name, help, labelNames}, buckets: buckets, values: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := key(labelValues)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	value, ok := h.values[k]
+	if !ok {
+		value = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = value
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, labelValues := h.values[k], split(k)
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, h.labels(labelValues, "le", formatFloat(upper)), value.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.metricName, h.labels(labelValues, "le", "+Inf"), value.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.metricName, h.labels(labelValues), formatFloat(value.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.metricName, h.labels(labelValues), value.count)
+	}
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/symphonyprotocol/log"
+)
+
+var logger = log.GetLogger("metrics")
+
+var (
+	// DIRECTION_* and TRANSPORT_* label the message counters
+	DIRECTION_IN  = "in"
+	DIRECTION_OUT = "out"
+	TRANSPORT_UDP = "udp"
+	TRANSPORT_TCP = "tcp"
+
+	// DIAL_* label the dial counter
+	DIAL_SUCCESS  = "success"
+	DIAL_FAILURE  = "failure"
+	DIAL_FALLBACK = "fallback"
+
+	PING_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	// the category and the type of a received message come from the wire, the ones past these limits
+	// are counted as LABEL_UNKNOWN so that a peer can't grow the counters without bound
+	MAX_MESSAGE_CATEGORIES = 64
+	MAX_MESSAGE_TYPES      = 64
+	LABEL_UNKNOWN          = "unknown"
+)
+
+// DefaultRegistry is served by Handler and Serve
+var DefaultRegistry = NewRegistry()
+
+var (
+	Messages = DefaultRegistry.NewCounterVec("p2p_messages_total", "Messages sent and received.", "direction", "transport", "category", "type")
+	Bytes    = DefaultRegistry.NewCounterVec("p2p_bytes_total", "Bytes of the messages sent and received.", "direction", "transport", "category", "type")
+	Dials    = DefaultRegistry.NewCounterVec("p2p_dials_total", "Outgoing tcp connections by result.", "result")
+	PingRTT  = DefaultRegistry.NewHistogramVec("p2p_ping_latency_seconds", "Round trip time of the kademlia pings.", PING_LATENCY_BUCKETS)
+)
+
+var enabled int32
+
+// the counters on the hot paths are only updated once enabled, so that decoding
+// outgoing packets for their labels costs nothing when nobody scrapes
+func Enable() {
+	atomic.StoreInt32(&enabled, 1)
+}
+
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+var (
+	messageLabelsMux sync.Mutex
+	messageLabels    = make(map[string]map[string]bool) // category -> types
+)
+
+// the labels of the message, LABEL_UNKNOWN for the ones past the limits
+func messageLabel(category string, dType string) (string, string) {
+	messageLabelsMux.Lock()
+	defer messageLabelsMux.Unlock()
+	types, ok := messageLabels[category]
+	if !ok {
+		if len(messageLabels) >= MAX_MESSAGE_CATEGORIES {
+			return LABEL_UNKNOWN, LABEL_UNKNOWN
+		}
+		types = make(map[string]bool)
+		messageLabels[category] = types
+	}
+	if !types[dType] {
+		if len(types) >= MAX_MESSAGE_TYPES {
+			return category, LABEL_UNKNOWN
+		}
+		types[dType] = true
+	}
+	return category, dType
+}
+
+// CountMessage counts one message of size bytes
+func CountMessage(direction string, transport string, category string, dType string, size int) {
+	if !Enabled() {
+		return
+	}
+	category, dType = messageLabel(category, dType)
+	Messages.Inc(direction, transport, category, dType)
+	Bytes.Add(float64(size), direction, transport, category, dType)
+}
+
+func CountDial(result string) {
+	if !Enabled() {
+		return
+	}
+	Dials.Inc(result)
+}
+
+func ObservePing(seconds float64) {
+	if !Enabled() {
+		return
+	}
+	PingRTT.Observe(seconds)
+}
+
+// Handler serves the DefaultRegistry in the prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		DefaultRegistry.WriteText(w)
+	})
+}
+
+// Serve enables the metrics and serves them at addr/metrics until the server is closed
+func Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	Enable()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("metrics endpoint stopped: %v", err)
+		}
+	}()
+	logger.Info("serving metrics at http://%v/metrics", listener.Addr())
+	return server, nil
+}
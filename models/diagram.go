@@ -17,6 +17,8 @@ type NetworkDiagram struct {
 	DCategory string
 	DType     string
 	Version   int
+	// set on traced diagrams only, see TraceContext
+	Trace *TraceContext `json:",omitempty"`
 }
 
 func (d NetworkDiagram) GetID() string { return d.ID }
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+// TraceContext travels with a diagram, every node receiving it appends its hop before handling and forwarding it
+type TraceContext struct {
+	TraceID string
+	// the node which started the trace, the hops are reported to it
+	Origin string
+	Report bool
+	Hops   []TraceHop
+}
+
+// TraceHop is one node the diagram went through, the first hop is the origin
+type TraceHop struct {
+	NodeID string
+	// unix nanoseconds at which the node sent (origin) or received the diagram
+	Time int64
+	// the middleware which handled the diagram, empty for the origin
+	Middleware string
+}
+
+func (h TraceHop) GetTime() time.Time { return time.Unix(0, h.Time) }
+
+// ITraceable is implemented by the pointers to the diagrams embedding NetworkDiagram
+type ITraceable interface {
+	IDiagram
+	GetTrace() *TraceContext
+	SetTrace(trace *TraceContext)
+}
+
+func (d NetworkDiagram) GetTrace() *TraceContext       { return d.Trace }
+func (d *NetworkDiagram) SetTrace(trace *TraceContext) { d.Trace = trace }
+
+// NewTraceContext starts a trace at the origin node, report asks the receivers to send their hops back
+func NewTraceContext(origin string, report bool) *TraceContext {
+	return &TraceContext{
+		TraceID: strings.Replace(utils.NewUUID(), "-", "", -1),
+		Origin:  origin,
+		Report:  report,
+		Hops:    []TraceHop{{NodeID: origin, Time: time.Now().UnixNano()}},
+	}
+}
+
+// AddHop records that nodeID received the diagram now
+func (t *TraceContext) AddHop(nodeID string, middleware string) {
+	t.Hops = append(t.Hops, TraceHop{NodeID: nodeID, Time: time.Now().UnixNano(), Middleware: middleware})
+}
+
+// Copy is a deep copy, the hops of the copy can be appended without touching the original
+func (t *TraceContext) Copy() *TraceContext {
+	c := *t
+	c.Hops = append([]TraceHop{}, t.Hops...)
+	return &c
+}
@@ -0,0 +1,201 @@
+package netsize
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/kad"
+)
+
+var (
+	// the ktable has a bucket per value of the first byte of the xor distance, each covers 1/256 of the ids
+	BUCKETS_TOTAL = 256
+	// the estimate is computed again when it is older
+	ESTIMATE_INTERVAL = 10 * time.Second
+	// confidence level of Low and High
+	CONFIDENCE = 0.95
+)
+
+// IBucketSource gives the number of nodes per bucket, implemented by kad.KTable
+type IBucketSource interface {
+	GetBucketSizes() map[int]int
+}
+
+// Estimate is the number of nodes in the network, this one included, with a confidence interval
+type Estimate struct {
+	Size       float64 `json:"size"`
+	Low        float64 `json:"low"`
+	High       float64 `json:"high"`
+	Confidence float64 `json:"confidence"`
+	// the nodes of the ktable the estimate is based on
+	Nodes int `json:"nodes"`
+	// every bucket is full, Size and High are lower bounds
+	Saturated bool      `json:"saturated"`
+	Time      time.Time `json:"time"`
+}
+
+func (e Estimate) String() string {
+	if e.Saturated {
+		return fmt.Sprintf(">= %.0f", e.Size)
+	}
+	return fmt.Sprintf("%.0f (%.0f - %.0f, %.0f%%)", e.Size, e.Low, e.High, e.Confidence*100)
+}
+
+// Fanout is the number of peers a gossip needs to reach every node with probability exp(-exp(-c)),
+// taken from the upper bound so that it errs on the reliable side
+func (e Estimate) Fanout(c float64) int {
+	fanout := int(math.Ceil(math.Log(math.Max(e.High, 1)) + c))
+	if fanout < 1 {
+		return 1
+	}
+	return fanout
+}
+
+// Estimator derives the network size from the density of the ktable buckets. The nodes fall into the
+// buckets uniformly, so the size of a bucket is a poisson count cut at kad.BUCKETS_SIZE. The rate is
+// fitted by maximum likelihood and the interval taken from the profile likelihood.
+// The buckets have to be complete for the estimate to hold, it runs low until the refresh has filled them.
+type Estimator struct {
+	source IBucketSource
+	mux    sync.Mutex
+	last   *Estimate
+}
+
+func NewEstimator(source IBucketSource) *Estimator {
+	return &Estimator{source: source}
+}
+
+// GetEstimate returns the estimate, computed again once it is older than ESTIMATE_INTERVAL
+func (e *Estimator) GetEstimate() Estimate {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.last == nil || time.Since(e.last.Time) >= ESTIMATE_INTERVAL {
+		estimate := EstimateFromBuckets(e.source.GetBucketSizes(), kad.BUCKETS_SIZE)
+		e.last = &estimate
+	}
+	return *e.last
+}
+
+// EstimateFromBuckets estimates the size from the nodes per bucket, buckets holding capacity nodes are full
+func EstimateFromBuckets(sizes map[int]int, capacity int) Estimate {
+	counts := make([]int, 0, BUCKETS_TOTAL)
+	nodes := 0
+	for _, size := range sizes {
+		counts = append(counts, size)
+		nodes += size
+	}
+	for len(counts) < BUCKETS_TOTAL {
+		counts = append(counts, 0)
+	}
+	full := 0
+	for _, c := range counts {
+		if c >= capacity {
+			full++
+		}
+	}
+	likelihood := func(logRate float64) float64 {
+		return logLikelihood(counts, capacity, math.Exp(logRate))
+	}
+
+	// the rate is searched on a log scale, up to far more nodes than a ktable can tell apart
+	minLog, maxLog := math.Log(1e-6), math.Log(float64(capacity)*1e3)
+	best := maximize(likelihood, minLog, maxLog)
+	// the likelihood ratio bound, half the chi-square quantile with one degree of freedom
+	z := normalQuantile(0.5 + CONFIDENCE/2)
+	drop := likelihood(best) - z*z/2
+	low, high := minLog, maxLog
+	if likelihood(minLog) < drop {
+		low = bisect(likelihood, drop, minLog, best)
+	}
+	if likelihood(maxLog) < drop {
+		high = bisect(likelihood, drop, maxLog, best)
+	}
+
+	toSize := func(logRate float64) float64 {
+		if logRate <= minLog {
+			return 1
+		}
+		return 1 + float64(BUCKETS_TOTAL)*math.Exp(logRate)
+	}
+	estimate := Estimate{
+		Size:       toSize(best),
+		Low:        toSize(low),
+		High:       toSize(high),
+		Confidence: CONFIDENCE,
+		Nodes:      nodes,
+		Saturated:  full == len(counts),
+		Time:       time.Now(),
+	}
+	if estimate.Saturated {
+		estimate.Size, estimate.High = estimate.Low, estimate.Low
+	}
+	// we know at least the nodes of the ktable
+	estimate.Low = math.Max(estimate.Low, float64(nodes+1))
+	estimate.Size = math.Max(estimate.Size, estimate.Low)
+	estimate.High = math.Max(estimate.High, estimate.Size)
+	return estimate
+}
+
+// log likelihood of the bucket sizes for a poisson rate, a full bucket counts as at least capacity nodes
+func logLikelihood(counts []int, capacity int, rate float64) float64 {
+	full := logTail(capacity, rate)
+	sum := 0.0
+	for _, c := range counts {
+		if c >= capacity {
+			sum += full
+		} else {
+			lgamma, _ := math.Lgamma(float64(c + 1))
+			sum += float64(c)*math.Log(rate) - rate - lgamma
+		}
+	}
+	return sum
+}
+
+// log P(X >= k) of a poisson variable X
+func logTail(k int, rate float64) float64 {
+	term, cdf := math.Exp(-rate), 0.0
+	for j := 0; j < k; j++ {
+		cdf += term
+		term *= rate / float64(j+1)
+	}
+	if cdf < 1 {
+		return math.Log(1 - cdf)
+	}
+	// 1 - cdf is lost in the rounding for small rates, the first missing term dominates then
+	lgamma, _ := math.Lgamma(float64(k + 1))
+	return float64(k)*math.Log(rate) - rate - lgamma
+}
+
+// golden section search for the maximum of a unimodal f in [a, b]
+func maximize(f func(float64) float64, a float64, b float64) float64 {
+	ratio := (math.Sqrt(5) - 1) / 2
+	for b-a > 1e-6 {
+		c, d := b-ratio*(b-a), a+ratio*(b-a)
+		if f(c) >= f(d) {
+			b = d
+		} else {
+			a = c
+		}
+	}
+	return (a + b) / 2
+}
+
+// the point between outside and inside where f crosses level, f(outside) < level <= f(inside)
+func bisect(f func(float64) float64, level float64, outside float64, inside float64) float64 {
+	for math.Abs(inside-outside) > 1e-6 {
+		mid := (inside + outside) / 2
+		if f(mid) < level {
+			outside = mid
+		} else {
+			inside = mid
+		}
+	}
+	return (inside + outside) / 2
+}
+
+// quantile of the standard normal distribution
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
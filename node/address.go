@@ -0,0 +1,166 @@
+package node
+
+import (
+	"net"
+
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+var (
+	FAMILY_IPV4 = "ip4"
+	FAMILY_IPV6 = "ip6"
+)
+
+func IPFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+// all the global unicast addresses of the up interfaces, the primary one first
+func collectLocalIPs(primary net.IP) []net.IP {
+	ips := make([]net.IP, 0)
+	if primary != nil && !primary.IsLoopback() {
+		ips = append(ips, primary)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		nodeLogger.Warn("list network interfaces error: %v", err)
+		return ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() || containsIP(ips, ipNet.IP) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the ip the listeners bind to, nil binds all the ipv4 and ipv6 addresses
+func (n *LocalNode) GetListenIP() net.IP {
+	if config.DUAL_STACK {
+		return nil
+	}
+	return n.localIP
+}
+
+func (n *LocalNode) GetLocalIPs() []net.IP {
+	return n.localIPs
+}
+
+func (n *LocalNode) HasFamily(family string) bool {
+	for _, ip := range n.localIPs {
+		if IPFamily(ip) == family {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *LocalNode) HasIPv4() bool { return n.HasFamily(FAMILY_IPV4) }
+func (n *LocalNode) HasIPv6() bool { return n.HasFamily(FAMILY_IPV6) }
+
+// whether we have an address of the same family to send from
+func (n *LocalNode) CanReach(ip net.IP) bool {
+	return ip != nil && n.HasFamily(IPFamily(ip))
+}
+
+// the remote address seen by other nodes for the family of ip, nil if unknown
+func (n *LocalNode) GetRemoteAddrFor(family string) *net.UDPAddr {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	if addr, ok := n.remoteAddrs[family]; ok {
+		return addr
+	}
+	return nil
+}
+
+// whether ip is one of the remote addresses of the local node, i.e. behind the same NAT
+func (n *LocalNode) IsOwnRemoteIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	for _, addr := range n.remoteAddrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	// observed but unproven addresses count as well, nodes behind a NAT without
+	// dial-back are private and only have those
+	for _, c := range n.candidates {
+		if c.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the endpoint of the given transport to send to, same NAT uses the local addresses
+// and otherwise the observed address is preferred when we can reach its family
+func (r *RemoteNode) GetSendEndpoint(local *LocalNode, transport string) (net.IP, int) {
+	candidates := make([]Endpoint, 0)
+	if r.record != nil {
+		for _, ep := range r.record.Endpoints {
+			if ep.Transport == transport {
+				candidates = append(candidates, ep)
+			}
+		}
+	}
+
+	if r.remoteIP == nil {
+		return r.localIP, r.localPort
+	}
+	if local.IsOwnRemoteIP(r.remoteIP) {
+		// the local address we know it at first, e.g. found on the lan
+		for _, ep := range candidates {
+			if ip := net.ParseIP(ep.IP); ep.Scope == ENDPOINT_SCOPE_LOCAL && ip.Equal(r.localIP) && local.CanReach(ip) {
+				return ip, ep.Port
+			}
+		}
+		for _, ep := range candidates {
+			if ip := net.ParseIP(ep.IP); ep.Scope == ENDPOINT_SCOPE_LOCAL && local.CanReach(ip) {
+				return ip, ep.Port
+			}
+		}
+		return r.localIP, r.localPort
+	}
+
+	if local.CanReach(r.remoteIP) {
+		// the observed address is the udp one, the tcp port may be mapped differently
+		for _, ep := range candidates {
+			if ep.Scope == ENDPOINT_SCOPE_REMOTE && transport != ENDPOINT_UDP && net.ParseIP(ep.IP).Equal(r.remoteIP) {
+				return r.remoteIP, ep.Port
+			}
+		}
+		return r.remoteIP, r.remotePort
+	}
+	for _, ep := range candidates {
+		if ip := net.ParseIP(ep.IP); ep.Scope == ENDPOINT_SCOPE_REMOTE && local.CanReach(ip) {
+			return ip, ep.Port
+		}
+	}
+	return r.remoteIP, r.remotePort
+}
@@ -5,11 +5,13 @@ import (
 	"crypto/ecdsa"
 	"encoding/hex"
 	"net"
+	"strconv"
+	"sync"
 
 	"github.com/symphonyprotocol/log"
 	"github.com/symphonyprotocol/nat"
-	"github.com/symphonyprotocol/nat/upnp"
 	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/events"
 	symen "github.com/symphonyprotocol/p2p/encrypt"
 	"github.com/symphonyprotocol/p2p/node/store"
 )
@@ -70,7 +72,7 @@ func (n *Node) GetRemotePort() int {
 }
 
 func (n *Node) GetNetwork() string {
-	return n.GetNetwork()
+	return n.network
 }
 
 type LocalNode struct {
@@ -78,11 +80,125 @@ type LocalNode struct {
 	privKey  *ecdsa.PrivateKey
 	isPublic bool
 	launchTime 	time.Time
+	localIPs	[]net.IP
+	tcpPort	int	// the port the tcp services listen on, localPort is the udp one
+
+	recordMux    sync.RWMutex
+	record       *NodeRecord
+	capabilities []string
+	relays       []string
+	remoteAddrs  map[string]*net.UDPAddr // proven reachable, by ip family
+	// proven tcp ports by external ip, tcp isn't advertised for ips missing here
+	remoteTCPPorts map[string]int
+	candidates     []*CandidateAddr
+	reachability   Reachability
+	events         *events.Bus
+}
+
+// Events is the bus the components of this node publish their lifecycle events on
+func (n *LocalNode) Events() *events.Bus {
+	return n.events
+}
+
+func (n *LocalNode) IsPublic() bool {
+	return n.isPublic
+}
+
+// GetTCPPort returns config.DEFAULT_TCP_PORT, GetLocalPort is the udp port
+func (n *LocalNode) GetTCPPort() int {
+	return n.tcpPort
+}
+
+// GetRemoteIP returns the most observed external ip, it changes as the candidates come in
+func (n *LocalNode) GetRemoteIP() net.IP {
+	n.recordMux.RLock()
+	defer n.recordMux.RUnlock()
+	return n.remoteIP
+}
+
+func (n *LocalNode) GetRemotePort() int {
+	n.recordMux.RLock()
+	defer n.recordMux.RUnlock()
+	return n.remotePort
 }
 
-func (n *LocalNode) SetRemoteIPPort(ip string, port int) {
-	n.remoteIP = net.ParseIP(ip)
-	n.remotePort = port
+// SetRelays advertises the relays which hold a reservation for us
+func (n *LocalNode) SetRelays(relays []string) {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	n.relays = append([]string{}, relays...)
+	n.updateRecord()
+}
+
+// GetRecord returns the latest signed record of the local node
+func (n *LocalNode) GetRecord() *NodeRecord {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	if n.record == nil {
+		n.updateRecord()
+	}
+	return n.record
+}
+
+// AddCapability advertises a capability tag in the node record
+func (n *LocalNode) AddCapability(capability string) {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	for _, c := range n.capabilities {
+		if c == capability {
+			return
+		}
+	}
+	n.capabilities = append(n.capabilities, capability)
+	n.updateRecord()
+}
+
+// UpdateRecord signs a new record with a higher sequence number, call it after the endpoints changed
+func (n *LocalNode) UpdateRecord() {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	n.updateRecord()
+}
+
+func (n *LocalNode) updateRecord() {
+	// millisecond timestamps keep the sequence increasing across restarts
+	seq := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if n.record != nil && seq <= n.record.Seq {
+		seq = n.record.Seq + 1
+	}
+	record := &NodeRecord{
+		Seq:          seq,
+		ID:           n.GetID(),
+		PublicKey:    n.GetPublicKey(),
+		NetworkID:    n.network,
+		Endpoints:    n.endpoints(),
+		Capabilities: append([]string{}, n.capabilities...),
+		Relays:       append([]string{}, n.relays...),
+	}
+	if err := record.Sign(n.privKey); err != nil {
+		nodeLogger.Error("failed to sign node record: %v", err)
+		return
+	}
+	n.record = record
+}
+
+func (n *LocalNode) endpoints() []Endpoint {
+	endpoints := make([]Endpoint, 0)
+	for _, ip := range n.localIPs {
+		endpoints = append(endpoints,
+			Endpoint{Transport: ENDPOINT_UDP, Scope: ENDPOINT_SCOPE_LOCAL, IP: ip.String(), Port: n.localPort},
+			Endpoint{Transport: ENDPOINT_TCP, Scope: ENDPOINT_SCOPE_LOCAL, IP: ip.String(), Port: n.tcpPort},
+		)
+	}
+	for _, family := range []string{FAMILY_IPV4, FAMILY_IPV6} {
+		if addr, ok := n.remoteAddrs[family]; ok {
+			endpoints = append(endpoints, Endpoint{Transport: ENDPOINT_UDP, Scope: ENDPOINT_SCOPE_REMOTE, IP: addr.IP.String(), Port: addr.Port})
+			if tcpPort, ok := n.remoteTCPPorts[addr.IP.String()]; ok {
+				endpoints = append(endpoints, Endpoint{Transport: ENDPOINT_TCP, Scope: ENDPOINT_SCOPE_REMOTE, IP: addr.IP.String(), Port: tcpPort})
+			}
+		}
+	}
+	return endpoints
 }
 
 func NewLocalNode() *LocalNode {
@@ -99,7 +215,11 @@ func NewLocalNode() *LocalNode {
 		pubKey := symen.ToPublicKey(pubKeyStr)
 		privKey = symen.ToPrivateKey(privKeyStr, pubKey)
 	}
-	localNode := &LocalNode{}
+	localNode := &LocalNode{
+		remoteAddrs:    make(map[string]*net.UDPAddr),
+		remoteTCPPorts: make(map[string]int),
+		events:         events.NewBus(),
+	}
 	localNode.Node.id = symen.PublicKeyToNodeId(privKey.PublicKey)
 	localNode.Node.network = config.DEFAULT_NET_WORK
 	nodeLogger.Info("setup local node: %v", localNode.GetID())
@@ -115,67 +235,32 @@ func NewLocalNode() *LocalNode {
 	}
 
 	ip := net.ParseIP(ipStr)
+	localNode.localIPs = collectLocalIPs(ip)
+	if ip.IsLoopback() && len(localNode.localIPs) > 0 {
+		// no ipv4 address, e.g. on an ipv6 only host
+		ip = localNode.localIPs[0]
+	}
+	if len(localNode.localIPs) == 0 {
+		localNode.localIPs = []net.IP{ip}
+	}
 	localNode.Node.localIP = ip
 	localNode.Node.localPort = config.DEFAULT_UDP_PORT
-	nodeLogger.Info("setup local node ip: %v:%v", localNode.localIP, localNode.localPort)
+	localNode.tcpPort = config.DEFAULT_TCP_PORT
+	nodeLogger.Info("setup local node ip: %v, all addresses: %v", net.JoinHostPort(localNode.localIP.String(), strconv.Itoa(localNode.localPort)), localNode.localIPs)
 	localNode.pubKey = privKey.PublicKey
 	nodeLogger.Info("setup local node pubkey: %v", pubKeyStr)
 	localNode.privKey = privKey
 	localNode.launchTime = time.Now()
 	return localNode
 }
-func (n *LocalNode) DiscoverNAT() {
-	client, err := upnp.NewUPnPClient()
-	if err != nil {
-		nodeLogger.Info("discover upnp error:%v", err)
+// ApplyPortMapping takes the external address mapped on the gateway as a candidate, tcpPort is 0 if tcp isn't mapped
+func (n *LocalNode) ApplyPortMapping(externalIP net.IP, udpPort int, tcpPort int) {
+	if nat.IsIntranet(externalIP.String()) {
+		// double NAT, the gateway's external address is private as well
+		nodeLogger.Info("external address %v of the gateway is not public", externalIP)
 		return
 	}
-	if ok := client.Discover(); ok {
-		// add mapping ports
-		mappingPort := 0
-		index := 0
-		dictPorts := make(map[int]int)
-		for {
-			_, ip, extPort, _ := upnp.GetGenericPortMappingEntry(index, client)
-			if extPort == 0 {
-				break
-			}
-			if ip == n.localIP.String() {
-				mappingPort = extPort
-			}
-			dictPorts[extPort] = 1
-			index++
-		}
-		if mappingPort == 0 {
-			mappingPort = config.DEFAULT_UDP_PORT
-			for {
-				if _, ok := dictPorts[mappingPort]; ok {
-					mappingPort++
-				} else {
-					break
-				}
-			}
-			if ok := upnp.AddPortMapping(n.localIP.String(), config.DEFAULT_UDP_PORT, mappingPort, "UDP", client); ok {
-				nodeLogger.Info("add port mapping for UDP from %v to %v", config.DEFAULT_UDP_PORT, mappingPort)
-			}
-			if ok := upnp.AddPortMapping(n.localIP.String(), config.DEFAULT_TCP_PORT, mappingPort, "TCP", client); ok {
-				nodeLogger.Info("add port mapping for TCP from %v to %v", config.DEFAULT_TCP_PORT, mappingPort)
-			}
-		}
-		// get external ip
-		externalIP, err := upnp.GetExternalIPAddress(client)
-		if err != nil {
-			nodeLogger.Info("upnp get external ip address error:%v", err)
-			n.isPublic = false
-		} else {
-			n.isPublic = !nat.IsIntranet(externalIP)
-			if n.isPublic {
-				extIP := net.ParseIP(externalIP)
-				n.remoteIP = extIP
-				n.remotePort = mappingPort
-			}
-		}
-	}
+	n.AddMappedAddr(externalIP, udpPort, tcpPort)
 }
 
 func (ln *LocalNode) GetPrivateKey() *ecdsa.PrivateKey {
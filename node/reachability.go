@@ -0,0 +1,162 @@
+package node
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/events"
+)
+
+type Reachability int
+
+const (
+	REACHABILITY_UNKNOWN Reachability = iota
+	REACHABILITY_PUBLIC
+	REACHABILITY_PRIVATE
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case REACHABILITY_PUBLIC:
+		return "public"
+	case REACHABILITY_PRIVATE:
+		return "private"
+	}
+	return "unknown"
+}
+
+var (
+	// observed addresses kept as candidates for the dial-back checks
+	MAX_CANDIDATE_ADDRS = 8
+	// the observer tag of addresses mapped on the gateway
+	OBSERVER_PORTMAP = "portmap"
+)
+
+// CandidateAddr is an address other nodes told us they see, not proven to be reachable yet
+type CandidateAddr struct {
+	IP        net.IP
+	Port      int
+	TCPPort   int // 0 if unknown, the udp port is tried then
+	Observers map[string]bool
+	LastSeen  time.Time
+}
+
+// AddObservedAddr counts an observer, e.g. a pong, for the address it saw us at
+func (n *LocalNode) AddObservedAddr(ip string, port int, observer string) {
+	n.addCandidate(net.ParseIP(ip), port, 0, observer)
+}
+
+// AddMappedAddr takes the external address mapped on the gateway, tcpPort is 0 if tcp isn't mapped
+func (n *LocalNode) AddMappedAddr(ip net.IP, udpPort int, tcpPort int) {
+	n.addCandidate(ip, udpPort, tcpPort, OBSERVER_PORTMAP)
+}
+
+func (n *LocalNode) addCandidate(ip net.IP, port int, tcpPort int, observer string) {
+	if ip == nil || port == 0 {
+		return
+	}
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	var candidate *CandidateAddr
+	for _, c := range n.candidates {
+		if c.IP.Equal(ip) && c.Port == port {
+			candidate = c
+		}
+	}
+	if candidate == nil {
+		candidate = &CandidateAddr{IP: ip, Port: port, Observers: make(map[string]bool)}
+		n.candidates = append(n.candidates, candidate)
+	}
+	candidate.Observers[observer] = true
+	candidate.LastSeen = time.Now()
+	if tcpPort != 0 {
+		candidate.TCPPort = tcpPort
+	}
+	sortCandidates(n.candidates)
+	if len(n.candidates) > MAX_CANDIDATE_ADDRS {
+		n.candidates = n.candidates[:MAX_CANDIDATE_ADDRS]
+	}
+	// what the others see, the record only carries proven addresses
+	n.remoteIP = n.candidates[0].IP
+	n.remotePort = n.candidates[0].Port
+}
+
+// the address seen by most observers first, the recent one on ties
+func sortCandidates(candidates []*CandidateAddr) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if len(candidates[i].Observers) != len(candidates[j].Observers) {
+			return len(candidates[i].Observers) > len(candidates[j].Observers)
+		}
+		return candidates[i].LastSeen.After(candidates[j].LastSeen)
+	})
+}
+
+// GetCandidateAddrs returns copies of the candidates, the most observed first
+func (n *LocalNode) GetCandidateAddrs() []CandidateAddr {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	res := make([]CandidateAddr, 0, len(n.candidates))
+	for _, c := range n.candidates {
+		observers := make(map[string]bool)
+		for o := range c.Observers {
+			observers[o] = true
+		}
+		res = append(res, CandidateAddr{IP: c.IP, Port: c.Port, TCPPort: c.TCPPort, Observers: observers, LastSeen: c.LastSeen})
+	}
+	return res
+}
+
+// ConfirmRemoteAddr advertises an address proven reachable by dial-backs, tcpPort is 0 if tcp isn't reachable
+func (n *LocalNode) ConfirmRemoteAddr(ip net.IP, udpPort int, tcpPort int) {
+	if ip == nil {
+		return
+	}
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	family := IPFamily(ip)
+	oldTCPPort, hadTCP := n.remoteTCPPorts[ip.String()]
+	if addr, ok := n.remoteAddrs[family]; ok && addr.IP.Equal(ip) && addr.Port == udpPort && hadTCP == (tcpPort != 0) && oldTCPPort == tcpPort {
+		return
+	}
+	n.remoteAddrs[family] = &net.UDPAddr{IP: ip, Port: udpPort}
+	if tcpPort != 0 {
+		n.remoteTCPPorts[ip.String()] = tcpPort
+	} else {
+		delete(n.remoteTCPPorts, ip.String())
+	}
+	n.updateRecord()
+	n.events.Publish(&events.AddressChanged{IP: ip, Port: udpPort, TCPPort: tcpPort})
+}
+
+// RevokeRemoteAddrs stops advertising the remote addresses, e.g. when the dial-backs fail
+func (n *LocalNode) RevokeRemoteAddrs() {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	if len(n.remoteAddrs) == 0 {
+		return
+	}
+	for _, addr := range n.remoteAddrs {
+		n.events.Publish(&events.AddressChanged{IP: addr.IP, Port: addr.Port, TCPPort: n.remoteTCPPorts[addr.IP.String()], Revoked: true})
+	}
+	n.remoteAddrs = make(map[string]*net.UDPAddr)
+	n.remoteTCPPorts = make(map[string]int)
+	n.updateRecord()
+}
+
+func (n *LocalNode) GetReachability() Reachability {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	return n.reachability
+}
+
+func (n *LocalNode) SetReachability(r Reachability) {
+	n.recordMux.Lock()
+	defer n.recordMux.Unlock()
+	previous := n.reachability
+	n.reachability = r
+	n.isPublic = r == REACHABILITY_PUBLIC
+	if previous != r {
+		n.events.Publish(&events.NATStatusChanged{Reachability: r.String(), Previous: previous.String()})
+	}
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/symphonyprotocol/p2p/config"
+	symen "github.com/symphonyprotocol/p2p/encrypt"
+)
+
+var (
+	ENDPOINT_UDP = "udp"
+	ENDPOINT_TCP = "tcp"
+
+	// the address inside the node's own network
+	ENDPOINT_SCOPE_LOCAL = "local"
+	// the address seen from the internet
+	ENDPOINT_SCOPE_REMOTE = "remote"
+)
+
+type Endpoint struct {
+	Transport string
+	Scope     string
+	IP        string
+	Port      int
+}
+
+// NodeRecord is signed by the node it describes, so it can be relayed by other peers without being forged.
+// A record with a higher Seq replaces the older one.
+type NodeRecord struct {
+	Seq          uint64
+	ID           string
+	PublicKey    string
+	NetworkID    string
+	Endpoints    []Endpoint
+	Capabilities []string
+	// relays holding a reservation for the node when it can't be dialed directly
+	Relays    []string `json:",omitempty"`
+	Signature string
+}
+
+func (r *NodeRecord) signingHash() []byte {
+	unsigned := *r
+	unsigned.Signature = ""
+	data, _ := json.Marshal(unsigned)
+	return symen.ToSha256(data)
+}
+
+func (r *NodeRecord) Sign(privKey *ecdsa.PrivateKey) error {
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, privKey, r.signingHash())
+	if err != nil {
+		return err
+	}
+	sig := make([]byte, 64)
+	sigR.FillBytes(sig[:32])
+	sigS.FillBytes(sig[32:])
+	r.Signature = hex.EncodeToString(sig)
+	return nil
+}
+
+// Verify checks the signature and that the id belongs to the public key
+func (r *NodeRecord) Verify() error {
+	pubBytes, err := hex.DecodeString(r.PublicKey)
+	if err != nil || len(pubBytes) == 0 {
+		return fmt.Errorf("invalid public key in record of %v", r.ID)
+	}
+	pubKey := symen.ToPublicKey(r.PublicKey)
+	if pubKey.X == nil || pubKey.Y == nil {
+		return fmt.Errorf("invalid public key in record of %v", r.ID)
+	}
+	if hex.EncodeToString(symen.PublicKeyToNodeId(pubKey)) != r.ID {
+		return fmt.Errorf("public key does not match node id %v", r.ID)
+	}
+	sig, err := hex.DecodeString(r.Signature)
+	if err != nil || len(sig) != 64 {
+		return fmt.Errorf("invalid signature in record of %v", r.ID)
+	}
+	sigR := new(big.Int).SetBytes(sig[:32])
+	sigS := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&pubKey, r.signingHash(), sigR, sigS) {
+		return fmt.Errorf("bad signature in record of %v", r.ID)
+	}
+	return nil
+}
+
+func (r *NodeRecord) GetEndpoint(transport string, scope string) (Endpoint, bool) {
+	for _, ep := range r.Endpoints {
+		if ep.Transport == transport && ep.Scope == scope {
+			return ep, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+func (r *NodeRecord) HasCapability(capability string) bool {
+	for _, c := range r.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRecord verifies the record and checks it belongs to our network
+func ValidateRecord(r *NodeRecord) error {
+	if r == nil {
+		return fmt.Errorf("no record")
+	}
+	if r.NetworkID != config.DEFAULT_NET_WORK {
+		return fmt.Errorf("record of %v is from network %v", r.ID, r.NetworkID)
+	}
+	return r.Verify()
+}
+
+func (r *NodeRecord) hasLocalEndpoint(ip net.IP, port int) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ep := range r.Endpoints {
+		if ep.Transport == ENDPOINT_UDP && ep.Scope == ENDPOINT_SCOPE_LOCAL && ep.Port == port && ip.Equal(net.ParseIP(ep.IP)) {
+			return true
+		}
+	}
+	return false
+}
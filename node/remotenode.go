@@ -4,6 +4,7 @@ import (
 	//"crypto/ecdsa"
 
 	"net"
+	"encoding/hex"
 	"time"
 
 	symen "github.com/symphonyprotocol/p2p/encrypt"
@@ -14,6 +15,8 @@ type RemoteNode struct {
 	Distance int
 	Latency int
 	LastActiveTime	time.Time
+	IntroducedBy	string	// the node which forwarded us this node, a candidate rendezvous
+	record	*NodeRecord
 }
 
 func (r *RemoteNode) RefreshNode(localIP string, localPort int, remoteIP string, remotePort int, latency int) {
@@ -31,12 +34,42 @@ func (r *RemoteNode) SetPublicKey(keyStr string) {
 	r.pubKey = symen.ToPublicKey(keyStr)
 }
 
-func (r *RemoteNode) GetSendIPWithPort(local *LocalNode) (net.IP, int) {
-	//remote and local are behind same NAT
-	if r.remoteIP.String() == local.remoteIP.String() {
-		return r.localIP, r.localPort
+func (r *RemoteNode) GetRecord() *NodeRecord {
+	return r.record
+}
+
+// ApplyRecord takes the endpoints from a signed record, only valid records newer than the current one are accepted
+func (r *RemoteNode) ApplyRecord(record *NodeRecord) bool {
+	if record.ID != r.GetID() {
+		return false
+	}
+	if r.record != nil && record.Seq <= r.record.Seq {
+		return false
+	}
+	if err := ValidateRecord(record); err != nil {
+		nodeLogger.Warn("drop record: %v", err)
+		return false
+	}
+	r.record = record
+	r.pubKey = symen.ToPublicKey(record.PublicKey)
+	r.network = record.NetworkID
+	// keep the local address we know it at, e.g. found on the lan, while the record still has it
+	if ep, ok := record.GetEndpoint(ENDPOINT_UDP, ENDPOINT_SCOPE_LOCAL); ok && !record.hasLocalEndpoint(r.localIP, r.localPort) {
+		r.localIP = net.ParseIP(ep.IP)
+		r.localPort = ep.Port
 	}
-	return r.remoteIP, r.remotePort
+	if ep, ok := record.GetEndpoint(ENDPOINT_UDP, ENDPOINT_SCOPE_REMOTE); ok {
+		r.remoteIP = net.ParseIP(ep.IP)
+		r.remotePort = ep.Port
+	} else if r.remoteIP == nil {
+		r.remoteIP = r.localIP
+		r.remotePort = r.localPort
+	}
+	return true
+}
+
+func (r *RemoteNode) GetSendIPWithPort(local *LocalNode) (net.IP, int) {
+	return r.GetSendEndpoint(local, ENDPOINT_UDP)
 }
 
 func NewRemoteNode(id []byte, localIP net.IP, localPort int, remoteIP net.IP, remotePort int) *RemoteNode {
@@ -50,3 +83,39 @@ func NewRemoteNode(id []byte, localIP net.IP, localPort int, remoteIP net.IP, re
 	remote.Latency = -1
 	return remote
 }
+
+// NewLANRemoteNode is a node found on the local network at ip:port. It shares our remote address,
+// so GetSendEndpoint takes the same-NAT path and talks to it on the lan. Returns nil if the record is not valid.
+func NewLANRemoteNode(record *NodeRecord, ip net.IP, port int, local *LocalNode) *RemoteNode {
+	id, err := hex.DecodeString(record.ID)
+	if err != nil {
+		return nil
+	}
+	remote := NewRemoteNode(id, ip, port, nil, 0)
+	if !remote.ApplyRecord(record) {
+		return nil
+	}
+	remote.localIP = ip
+	remote.localPort = port
+	if remoteIP := local.GetRemoteIP(); remoteIP != nil {
+		remote.remoteIP = remoteIP
+		remote.remotePort = port
+	} else {
+		remote.remoteIP = ip
+		remote.remotePort = port
+	}
+	return remote
+}
+
+// NewRemoteNodeFromRecord returns nil if the record is not valid
+func NewRemoteNodeFromRecord(record *NodeRecord) *RemoteNode {
+	id, err := hex.DecodeString(record.ID)
+	if err != nil {
+		return nil
+	}
+	remote := NewRemoteNode(id, nil, 0, nil, 0)
+	if !remote.ApplyRecord(record) {
+		return nil
+	}
+	return remote
+}
@@ -0,0 +1,73 @@
+package portmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+// the port NAT-PMP and PCP servers listen on
+var GATEWAY_PORT = 5351
+
+// GatewayAddr returns config.NAT_GATEWAY if set, otherwise the default gateway of the system
+func GatewayAddr(localIP net.IP) *net.UDPAddr {
+	if config.NAT_GATEWAY != "" {
+		host, portStr, err := net.SplitHostPort(config.NAT_GATEWAY)
+		if err != nil {
+			host, portStr = config.NAT_GATEWAY, strconv.Itoa(GATEWAY_PORT)
+		}
+		port, _ := strconv.Atoi(portStr)
+		if ip := net.ParseIP(host); ip != nil {
+			return &net.UDPAddr{IP: ip, Port: port}
+		}
+		pmLogger.Warn("invalid gateway %v", config.NAT_GATEWAY)
+	}
+	gateway, err := DefaultGateway()
+	if err != nil {
+		gateway = guessGateway(localIP)
+		pmLogger.Debug("%v, guess the gateway is %v", err, gateway)
+	}
+	return &net.UDPAddr{IP: gateway, Port: GATEWAY_PORT}
+}
+
+// DefaultGateway reads the ipv4 default route, only available on linux
+func DefaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// the route table is in host byte order
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no default route")
+}
+
+// most home routers take the first address of the subnet
+func guessGateway(localIP net.IP) net.IP {
+	ip4 := localIP.To4()
+	if ip4 == nil {
+		return net.IPv4(192, 168, 1, 1)
+	}
+	return net.IPv4(ip4[0], ip4[1], ip4[2], 1)
+}
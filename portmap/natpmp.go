@@ -0,0 +1,124 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// the request is resent with a doubled timeout, RFC 6886 section 3.1
+	NATPMP_INITIAL_TIMEOUT = 250 * time.Millisecond
+	NATPMP_RETRIES         = 4
+)
+
+const (
+	natpmpVersion        = 0
+	natpmpOpExternalAddr = 0
+	natpmpOpMapUDP       = 1
+	natpmpOpMapTCP       = 2
+)
+
+// NATPMP speaks NAT-PMP (RFC 6886) with the gateway
+type NATPMP struct {
+	gateway *net.UDPAddr
+}
+
+func NewNATPMP(gateway *net.UDPAddr) *NATPMP {
+	return &NATPMP{gateway: gateway}
+}
+
+func (p *NATPMP) Name() string { return "NAT-PMP" }
+
+func (p *NATPMP) Probe() error {
+	_, err := p.ExternalIP()
+	return err
+}
+
+func (p *NATPMP) ExternalIP() (net.IP, error) {
+	resp, err := p.request([]byte{natpmpVersion, natpmpOpExternalAddr}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (p *NATPMP) AddMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	resp, err := p.mapPort(protocol, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := p.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: int(binary.BigEndian.Uint16(resp[8:10])),
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:12])),
+		ExternalIP:   ip,
+		Lifetime:     granted,
+		Expires:      time.Now().Add(granted),
+	}, nil
+}
+
+// a zero lifetime deletes the mapping
+func (p *NATPMP) DeleteMapping(m *Mapping) error {
+	_, err := p.mapPort(m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
+
+func (p *NATPMP) mapPort(protocol string, internalPort int, externalPort int, lifetime time.Duration) ([]byte, error) {
+	op := byte(natpmpOpMapUDP)
+	if protocol == PROTOCOL_TCP {
+		op = natpmpOpMapTCP
+	}
+	msg := make([]byte, 12)
+	msg[0] = natpmpVersion
+	msg[1] = op
+	binary.BigEndian.PutUint16(msg[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(msg[8:12], uint32(lifetime/time.Second))
+	return p.request(msg, 16)
+}
+
+func (p *NATPMP) request(msg []byte, respLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, p.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := NATPMP_INITIAL_TIMEOUT
+	buf := make([]byte, 64)
+	for i := 0; i < NATPMP_RETRIES; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if n < 4 || buf[1] != msg[1]|0x80 {
+			continue
+		}
+		if buf[0] != natpmpVersion {
+			return nil, fmt.Errorf("nat-pmp unsupported, gateway answered version %d", buf[0])
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("nat-pmp result code %d", code)
+		}
+		if n < respLen {
+			return nil, fmt.Errorf("nat-pmp response too short: %d bytes", n)
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("nat-pmp gateway %v did not respond", p.gateway)
+}
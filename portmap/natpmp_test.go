@@ -0,0 +1,298 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testExternalIP = net.IPv4(203, 0, 113, 7).To4()
+
+// natpmpGateway is a NAT-PMP server on the loopback. It hands out the suggested port when it is free,
+// the next free one otherwise, and caps the leases at lifetime
+type natpmpGateway struct {
+	conn     *net.UDPConn
+	lifetime time.Duration
+
+	mux sync.Mutex
+	// "UDP/32768" -> the internal port mapped on it
+	ports map[string]int
+	// "UDP/32768" of the internal port -> the external port
+	mappings map[string]int
+	requests map[byte]int
+	// answered to every request when not 0
+	resultCode uint16
+}
+
+func newNATPMPGateway(t *testing.T, lifetime time.Duration) *natpmpGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &natpmpGateway{
+		conn:     conn,
+		lifetime: lifetime,
+		ports:    make(map[string]int),
+		mappings: make(map[string]int),
+		requests: make(map[byte]int),
+	}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g
+}
+
+func (g *natpmpGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// give port to another client
+func (g *natpmpGateway) setPort(protocol string, port int, internalPort int) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.ports[fmt.Sprintf("%v/%v", protocol, port)] = internalPort
+}
+
+// answer every request with code
+func (g *natpmpGateway) setResultCode(code uint16) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.resultCode = code
+}
+
+func (g *natpmpGateway) getMapping(protocol string, internalPort int) (int, bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	port, ok := g.mappings[fmt.Sprintf("%v/%v", protocol, internalPort)]
+	return port, ok
+}
+
+// drop the mapping without telling the client, as a reboot does
+func (g *natpmpGateway) forget(protocol string, internalPort int) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	key := fmt.Sprintf("%v/%v", protocol, internalPort)
+	delete(g.ports, fmt.Sprintf("%v/%v", protocol, g.mappings[key]))
+	delete(g.mappings, key)
+}
+
+func (g *natpmpGateway) count(op byte) int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.requests[op]
+}
+
+func (g *natpmpGateway) serve() {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 {
+			continue
+		}
+		if resp := g.handle(buf[:n]); resp != nil {
+			g.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (g *natpmpGateway) handle(req []byte) []byte {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	op := req[1]
+	g.requests[op]++
+	resp := make([]byte, 16)
+	resp[0] = natpmpVersion
+	resp[1] = op | 0x80
+	binary.BigEndian.PutUint16(resp[2:4], g.resultCode)
+	binary.BigEndian.PutUint32(resp[4:8], 1)
+	if g.resultCode != 0 {
+		return resp[:8]
+	}
+	if op == natpmpOpExternalAddr {
+		copy(resp[8:12], testExternalIP)
+		return resp[:12]
+	}
+	if len(req) < 12 {
+		return nil
+	}
+	protocol := PROTOCOL_UDP
+	if op == natpmpOpMapTCP {
+		protocol = PROTOCOL_TCP
+	}
+	internalPort := int(binary.BigEndian.Uint16(req[4:6]))
+	suggested := int(binary.BigEndian.Uint16(req[6:8]))
+	lifetime := time.Duration(binary.BigEndian.Uint32(req[8:12])) * time.Second
+	key := fmt.Sprintf("%v/%v", protocol, internalPort)
+	binary.BigEndian.PutUint16(resp[8:10], uint16(internalPort))
+
+	if lifetime == 0 {
+		if port, ok := g.mappings[key]; ok {
+			delete(g.ports, fmt.Sprintf("%v/%v", protocol, port))
+			delete(g.mappings, key)
+		}
+		return resp
+	}
+	port, ok := g.mappings[key]
+	if !ok {
+		port = suggested
+		for g.ports[fmt.Sprintf("%v/%v", protocol, port)] != 0 {
+			port++
+		}
+		g.ports[fmt.Sprintf("%v/%v", protocol, port)] = internalPort
+		g.mappings[key] = port
+	}
+	if lifetime > g.lifetime {
+		lifetime = g.lifetime
+	}
+	binary.BigEndian.PutUint16(resp[10:12], uint16(port))
+	binary.BigEndian.PutUint32(resp[12:16], uint32(lifetime/time.Second))
+	return resp
+}
+
+func TestNATPMPMapping(t *testing.T) {
+	gateway := newNATPMPGateway(t, time.Hour)
+	p := NewNATPMP(gateway.addr())
+	if err := p.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := p.AddMapping(PROTOCOL_UDP, 32768, 32768, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalPort != 32768 || mapping.InternalPort != 32768 || !mapping.ExternalIP.Equal(testExternalIP) {
+		t.Errorf("unexpected mapping %v", mapping)
+	}
+	if mapping.Lifetime != time.Hour {
+		t.Errorf("the lease should be capped by the gateway, got %v", mapping.Lifetime)
+	}
+	tcp, err := p.AddMapping(PROTOCOL_TCP, 32768, 32768, time.Hour)
+	if err != nil || tcp.ExternalPort != 32768 {
+		t.Errorf("tcp is mapped separately: %v %v", tcp, err)
+	}
+}
+
+func TestNATPMPConflict(t *testing.T) {
+	gateway := newNATPMPGateway(t, time.Hour)
+	gateway.setPort(PROTOCOL_UDP, 32768, 40000)
+	m := NewNATManager(NewNATPMP(gateway.addr()))
+	if !m.Discover() {
+		t.Fatal("nat-pmp not discovered")
+	}
+	mapping, err := m.AddMapping(PROTOCOL_UDP, 32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalPort == 32768 {
+		t.Fatalf("got the port of another client")
+	}
+	if port := m.GetMapping(PROTOCOL_UDP, 32768); port != mapping.ExternalPort {
+		t.Errorf("manager reports %v, gateway assigned %v", port, mapping.ExternalPort)
+	}
+}
+
+func TestNATPMPRenewal(t *testing.T) {
+	gateway := newNATPMPGateway(t, 2*time.Second)
+	m := NewNATManager(NewNATPMP(gateway.addr()))
+	m.Discover()
+	changes := make(chan []Mapping, 4)
+	m.OnExternalAddressChanged(func(ip net.IP, mappings []Mapping) { changes <- mappings })
+	first, err := m.AddMapping(PROTOCOL_UDP, 32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-changes
+	// first is renewed in place
+	port, expires := first.ExternalPort, first.Expires
+
+	// not due before half of the lease is gone
+	m.renew()
+	if n := gateway.count(natpmpOpMapUDP); n != 1 {
+		t.Fatalf("renewed too early, %v map requests", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	m.renew()
+	if n := gateway.count(natpmpOpMapUDP); n != 2 {
+		t.Fatalf("not renewed, %v map requests", n)
+	}
+	renewed := m.GetMappings()[0]
+	if renewed.ExternalPort != port || !renewed.Expires.After(expires) {
+		t.Errorf("renewal should extend the same port: %v expires %v, was %v", renewed, renewed.Expires, expires)
+	}
+	select {
+	case <-changes:
+		t.Errorf("a renewal on the same port is not a change")
+	default:
+	}
+
+	// the gateway rebooted and gave the port away, the renewal moves the mapping and reports it
+	time.Sleep(1100 * time.Millisecond)
+	gateway.forget(PROTOCOL_UDP, 32768)
+	gateway.setPort(PROTOCOL_UDP, port, 40000)
+	m.renew()
+	select {
+	case mappings := <-changes:
+		if len(mappings) != 1 || mappings[0].ExternalPort == port {
+			t.Errorf("moved mapping not reported: %v", mappings)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the moved mapping was not reported")
+	}
+	if moved, _ := gateway.getMapping(PROTOCOL_UDP, 32768); moved != m.GetMapping(PROTOCOL_UDP, 32768) {
+		t.Errorf("manager reports %v, gateway has %v", m.GetMapping(PROTOCOL_UDP, 32768), moved)
+	}
+}
+
+func TestNATPMPDelete(t *testing.T) {
+	gateway := newNATPMPGateway(t, time.Hour)
+	m := NewNATManager(NewNATPMP(gateway.addr()))
+	m.Discover()
+	if _, err := m.AddMapping(PROTOCOL_UDP, 32768); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddMapping(PROTOCOL_TCP, 32768); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if _, ok := gateway.getMapping(PROTOCOL_UDP, 32768); ok {
+		t.Errorf("udp mapping left on the gateway")
+	}
+	if _, ok := gateway.getMapping(PROTOCOL_TCP, 32768); ok {
+		t.Errorf("tcp mapping left on the gateway")
+	}
+	if len(m.GetMappings()) != 0 {
+		t.Errorf("mappings left in the manager: %v", m.GetMappings())
+	}
+	// a mapping finished after the close is deleted right away
+	if _, err := m.AddMapping(PROTOCOL_UDP, 32769); err == nil {
+		t.Errorf("mapped after the close")
+	}
+	if _, ok := gateway.getMapping(PROTOCOL_UDP, 32769); ok {
+		t.Errorf("mapping made after the close left on the gateway")
+	}
+}
+
+func TestNATPMPErrors(t *testing.T) {
+	gateway := newNATPMPGateway(t, time.Hour)
+	gateway.setResultCode(2) // not authorized
+	p := NewNATPMP(gateway.addr())
+	if _, err := p.AddMapping(PROTOCOL_UDP, 32768, 32768, time.Hour); err == nil {
+		t.Errorf("the result code is ignored")
+	}
+
+	timeout := NATPMP_INITIAL_TIMEOUT
+	NATPMP_INITIAL_TIMEOUT = 10 * time.Millisecond
+	defer func() { NATPMP_INITIAL_TIMEOUT = timeout }()
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if err := NewNATPMP(silent.LocalAddr().(*net.UDPAddr)).Probe(); err == nil {
+		t.Errorf("probe of a silent gateway succeeded")
+	}
+}
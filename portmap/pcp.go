@@ -0,0 +1,168 @@
+package portmap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcpVersion    = 2
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+// PCP speaks the Port Control Protocol (RFC 6887) with the gateway
+type PCP struct {
+	gateway *net.UDPAddr
+
+	mux        sync.Mutex
+	nonces     map[string][]byte // renewals and deletions must reuse the nonce of the mapping
+	externalIP net.IP
+}
+
+func NewPCP(gateway *net.UDPAddr) *PCP {
+	return &PCP{
+		gateway: gateway,
+		nonces:  make(map[string][]byte),
+	}
+}
+
+func (p *PCP) Name() string { return "PCP" }
+
+// an ANNOUNCE request only checks that the server is there
+func (p *PCP) Probe() error {
+	_, err := p.request(pcpOpAnnounce, 0, nil)
+	return err
+}
+
+// PCP has no request for the external address, it is known after the first mapping
+func (p *PCP) ExternalIP() (net.IP, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.externalIP == nil {
+		return nil, fmt.Errorf("pcp external address unknown before the first mapping")
+	}
+	return p.externalIP, nil
+}
+
+func (p *PCP) AddMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	resp, err := p.request(pcpOpMap, lifetime, p.mapOpcode(protocol, internalPort, externalPort))
+	if err != nil {
+		return nil, err
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	body := resp[pcpHeaderLen:]
+	ip := net.IP(append([]byte{}, body[20:36]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p.mux.Lock()
+	p.externalIP = ip
+	p.mux.Unlock()
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: int(binary.BigEndian.Uint16(body[16:18])),
+		ExternalPort: int(binary.BigEndian.Uint16(body[18:20])),
+		ExternalIP:   ip,
+		Lifetime:     granted,
+		Expires:      time.Now().Add(granted),
+	}, nil
+}
+
+// a MAP request with zero lifetime deletes the mapping
+func (p *PCP) DeleteMapping(m *Mapping) error {
+	_, err := p.request(pcpOpMap, 0, p.mapOpcode(m.Protocol, m.InternalPort, 0))
+	if err == nil {
+		p.mux.Lock()
+		delete(p.nonces, fmt.Sprintf("%v/%v", m.Protocol, m.InternalPort))
+		p.mux.Unlock()
+	}
+	return err
+}
+
+// nonce(12) protocol(1) reserved(3) internal port(2) external port(2) external ip(16)
+func (p *PCP) mapOpcode(protocol string, internalPort int, externalPort int) []byte {
+	key := fmt.Sprintf("%v/%v", protocol, internalPort)
+	p.mux.Lock()
+	nonce, ok := p.nonces[key]
+	if !ok {
+		nonce = make([]byte, 12)
+		rand.Read(nonce)
+		p.nonces[key] = nonce
+	}
+	p.mux.Unlock()
+
+	body := make([]byte, pcpMapLen)
+	copy(body[0:12], nonce)
+	body[12] = 17
+	if protocol == PROTOCOL_TCP {
+		body[12] = 6
+	}
+	binary.BigEndian.PutUint16(body[16:18], uint16(internalPort))
+	binary.BigEndian.PutUint16(body[18:20], uint16(externalPort))
+	// any ipv4 address, ::ffff:0.0.0.0
+	copy(body[20:36], net.IPv4zero.To16())
+	return body
+}
+
+func (p *PCP) request(op byte, lifetime time.Duration, opcode []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, p.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the client address must be the one the gateway sees the request from
+	clientIP := conn.LocalAddr().(*net.UDPAddr).IP
+	msg := make([]byte, pcpHeaderLen, pcpHeaderLen+len(opcode))
+	msg[0] = pcpVersion
+	msg[1] = op
+	binary.BigEndian.PutUint32(msg[4:8], uint32(lifetime/time.Second))
+	copy(msg[8:24], clientIP.To16())
+	msg = append(msg, opcode...)
+
+	timeout := NATPMP_INITIAL_TIMEOUT
+	buf := make([]byte, 1100)
+	for i := 0; i < NATPMP_RETRIES; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if n < 4 {
+			continue
+		}
+		if buf[0] != pcpVersion {
+			return nil, fmt.Errorf("pcp unsupported, gateway answered version %d", buf[0])
+		}
+		if buf[1] != op|0x80 {
+			continue
+		}
+		if code := buf[3]; code != 0 {
+			return nil, fmt.Errorf("pcp result code %d", code)
+		}
+		if n < pcpHeaderLen+len(opcode) {
+			return nil, fmt.Errorf("pcp response too short: %d bytes", n)
+		}
+		// a response to another request of the same client
+		if len(opcode) > 0 && string(buf[pcpHeaderLen:pcpHeaderLen+12]) != string(opcode[:12]) {
+			continue
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("pcp gateway %v did not respond", p.gateway)
+}
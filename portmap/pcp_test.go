@@ -0,0 +1,295 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	pcpResultNotAuthorized   = 2
+	pcpResultNoResources     = 8
+	pcpResultAddressMismatch = 12
+)
+
+type pcpLease struct {
+	nonce        string
+	externalPort int
+}
+
+// pcpGateway is a PCP server on the loopback. Like natpmpGateway it hands out the suggested port when
+// it is free and caps the leases at lifetime, and it rejects a request for a mapping made with another nonce
+type pcpGateway struct {
+	conn     *net.UDPConn
+	lifetime time.Duration
+
+	mux sync.Mutex
+	// "UDP/32768" -> the internal port mapped on it
+	ports map[string]int
+	// "UDP/32768" of the internal port -> the lease
+	leases   map[string]pcpLease
+	requests map[byte]int
+	// answered to every request when not 0
+	resultCode byte
+}
+
+func newPCPGateway(t *testing.T, lifetime time.Duration) *pcpGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &pcpGateway{
+		conn:     conn,
+		lifetime: lifetime,
+		ports:    make(map[string]int),
+		leases:   make(map[string]pcpLease),
+		requests: make(map[byte]int),
+	}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+	return g
+}
+
+func (g *pcpGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// give port to another client
+func (g *pcpGateway) setPort(protocol string, port int, internalPort int) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.ports[fmt.Sprintf("%v/%v", protocol, port)] = internalPort
+}
+
+// answer every request with code
+func (g *pcpGateway) setResultCode(code byte) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	g.resultCode = code
+}
+
+func (g *pcpGateway) getMapping(protocol string, internalPort int) (int, bool) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	lease, ok := g.leases[fmt.Sprintf("%v/%v", protocol, internalPort)]
+	return lease.externalPort, ok
+}
+
+func (g *pcpGateway) count(op byte) int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.requests[op]
+}
+
+func (g *pcpGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < pcpHeaderLen {
+			continue
+		}
+		if resp := g.handle(buf[:n], from); resp != nil {
+			g.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (g *pcpGateway) handle(req []byte, from *net.UDPAddr) []byte {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	op := req[1]
+	g.requests[op]++
+	resp := make([]byte, len(req))
+	resp[0] = pcpVersion
+	resp[1] = op | 0x80
+	binary.BigEndian.PutUint32(resp[8:12], 1)
+	// the opcode body is echoed, with the assigned port and address filled in below
+	copy(resp[pcpHeaderLen:], req[pcpHeaderLen:])
+	fail := func(code byte) []byte {
+		resp[3] = code
+		return resp
+	}
+	if g.resultCode != 0 {
+		return fail(g.resultCode)
+	}
+	if !net.IP(req[8:24]).Equal(from.IP) {
+		return fail(pcpResultAddressMismatch)
+	}
+	if op == pcpOpAnnounce {
+		return resp
+	}
+	if len(req) < pcpHeaderLen+pcpMapLen {
+		return nil
+	}
+	body := req[pcpHeaderLen:]
+	protocol := PROTOCOL_UDP
+	if body[12] == 6 {
+		protocol = PROTOCOL_TCP
+	}
+	nonce := string(body[0:12])
+	internalPort := int(binary.BigEndian.Uint16(body[16:18]))
+	suggested := int(binary.BigEndian.Uint16(body[18:20]))
+	lifetime := time.Duration(binary.BigEndian.Uint32(req[4:8])) * time.Second
+	key := fmt.Sprintf("%v/%v", protocol, internalPort)
+
+	lease, ok := g.leases[key]
+	if ok && lease.nonce != nonce {
+		return fail(pcpResultNotAuthorized)
+	}
+	if lifetime == 0 {
+		if ok {
+			delete(g.ports, fmt.Sprintf("%v/%v", protocol, lease.externalPort))
+			delete(g.leases, key)
+		}
+		return resp
+	}
+	if !ok {
+		port := suggested
+		for g.ports[fmt.Sprintf("%v/%v", protocol, port)] != 0 {
+			port++
+		}
+		g.ports[fmt.Sprintf("%v/%v", protocol, port)] = internalPort
+		lease = pcpLease{nonce: nonce, externalPort: port}
+		g.leases[key] = lease
+	}
+	if lifetime > g.lifetime {
+		lifetime = g.lifetime
+	}
+	binary.BigEndian.PutUint32(resp[4:8], uint32(lifetime/time.Second))
+	binary.BigEndian.PutUint16(resp[pcpHeaderLen+18:pcpHeaderLen+20], uint16(lease.externalPort))
+	copy(resp[pcpHeaderLen+20:pcpHeaderLen+36], testExternalIP.To16())
+	return resp
+}
+
+func TestPCPMapping(t *testing.T) {
+	gateway := newPCPGateway(t, time.Hour)
+	p := NewPCP(gateway.addr())
+	if err := p.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ExternalIP(); err == nil {
+		t.Errorf("the external address is known before the first mapping")
+	}
+	mapping, err := p.AddMapping(PROTOCOL_UDP, 32768, 32768, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalPort != 32768 || mapping.InternalPort != 32768 || !mapping.ExternalIP.Equal(testExternalIP) {
+		t.Errorf("unexpected mapping %v", mapping)
+	}
+	if mapping.Lifetime != time.Hour {
+		t.Errorf("the lease should be capped by the gateway, got %v", mapping.Lifetime)
+	}
+	if ip, err := p.ExternalIP(); err != nil || !ip.Equal(testExternalIP) {
+		t.Errorf("external address after the mapping: %v %v", ip, err)
+	}
+	tcp, err := p.AddMapping(PROTOCOL_TCP, 32768, 32768, time.Hour)
+	if err != nil || tcp.ExternalPort != 32768 {
+		t.Errorf("tcp is mapped separately: %v %v", tcp, err)
+	}
+}
+
+func TestPCPConflict(t *testing.T) {
+	gateway := newPCPGateway(t, time.Hour)
+	gateway.setPort(PROTOCOL_UDP, 32768, 40000)
+	m := NewNATManager(NewPCP(gateway.addr()))
+	if !m.Discover() {
+		t.Fatal("pcp not discovered")
+	}
+	mapping, err := m.AddMapping(PROTOCOL_UDP, 32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.ExternalPort == 32768 {
+		t.Fatalf("got the port of another client")
+	}
+	if port := m.GetMapping(PROTOCOL_UDP, 32768); port != mapping.ExternalPort {
+		t.Errorf("manager reports %v, gateway assigned %v", port, mapping.ExternalPort)
+	}
+
+	// another client holding the nonce of a mapping
+	other := NewPCP(gateway.addr())
+	if _, err := other.AddMapping(PROTOCOL_UDP, 32768, 32768, time.Hour); err == nil {
+		t.Errorf("mapped with another nonce")
+	}
+}
+
+func TestPCPRenewal(t *testing.T) {
+	gateway := newPCPGateway(t, 2*time.Second)
+	m := NewNATManager(NewPCP(gateway.addr()))
+	m.Discover()
+	changes := make(chan []Mapping, 4)
+	m.OnExternalAddressChanged(func(ip net.IP, mappings []Mapping) { changes <- mappings })
+	first, err := m.AddMapping(PROTOCOL_UDP, 32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-changes
+	port, expires := first.ExternalPort, first.Expires
+
+	m.renew()
+	if n := gateway.count(pcpOpMap); n != 1 {
+		t.Fatalf("renewed too early, %v map requests", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	// the gateway only renews a lease for the nonce it was made with
+	m.renew()
+	if n := gateway.count(pcpOpMap); n != 2 {
+		t.Fatalf("not renewed, %v map requests", n)
+	}
+	renewed := m.GetMappings()[0]
+	if renewed.ExternalPort != port || !renewed.Expires.After(expires) {
+		t.Errorf("renewal should extend the same port: %v expires %v, was %v", renewed, renewed.Expires, expires)
+	}
+	select {
+	case <-changes:
+		t.Errorf("a renewal on the same port is not a change")
+	default:
+	}
+}
+
+func TestPCPDelete(t *testing.T) {
+	gateway := newPCPGateway(t, time.Hour)
+	m := NewNATManager(NewPCP(gateway.addr()))
+	m.Discover()
+	if _, err := m.AddMapping(PROTOCOL_UDP, 32768); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddMapping(PROTOCOL_TCP, 32768); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if _, ok := gateway.getMapping(PROTOCOL_UDP, 32768); ok {
+		t.Errorf("udp mapping left on the gateway")
+	}
+	if _, ok := gateway.getMapping(PROTOCOL_TCP, 32768); ok {
+		t.Errorf("tcp mapping left on the gateway")
+	}
+
+	// the nonce is dropped with the mapping, a new one maps the port again
+	p := NewPCP(gateway.addr())
+	mapping, err := p.AddMapping(PROTOCOL_UDP, 32768, 32768, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteMapping(mapping); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddMapping(PROTOCOL_UDP, 32768, 32768, time.Hour); err != nil {
+		t.Errorf("map after delete: %v", err)
+	}
+}
+
+func TestPCPErrors(t *testing.T) {
+	gateway := newPCPGateway(t, time.Hour)
+	gateway.setResultCode(pcpResultNoResources)
+	if _, err := NewPCP(gateway.addr()).AddMapping(PROTOCOL_UDP, 32768, 32768, time.Hour); err == nil {
+		t.Errorf("the result code is ignored")
+	}
+}
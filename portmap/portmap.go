@@ -0,0 +1,285 @@
+package portmap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/config"
+)
+
+var pmLogger = log.GetLogger("portmap")
+
+var (
+	PROTOCOL_UDP = "UDP"
+	PROTOCOL_TCP = "TCP"
+
+	// requested lease of the mappings, they are renewed when half of it is gone
+	MAPPING_LIFETIME = time.Hour
+	// how often the leases and the external address are checked
+	MAPPING_CHECK_INTERVAL = time.Minute
+)
+
+// Mapping is a port forwarded by the gateway
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	ExternalIP   net.IP
+	// the lease granted by the gateway, 0 means permanent
+	Lifetime time.Duration
+	Expires  time.Time
+}
+
+func (m Mapping) String() string {
+	return fmt.Sprintf("%v %v -> %v", m.Protocol, m.InternalPort, net.JoinHostPort(m.ExternalIP.String(), strconv.Itoa(m.ExternalPort)))
+}
+
+// IMapper is a port mapping protocol spoken with the gateway
+type IMapper interface {
+	Name() string
+	// Probe checks whether the gateway speaks the protocol
+	Probe() error
+	ExternalIP() (net.IP, error)
+	// AddMapping requests externalPort, the gateway may assign another one
+	AddMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (*Mapping, error)
+	DeleteMapping(m *Mapping) error
+}
+
+// NATManager keeps the port mappings on the gateway alive and reports external address changes
+type NATManager struct {
+	mappers    []IMapper
+	mapper     IMapper
+	mux        sync.Mutex
+	mappings   []*Mapping
+	externalIP net.IP
+	handlers   []func(net.IP, []Mapping)
+	quit       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewNATManager tries the mappers in the given order
+func NewNATManager(mappers ...IMapper) *NATManager {
+	return &NATManager{
+		mappers:  mappers,
+		mappings: make([]*Mapping, 0),
+		quit:     make(chan struct{}),
+	}
+}
+
+// NewDefaultNATManager tries PCP, NAT-PMP and UPnP, the gateway can be overridden by config.NAT_GATEWAY
+// and config.NAT_UPNP_LOCATION, e.g. to point them to a local stand-in
+func NewDefaultNATManager(localIP net.IP) *NATManager {
+	gateway := GatewayAddr(localIP)
+	return NewNATManager(
+		NewPCP(gateway),
+		NewNATPMP(gateway),
+		NewUPnP(localIP, config.NAT_UPNP_LOCATION),
+	)
+}
+
+// Discover picks the first mapper supported by the gateway
+func (m *NATManager) Discover() bool {
+	for _, mapper := range m.mappers {
+		if err := mapper.Probe(); err != nil {
+			pmLogger.Debug("gateway does not support %v: %v", mapper.Name(), err)
+			continue
+		}
+		pmLogger.Info("gateway supports %v", mapper.Name())
+		m.mux.Lock()
+		m.mapper = mapper
+		m.mux.Unlock()
+		return true
+	}
+	pmLogger.Info("no port mapping protocol is supported by the gateway")
+	return false
+}
+
+func (m *NATManager) GetMapper() IMapper {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.mapper
+}
+
+func (m *NATManager) GetExternalIP() net.IP {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.externalIP
+}
+
+// GetMappings returns a copy of the active mappings
+func (m *NATManager) GetMappings() []Mapping {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.copyMappings()
+}
+
+func (m *NATManager) copyMappings() []Mapping {
+	mappings := make([]Mapping, 0, len(m.mappings))
+	for _, mapping := range m.mappings {
+		mappings = append(mappings, *mapping)
+	}
+	return mappings
+}
+
+// GetMapping returns the external port of a mapped internal port, 0 if not mapped
+func (m *NATManager) GetMapping(protocol string, internalPort int) int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, mapping := range m.mappings {
+		if mapping.Protocol == protocol && mapping.InternalPort == internalPort {
+			return mapping.ExternalPort
+		}
+	}
+	return 0
+}
+
+// OnExternalAddressChanged is called with the external ip and all the mappings when either of them changes
+func (m *NATManager) OnExternalAddressChanged(f func(net.IP, []Mapping)) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.handlers = append(m.handlers, f)
+}
+
+// AddMapping maps the internal port, asking for the same external port first
+func (m *NATManager) AddMapping(protocol string, internalPort int) (*Mapping, error) {
+	mapper := m.GetMapper()
+	if mapper == nil {
+		return nil, fmt.Errorf("no port mapping protocol available")
+	}
+	mapping, err := mapper.AddMapping(protocol, internalPort, internalPort, MAPPING_LIFETIME)
+	if err != nil {
+		return nil, err
+	}
+	pmLogger.Info("%v mapped %v", mapper.Name(), mapping)
+
+	m.mux.Lock()
+	select {
+	case <-m.quit:
+		// closed while the gateway was answering, don't leave the lease behind
+		m.mux.Unlock()
+		if err := mapper.DeleteMapping(mapping); err != nil {
+			pmLogger.Warn("delete mapping %v error: %v", mapping, err)
+		}
+		return nil, fmt.Errorf("the nat manager is closed")
+	default:
+	}
+	replaced := false
+	for i, existing := range m.mappings {
+		if existing.Protocol == protocol && existing.InternalPort == internalPort {
+			m.mappings[i] = mapping
+			replaced = true
+		}
+	}
+	if !replaced {
+		m.mappings = append(m.mappings, mapping)
+	}
+	m.mux.Unlock()
+	m.updateExternalIP(mapping.ExternalIP, true)
+	return mapping, nil
+}
+
+func (m *NATManager) Start() {
+	go m.loop()
+}
+
+func (m *NATManager) loop() {
+	ticker := time.NewTicker(MAPPING_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.renew()
+			if mapper := m.GetMapper(); mapper != nil {
+				if ip, err := mapper.ExternalIP(); err == nil {
+					m.updateExternalIP(ip, false)
+				}
+			}
+		}
+	}
+}
+
+// renew the leases past half of their lifetime, the gateway may have lost them in a reboot
+func (m *NATManager) renew() {
+	mapper := m.GetMapper()
+	if mapper == nil {
+		return
+	}
+	m.mux.Lock()
+	due := make([]*Mapping, 0)
+	for _, mapping := range m.mappings {
+		if mapping.Lifetime > 0 && time.Until(mapping.Expires) < mapping.Lifetime/2 {
+			due = append(due, mapping)
+		}
+	}
+	m.mux.Unlock()
+
+	for _, old := range due {
+		mapping, err := mapper.AddMapping(old.Protocol, old.InternalPort, old.ExternalPort, MAPPING_LIFETIME)
+		if err != nil {
+			pmLogger.Warn("renew mapping %v error: %v", old, err)
+			continue
+		}
+		m.mux.Lock()
+		portChanged := mapping.ExternalPort != old.ExternalPort
+		*old = *mapping
+		m.mux.Unlock()
+		if portChanged {
+			pmLogger.Info("gateway moved mapping to %v", mapping)
+		}
+		m.updateExternalIP(mapping.ExternalIP, portChanged)
+	}
+}
+
+func (m *NATManager) updateExternalIP(ip net.IP, force bool) {
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+	m.mux.Lock()
+	changed := !ip.Equal(m.externalIP)
+	if !changed && !force {
+		m.mux.Unlock()
+		return
+	}
+	if changed {
+		pmLogger.Info("external address changed from %v to %v", m.externalIP, ip)
+	}
+	m.externalIP = ip
+	for _, mapping := range m.mappings {
+		mapping.ExternalIP = ip
+	}
+	mappings := m.copyMappings()
+	handlers := append([]func(net.IP, []Mapping){}, m.handlers...)
+	m.mux.Unlock()
+
+	for _, handler := range handlers {
+		handler(ip, mappings)
+	}
+}
+
+// Close stops the renewal and deletes all the mappings from the gateway
+func (m *NATManager) Close() {
+	m.closeOnce.Do(func() {
+		m.mux.Lock()
+		close(m.quit)
+		mapper := m.mapper
+		mappings := m.mappings
+		m.mappings = make([]*Mapping, 0)
+		m.mux.Unlock()
+		if mapper == nil {
+			return
+		}
+		for _, mapping := range mappings {
+			if err := mapper.DeleteMapping(mapping); err != nil {
+				pmLogger.Warn("delete mapping %v error: %v", mapping, err)
+			} else {
+				pmLogger.Info("deleted mapping %v", mapping)
+			}
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	UPNP_SSDP_ADDR    = "239.255.255.250:1900"
+	UPNP_SSDP_TIMEOUT = 3 * time.Second
+	UPNP_HTTP_TIMEOUT = 5 * time.Second
+	// external ports tried after the requested one is taken by another client
+	UPNP_PORT_ATTEMPTS = 16
+
+	upnpServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+const (
+	upnpErrNoSuchEntry         = 714
+	upnpErrConflict            = 718
+	upnpErrOnlyPermanentLeases = 725
+	upnpSearchTarget           = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp error %d: %v", e.Code, e.Description)
+}
+
+// UPnP controls an Internet Gateway Device over SOAP
+type UPnP struct {
+	localIP  net.IP
+	location string // the device description, searched by SSDP when empty
+	client   *http.Client
+
+	mux         sync.Mutex
+	controlURL  string
+	serviceType string
+}
+
+func NewUPnP(localIP net.IP, location string) *UPnP {
+	return &UPnP{
+		localIP:  localIP,
+		location: location,
+		client:   &http.Client{Timeout: UPNP_HTTP_TIMEOUT},
+	}
+}
+
+func (u *UPnP) Name() string { return "UPnP" }
+
+func (u *UPnP) Probe() error {
+	_, err := u.ExternalIP()
+	return err
+}
+
+func (u *UPnP) ExternalIP() (net.IP, error) {
+	var resp struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := u.soap("GetExternalIPAddress", nil, &resp); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(resp.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external ip %q", resp.IP)
+	}
+	return ip, nil
+}
+
+// IGDs do not assign ports, look for a free one starting from externalPort
+func (u *UPnP) AddMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	ip, err := u.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	for port := externalPort; port < externalPort+UPNP_PORT_ATTEMPTS && port <= 65535; port++ {
+		if !u.isFree(protocol, internalPort, port) {
+			pmLogger.Debug("upnp %v port %v is used by another client", protocol, port)
+			continue
+		}
+		granted, err := u.addPortMapping(protocol, internalPort, port, lifetime)
+		if e, ok := err.(*upnpError); ok && e.Code == upnpErrConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Mapping{
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			ExternalPort: port,
+			ExternalIP:   ip,
+			Lifetime:     granted,
+			Expires:      time.Now().Add(granted),
+		}, nil
+	}
+	return nil, fmt.Errorf("no free external %v port from %v", protocol, externalPort)
+}
+
+func (u *UPnP) DeleteMapping(m *Mapping) error {
+	return u.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+		{"NewProtocol", m.Protocol},
+	}, nil)
+}
+
+// a port is free when nobody maps it, or it is already mapped to us
+func (u *UPnP) isFree(protocol string, internalPort int, externalPort int) bool {
+	var resp struct {
+		InternalPort   int    `xml:"Body>GetSpecificPortMappingEntryResponse>NewInternalPort"`
+		InternalClient string `xml:"Body>GetSpecificPortMappingEntryResponse>NewInternalClient"`
+	}
+	err := u.soap("GetSpecificPortMappingEntry", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", protocol},
+	}, &resp)
+	if err != nil {
+		e, ok := err.(*upnpError)
+		return ok && e.Code == upnpErrNoSuchEntry
+	}
+	return net.ParseIP(resp.InternalClient).Equal(u.localIP) && resp.InternalPort == internalPort
+}
+
+func (u *UPnP) addPortMapping(protocol string, internalPort int, externalPort int, lifetime time.Duration) (time.Duration, error) {
+	args := func(lifetime time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(externalPort)},
+			{"NewProtocol", protocol},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", u.localIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "symphony p2p"},
+			{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+		}
+	}
+	err := u.soap("AddPortMapping", args(lifetime), nil)
+	if e, ok := err.(*upnpError); ok && e.Code == upnpErrOnlyPermanentLeases {
+		return 0, u.soap("AddPortMapping", args(0), nil)
+	}
+	return lifetime, err
+}
+
+func (u *UPnP) soap(action string, args [][2]string, result interface{}) error {
+	controlURL, serviceType, err := u.discover()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%v xmlns:u="%v">`, action, serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%v>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%v>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%v></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", controlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%v#%v"`, serviceType, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Code != 0 {
+			return &upnpError{Code: fault.Code, Description: fault.Description}
+		}
+		return fmt.Errorf("upnp %v: http status %v", action, resp.Status)
+	}
+	if result != nil {
+		return xml.Unmarshal(data, result)
+	}
+	return nil
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find the WAN connection service of the gateway, cached after the first success
+func (u *UPnP) discover() (string, string, error) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.controlURL != "" {
+		return u.controlURL, u.serviceType, nil
+	}
+
+	location := u.location
+	if location == "" {
+		var err error
+		if location, err = u.search(); err != nil {
+			return "", "", err
+		}
+	}
+	resp, err := u.client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if desc.URLBase != "" {
+		if b, err := url.Parse(desc.URLBase); err == nil {
+			base = b
+		}
+	}
+	for _, serviceType := range upnpServiceTypes {
+		if controlURL := findService(desc.Device, serviceType); controlURL != "" {
+			ref, err := url.Parse(controlURL)
+			if err != nil {
+				return "", "", err
+			}
+			u.controlURL = base.ResolveReference(ref).String()
+			u.serviceType = serviceType
+			return u.controlURL, u.serviceType, nil
+		}
+	}
+	return "", "", fmt.Errorf("no wan connection service at %v", location)
+}
+
+func findService(device upnpDevice, serviceType string) string {
+	for _, s := range device.Services {
+		if s.ServiceType == serviceType {
+			return s.ControlURL
+		}
+	}
+	for _, d := range device.Devices {
+		if controlURL := findService(d, serviceType); controlURL != "" {
+			return controlURL
+		}
+	}
+	return ""
+}
+
+// send an SSDP M-SEARCH and take the location of the first gateway answering
+func (u *UPnP) search() (string, error) {
+	ssdp, err := net.ResolveUDPAddr("udp4", UPNP_SSDP_ADDR)
+	if err != nil {
+		return "", err
+	}
+	var laddr *net.UDPAddr
+	if u.localIP.To4() != nil {
+		laddr = &net.UDPAddr{IP: u.localIP}
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	msg := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + UPNP_SSDP_ADDR + "\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(msg), ssdp); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(UPNP_SSDP_TIMEOUT))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", fmt.Errorf("no upnp gateway found: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" && strings.Contains(resp.Header.Get("St"), "InternetGatewayDevice") {
+			return location, nil
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package punch
+
+import (
+	"github.com/symphonyprotocol/p2p/models"
+)
+
+var (
+	PUNCH_DIAGRAM_CATEGORY  = "PUNCH"
+	PUNCH_DIAGRAM_REQUEST   = "REQUEST"
+	PUNCH_DIAGRAM_INTRODUCE = "INTRODUCE"
+	PUNCH_DIAGRAM_PROBE     = "PROBE"
+	PUNCH_DIAGRAM_ACK       = "ACK"
+)
+
+// sent to the rendezvous, asking it to introduce us to the target
+type RequestDiagram struct {
+	models.UDPDiagram
+	Target string
+	Nonce  string
+}
+
+// the "connect to me" signal relayed by the rendezvous to both sides
+type IntroduceDiagram struct {
+	models.UDPDiagram
+	Peer     string
+	PeerIP   string
+	PeerPort int
+	// guessed from the peer record, NATs often keep the port for tcp as well
+	PeerTCPPort int
+	Nonce       string
+}
+
+// probes and acks are sent directly between the two peers
+type ProbeDiagram struct {
+	models.UDPDiagram
+	Nonce string
+}
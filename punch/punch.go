@@ -0,0 +1,336 @@
+package punch
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/tcp"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	logger = log.GetLogger("punch")
+
+	PUNCH_TIMEOUT        = 5 * time.Second
+	PUNCH_PROBE_INTERVAL = 200 * time.Millisecond
+	PUNCH_PROBE_COUNT    = 15
+	// rendezvous peers asked in parallel
+	PUNCH_MAX_RENDEZVOUS = 3
+	// tcp simultaneous open attempts of the side which is introduced
+	PUNCH_TCP_ATTEMPTS       = 5
+	PUNCH_TCP_RETRY_INTERVAL = 500 * time.Millisecond
+)
+
+type attempt struct {
+	peerID     string
+	rendezvous map[string]bool
+	initiator  bool
+	addr       *net.UDPAddr
+	done       chan struct{}
+	once       sync.Once
+}
+
+func (a *attempt) succeed(addr *net.UDPAddr) {
+	a.once.Do(func() {
+		a.addr = addr
+		close(a.done)
+	})
+}
+
+// HolePuncher opens direct paths to nodes behind NAT with the help of a rendezvous peer
+// which both sides are connected to.
+type HolePuncher struct {
+	localNode  *node.LocalNode
+	network    models.INetwork
+	ktable     *kad.KTable
+	tcpService *tcp.TLSSecuredTCPService
+	pending    sync.Map // map[string]*attempt, keyed by nonce
+}
+
+func NewHolePuncher(localNode *node.LocalNode, network models.INetwork, ktable *kad.KTable, tcpService *tcp.TLSSecuredTCPService) *HolePuncher {
+	h := &HolePuncher{
+		localNode:  localNode,
+		network:    network,
+		ktable:     ktable,
+		tcpService: tcpService,
+	}
+	network.RegisterCallback(PUNCH_DIAGRAM_CATEGORY, h.callback)
+	if tcpService != nil {
+		tcpService.RegisterDialFallback(h.dialFallback)
+	}
+	return h
+}
+
+// Connect punches a udp path to the target and returns the address it answered from
+func (h *HolePuncher) Connect(target *node.RemoteNode) (*net.UDPAddr, error) {
+	rendezvous := h.findRendezvous(target)
+	if len(rendezvous) == 0 {
+		return nil, fmt.Errorf("no rendezvous peer for %v", target.GetID())
+	}
+
+	nonce := utils.NewUUID()
+	a := &attempt{
+		peerID:     target.GetID(),
+		rendezvous: make(map[string]bool),
+		initiator:  true,
+		done:       make(chan struct{}),
+	}
+	for _, r := range rendezvous {
+		a.rendezvous[r.GetID()] = true
+	}
+	h.pending.Store(nonce, a)
+	defer h.pending.Delete(nonce)
+
+	for _, r := range rendezvous {
+		req := RequestDiagram{
+			UDPDiagram: h.newDiagram(PUNCH_DIAGRAM_REQUEST),
+			Target:     target.GetID(),
+			Nonce:      nonce,
+		}
+		h.send(r, utils.DiagramToBytes(req))
+		logger.Debug("ask %v to introduce us to %v", r.GetID(), target.GetID())
+	}
+
+	select {
+	case <-a.done:
+		return a.addr, nil
+	case <-time.After(PUNCH_TIMEOUT):
+		return nil, fmt.Errorf("hole punching to %v timed out", target.GetID())
+	}
+}
+
+// the node which told us about the target first, then the active nodes closest to it
+func (h *HolePuncher) findRendezvous(target *node.RemoteNode) []*node.RemoteNode {
+	res := make([]*node.RemoteNode, 0, PUNCH_MAX_RENDEZVOUS)
+	if target.IntroducedBy != "" {
+		if r := h.ktable.Search(target.IntroducedBy); r != nil && !r.LastActiveTime.IsZero() {
+			res = append(res, r)
+		}
+	}
+	candidates := h.ktable.GetActiveNodes()
+	sort.Slice(candidates, func(i, j int) bool {
+		return kad.Closer(target.GetIDBytes(), candidates[i].GetIDBytes(), candidates[j].GetIDBytes())
+	})
+	for _, c := range candidates {
+		if len(res) >= PUNCH_MAX_RENDEZVOUS {
+			break
+		}
+		if c.GetID() == target.GetID() || c.GetID() == target.IntroducedBy {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// used by the tcp service when dialing a node fails
+func (h *HolePuncher) dialFallback(ip net.IP, port int, nodeId string) (*tcp.TCPConnection, error) {
+	target := h.ktable.Search(nodeId)
+	if target == nil {
+		return nil, fmt.Errorf("node %v is not in the table", nodeId)
+	}
+	addr, err := h.Connect(target)
+	if err != nil {
+		return nil, err
+	}
+	if conn := h.tcpService.GetConnectionByNodeID(nodeId); conn != nil {
+		return conn, nil
+	}
+	return h.simultaneousOpen(nodeId, addr.IP, tcpPortOf(target, addr.Port), PUNCH_TCP_ATTEMPTS)
+}
+
+func (h *HolePuncher) callback(p models.ICallbackParams) {
+	params, ok := p.(models.UDPCallbackParams)
+	if !ok {
+		return
+	}
+	remoteAddr := params.GetUDPRemoteAddr()
+	switch params.Diagram.GetDType() {
+	case PUNCH_DIAGRAM_REQUEST:
+		var req RequestDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &req); err == nil {
+			h.introduce(req, remoteAddr)
+		}
+	case PUNCH_DIAGRAM_INTRODUCE:
+		var intro IntroduceDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &intro); err == nil {
+			h.introduced(intro)
+		}
+	case PUNCH_DIAGRAM_PROBE:
+		var probe ProbeDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &probe); err == nil {
+			ack := ProbeDiagram{
+				UDPDiagram: h.newDiagram(PUNCH_DIAGRAM_ACK),
+				Nonce:      probe.Nonce,
+			}
+			h.network.Send(remoteAddr.IP, remoteAddr.Port, utils.DiagramToBytes(ack), probe.NodeID)
+			h.punched(probe, remoteAddr)
+		}
+	case PUNCH_DIAGRAM_ACK:
+		var ack ProbeDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &ack); err == nil {
+			h.punched(ack, remoteAddr)
+		}
+	}
+}
+
+// rendezvous side, both peers must be in our table
+func (h *HolePuncher) introduce(req RequestDiagram, requesterAddr *net.UDPAddr) {
+	requester := h.ktable.Search(req.NodeID)
+	target := h.ktable.Search(req.Target)
+	if requester == nil || target == nil || target.LastActiveTime.IsZero() {
+		logger.Debug("cannot introduce %v to %v, not connected to both", req.NodeID, req.Target)
+		return
+	}
+
+	toTarget := IntroduceDiagram{
+		UDPDiagram:  h.newDiagram(PUNCH_DIAGRAM_INTRODUCE),
+		Peer:        req.NodeID,
+		PeerIP:      requesterAddr.IP.String(),
+		PeerPort:    requesterAddr.Port,
+		PeerTCPPort: tcpPortOf(requester, requesterAddr.Port),
+		Nonce:       req.Nonce,
+	}
+	targetIP, targetPort := target.GetSendIPWithPort(h.localNode)
+	toRequester := IntroduceDiagram{
+		UDPDiagram:  h.newDiagram(PUNCH_DIAGRAM_INTRODUCE),
+		Peer:        req.Target,
+		PeerIP:      targetIP.String(),
+		PeerPort:    targetPort,
+		PeerTCPPort: tcpPortOf(target, targetPort),
+		Nonce:       req.Nonce,
+	}
+	h.send(target, utils.DiagramToBytes(toTarget))
+	h.network.Send(requesterAddr.IP, requesterAddr.Port, utils.DiagramToBytes(toRequester), req.NodeID)
+	logger.Debug("introduced %v to %v", req.NodeID, req.Target)
+}
+
+// both peers start probing each other once the rendezvous introduced them
+func (h *HolePuncher) introduced(intro IntroduceDiagram) {
+	var a *attempt
+	if obj, ok := h.pending.Load(intro.Nonce); ok {
+		a = obj.(*attempt)
+		if !a.rendezvous[intro.NodeID] || a.peerID != intro.Peer {
+			return
+		}
+	} else {
+		// we are the target, only trust rendezvous peers we know
+		if h.ktable.Search(intro.NodeID) == nil {
+			return
+		}
+		a = &attempt{
+			peerID: intro.Peer,
+			done:   make(chan struct{}),
+		}
+		h.pending.Store(intro.Nonce, a)
+		time.AfterFunc(PUNCH_TIMEOUT, func() { h.pending.Delete(intro.Nonce) })
+	}
+	peerIP := net.ParseIP(intro.PeerIP)
+	if peerIP == nil {
+		return
+	}
+	go h.probe(a, intro.Nonce, peerIP, intro.PeerPort)
+	if !a.initiator {
+		go h.simultaneousOpen(intro.Peer, peerIP, intro.PeerTCPPort, PUNCH_TCP_ATTEMPTS)
+	}
+}
+
+func (h *HolePuncher) probe(a *attempt, nonce string, ip net.IP, port int) {
+	probe := ProbeDiagram{
+		UDPDiagram: h.newDiagram(PUNCH_DIAGRAM_PROBE),
+		Nonce:      nonce,
+	}
+	data := utils.DiagramToBytes(probe)
+	for i := 0; i < PUNCH_PROBE_COUNT; i++ {
+		select {
+		case <-a.done:
+			return
+		default:
+		}
+		h.network.Send(ip, port, data, a.peerID)
+		time.Sleep(PUNCH_PROBE_INTERVAL)
+	}
+}
+
+// a probe or ack came through, the path is open: remember the address for the table and the tcp service
+func (h *HolePuncher) punched(probe ProbeDiagram, addr *net.UDPAddr) {
+	obj, ok := h.pending.Load(probe.Nonce)
+	if !ok {
+		return
+	}
+	a := obj.(*attempt)
+	if a.peerID != probe.NodeID {
+		return
+	}
+
+	rnode := h.ktable.Search(a.peerID)
+	if rnode == nil {
+		id, _ := hex.DecodeString(a.peerID)
+		rnode = node.NewRemoteNode(id, addr.IP, addr.Port, addr.IP, addr.Port)
+		h.ktable.AddNode(rnode)
+	}
+	rnode.RefreshNode(rnode.GetLocalIP().String(), rnode.GetLocalPort(), addr.IP.String(), addr.Port, -1)
+	logger.Debug("punched a hole to %v at %v", a.peerID, addr.String())
+	a.succeed(addr)
+}
+
+// the node with the lower id plays the tls server
+func (h *HolePuncher) simultaneousOpen(peerID string, ip net.IP, port int, attempts int) (*tcp.TCPConnection, error) {
+	if h.tcpService == nil {
+		return nil, fmt.Errorf("no tcp service")
+	}
+	isServer := h.localNode.GetID() < peerID
+	var err error
+	for i := 0; i < attempts; i++ {
+		if conn := h.tcpService.GetConnectionByNodeID(peerID); conn != nil {
+			return conn, nil
+		}
+		var conn *tcp.TCPConnection
+		if conn, err = h.tcpService.DialSimultaneous(ip, port, peerID, isServer); err == nil {
+			return conn, nil
+		}
+		time.Sleep(PUNCH_TCP_RETRY_INTERVAL)
+	}
+	logger.Debug("tcp simultaneous open to %v failed: %v", peerID, err)
+	return nil, err
+}
+
+func (h *HolePuncher) send(rnode *node.RemoteNode, data []byte) {
+	ip, port := rnode.GetSendIPWithPort(h.localNode)
+	h.network.Send(ip, port, data, rnode.GetID())
+}
+
+func (h *HolePuncher) newDiagram(dType string) models.UDPDiagram {
+	ts := time.Now().Unix()
+	return models.UDPDiagram{
+		NetworkDiagram: models.NetworkDiagram{
+			ID:        utils.NewUUID(),
+			NodeID:    h.localNode.GetID(),
+			Timestamp: ts,
+			DCategory: PUNCH_DIAGRAM_CATEGORY,
+			DType:     dType,
+			Version:   models.UDP_DIAGRAM_VERSION,
+		},
+		Expire:    ts + int64(models.DEFAULT_TIMEOUT),
+		LocalAddr: h.localNode.GetLocalIP().String(),
+		LocalPort: h.localNode.GetLocalPort(),
+	}
+}
+
+// the external tcp port from the record if it maps to the same ip, otherwise guess the udp one
+func tcpPortOf(rnode *node.RemoteNode, udpPort int) int {
+	if record := rnode.GetRecord(); record != nil {
+		if ep, ok := record.GetEndpoint(node.ENDPOINT_TCP, node.ENDPOINT_SCOPE_REMOTE); ok && net.ParseIP(ep.IP).Equal(rnode.GetRemoteIP()) {
+			return ep.Port
+		}
+	}
+	return udpPort
+}
@@ -0,0 +1,266 @@
+package ratelimit
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// buckets idle this long are full again and forgotten
+	IDLE_TIMEOUT = time.Minute
+	// keys tracked per rule, a new key evicts the least recently used one above this so that spoofed
+	// sources can't grow the map nor lock new peers out
+	MAX_KEYS = 65536
+
+	// REASON_* label the drop counters
+	REASON_IP       = "ip"
+	REASON_NODE     = "node"
+	REASON_CATEGORY = "category"
+	REASON_BANNED   = "banned"
+)
+
+// Rule allows Rate events per second on average and Burst at once, a zero Rate disables it
+type Rule struct {
+	Rate  float64
+	Burst int
+}
+
+// Policy is the set of rules of one transport
+type Policy struct {
+	PerIP   Rule
+	PerNode Rule
+	// key the PerNode buckets on the node id and the source ip, for transports where the node id is only
+	// claimed by the sender, else anyone could exhaust the bucket of another node
+	PerNodeWithIP bool
+	// applied per source ip and category, categories without a rule are only limited by the others
+	PerCategory map[string]Rule
+}
+
+var (
+	DEFAULT_UDP_POLICY = Policy{
+		PerIP:         Rule{Rate: 100, Burst: 200},
+		PerNode:       Rule{Rate: 50, Burst: 100},
+		PerNodeWithIP: true,
+		PerCategory: map[string]Rule{
+			// pings are answered with bigger pongs
+			"KTABKE": {Rate: 30, Burst: 60},
+			"PUNCH":  {Rate: 20, Burst: 40},
+			// every request costs a udp and a tcp dial-back
+			"AUTONAT": {Rate: 1, Burst: 5},
+		},
+	}
+	// file and block sync push many chunks
+	DEFAULT_TCP_POLICY = Policy{
+		PerIP:       Rule{Rate: 2000, Burst: 4000},
+		PerNode:     Rule{Rate: 2000, Burst: 4000},
+		PerCategory: map[string]Rule{},
+	}
+)
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// keyed token buckets sharing one rule
+type buckets struct {
+	rule      Rule
+	mux       sync.Mutex
+	buckets   map[string]*list.Element
+	lru       *list.List // of *bucket, the most recently used first
+	lastSweep time.Time
+}
+
+func newBuckets(rule Rule) *buckets {
+	return &buckets{rule: rule, buckets: make(map[string]*list.Element), lru: list.New(), lastSweep: time.Now()}
+}
+
+func (b *buckets) allow(key string) bool {
+	if b.rule.Rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if now.Sub(b.lastSweep) > IDLE_TIMEOUT {
+		b.sweep(now)
+	}
+	var tb *bucket
+	if elem, ok := b.buckets[key]; ok {
+		tb = elem.Value.(*bucket)
+		b.lru.MoveToFront(elem)
+	} else {
+		if len(b.buckets) >= MAX_KEYS {
+			b.evict(b.lru.Back())
+		}
+		tb = &bucket{key: key, tokens: float64(b.rule.Burst), last: now}
+		b.buckets[key] = b.lru.PushFront(tb)
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * b.rule.Rate
+	if max := float64(b.rule.Burst); tb.tokens > max {
+		tb.tokens = max
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func (b *buckets) sweep(now time.Time) {
+	for elem := b.lru.Back(); elem != nil && now.Sub(elem.Value.(*bucket).last) > IDLE_TIMEOUT; elem = b.lru.Back() {
+		b.evict(elem)
+	}
+	b.lastSweep = now
+}
+
+func (b *buckets) evict(elem *list.Element) {
+	b.lru.Remove(elem)
+	delete(b.buckets, elem.Value.(*bucket).key)
+}
+
+// Limiter drops the traffic of sources exceeding the policy and counts the drops
+type Limiter struct {
+	perIP         *buckets
+	perNode       *buckets
+	perNodeWithIP bool
+	perCategory   map[string]*buckets
+
+	dropsMux sync.Mutex
+	drops    map[string]*uint64
+
+	bansMux sync.RWMutex
+	bans    map[string]time.Time // ip or node id -> expiry, zero for never
+}
+
+func NewLimiter(policy Policy) *Limiter {
+	l := &Limiter{
+		perIP:         newBuckets(policy.PerIP),
+		perNode:       newBuckets(policy.PerNode),
+		perNodeWithIP: policy.PerNodeWithIP,
+		perCategory:   make(map[string]*buckets),
+		drops:         make(map[string]*uint64),
+		bans:          make(map[string]time.Time),
+	}
+	for category, rule := range policy.PerCategory {
+		l.perCategory[category] = newBuckets(rule)
+	}
+	return l
+}
+
+// AllowIP is checked before a packet is decoded, a nil ip is always allowed
+func (l *Limiter) AllowIP(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if l.banned(ip.String()) {
+		l.drop(REASON_BANNED)
+		return false
+	}
+	if l.perIP.allow(ip.String()) {
+		return true
+	}
+	l.drop(REASON_IP)
+	return false
+}
+
+// AllowDiagram is checked once the sender and the category are known
+func (l *Limiter) AllowDiagram(ip net.IP, nodeID string, category string) bool {
+	if nodeID != "" && l.banned(nodeID) {
+		l.drop(REASON_BANNED)
+		return false
+	}
+	if nodeID != "" {
+		key := nodeID
+		if l.perNodeWithIP && ip != nil {
+			key = nodeID + "/" + ip.String()
+		}
+		if !l.perNode.allow(key) {
+			l.drop(REASON_NODE)
+			return false
+		}
+	}
+	if b, ok := l.perCategory[category]; ok {
+		key := category
+		if ip != nil {
+			key = ip.String()
+		}
+		if !b.allow(key) {
+			l.drop(REASON_CATEGORY + ":" + category)
+			return false
+		}
+	}
+	return true
+}
+
+// Ban drops everything from an ip or a node id for d, forever if d is 0
+func (l *Limiter) Ban(key string, d time.Duration) {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	l.bansMux.Lock()
+	defer l.bansMux.Unlock()
+	l.bans[key] = until
+}
+
+func (l *Limiter) Unban(key string) {
+	l.bansMux.Lock()
+	defer l.bansMux.Unlock()
+	delete(l.bans, key)
+}
+
+// GetBans returns the active bans and when they expire, a zero time never expires
+func (l *Limiter) GetBans() map[string]time.Time {
+	now := time.Now()
+	l.bansMux.RLock()
+	defer l.bansMux.RUnlock()
+	res := make(map[string]time.Time)
+	for key, until := range l.bans {
+		if until.IsZero() || until.After(now) {
+			res[key] = until
+		}
+	}
+	return res
+}
+
+func (l *Limiter) banned(key string) bool {
+	l.bansMux.RLock()
+	until, ok := l.bans[key]
+	l.bansMux.RUnlock()
+	if !ok {
+		return false
+	}
+	if until.IsZero() || time.Now().Before(until) {
+		return true
+	}
+	l.Unban(key)
+	return false
+}
+
+func (l *Limiter) drop(reason string) {
+	l.dropsMux.Lock()
+	counter, ok := l.drops[reason]
+	if !ok {
+		counter = new(uint64)
+		l.drops[reason] = counter
+	}
+	l.dropsMux.Unlock()
+	atomic.AddUint64(counter, 1)
+}
+
+// GetDrops returns the dropped packets by reason, "ip", "node", "banned" or "category:<name>"
+func (l *Limiter) GetDrops() map[string]uint64 {
+	l.dropsMux.Lock()
+	defer l.dropsMux.Unlock()
+	res := make(map[string]uint64)
+	for reason, counter := range l.drops {
+		res[reason] = atomic.LoadUint64(counter)
+	}
+	return res
+}
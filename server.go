@@ -1,13 +1,30 @@
 package p2p
 
 import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
 	"github.com/symphonyprotocol/log"
 
 	"github.com/symphonyprotocol/p2p/models"
 
+	"github.com/symphonyprotocol/p2p/autonat"
+	"github.com/symphonyprotocol/p2p/bootstrap"
+	"github.com/symphonyprotocol/p2p/capture"
+	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/events"
+	"github.com/symphonyprotocol/p2p/hyparview"
 	"github.com/symphonyprotocol/p2p/kad"
+	"github.com/symphonyprotocol/p2p/lan"
+	"github.com/symphonyprotocol/p2p/metrics"
+	"github.com/symphonyprotocol/p2p/netsize"
 	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/portmap"
+	"github.com/symphonyprotocol/p2p/punch"
 	"github.com/symphonyprotocol/p2p/tcp"
+	"github.com/symphonyprotocol/p2p/trace"
 	"github.com/symphonyprotocol/p2p/udp"
 )
 
@@ -16,54 +33,264 @@ var p2pLogger = log.GetLogger("p2pServer")
 type P2PServer struct {
 	node        *node.LocalNode
 	ktable      models.INodeProvider
+	hyparview   *hyparview.HyParView
+	// the provider of the contexts, the ktable or the hyparview
+	overlay     models.INodeProvider
+	sizeEstimator *netsize.Estimator
 	udpService  models.INetwork
 	tcpService  *tcp.TLSSecuredTCPService
 	syncManager *tcp.SyncManager
+	holePuncher *punch.HolePuncher
+	relayService *tcp.RelayService
+	pubsub      *tcp.PubSub
+	plumtree    *tcp.Plumtree
+	natManager  *portmap.NATManager
+	autoNAT     *autonat.AutoNAT
+	lanDiscovery *lan.Discovery
+	metricsServer *http.Server
+	adminAPI    *AdminAPI
+	recorder    *capture.Recorder
 	middlewares []tcp.IMiddleware
 	quit        chan int
+	closeOnce   sync.Once
 	p2pContext	*tcp.P2PContext
 }
 
 func NewP2PServer() *P2PServer {
 	node := node.NewLocalNode()
-	udpService := udp.NewUDPService(node.GetID(), node.GetLocalIP(), node.GetLocalPort())
+	udpService := udp.NewUDPService(node.GetID(), node.GetListenIP(), node.GetLocalPort())
+	udpService.SetEventBus(node.Events())
 	sTcpService := tcp.NewTLSSecuredTCPService(node)
+	sTcpService.SetTraceCollector(trace.NewCollector())
 	ktable := kad.NewKTable(node, udpService)
 	syncManager := tcp.NewSyncManager(ktable, sTcpService, tcp.NewFileSyncProvider())
+	holePuncher := punch.NewHolePuncher(node, udpService, ktable, sTcpService)
+	relayService := tcp.NewRelayService(sTcpService.TCPService, node, ktable)
+	pubsub := tcp.NewPubSub(sTcpService.TCPService, node, ktable)
+	hpv := hyparview.NewHyParView(node, udpService, ktable)
+	var overlay models.INodeProvider = ktable
+	if config.BROADCAST_OVERLAY == "hyparview" {
+		overlay = hpv
+	}
+	plumtree := tcp.NewPlumtree(sTcpService.TCPService, node, overlay, ktable)
+	autoNAT := autonat.NewAutoNAT(node, udpService, ktable, sTcpService)
 	srv := &P2PServer{
 		node:        node,
 		ktable:      ktable,
+		hyparview:   hpv,
+		overlay:     overlay,
+		sizeEstimator: netsize.NewEstimator(ktable),
 		udpService:  udpService,
 		tcpService:  sTcpService,
 		quit:        make(chan int),
 		syncManager: syncManager,
+		holePuncher: holePuncher,
+		relayService: relayService,
+		pubsub:      pubsub,
+		plumtree:    plumtree,
+		autoNAT:     autoNAT,
 		middlewares: make([]tcp.IMiddleware, 0, 10),
 	}
 	return srv
 }
 
 func (s *P2PServer) Start() {
-	s.node.DiscoverNAT()
+	s.startCapture()
+	s.mapPorts()
+	s.startMetrics()
+	s.startAdminAPI()
 	p2pLogger.Debug("%v", s.node)
 	s.udpService.Start()
 	s.tcpService.Start()
 	s.regTCPEvents()
 	s.ktable.Start()
-	s.p2pContext = tcp.NewP2PContext(s.tcpService, s.node, s.ktable, nil, s.middlewares)
+	s.hyparview.Start()
+	s.autoNAT.Start()
+	s.startLANDiscovery()
+	s.relayService.Start()
+	s.pubsub.Start()
+	s.plumtree.Start()
+	s.p2pContext = tcp.NewP2PContext(s.tcpService, s.node, s.overlay, nil, s.middlewares)
 	s.startMiddlewares()
 	// s.syncManager.Start()
-	defer close(s.quit)
 	<-s.quit
 }
 
+// map the udp and tcp ports on the gateway and keep the record in sync with the external address.
+// The discovery waits for the timeouts of every protocol the gateway doesn't speak, so it runs in the background
+// and the mapping reaches the record through OnExternalAddressChanged
+func (s *P2PServer) mapPorts() {
+	if !config.NAT_ENABLED {
+		return
+	}
+	s.natManager = portmap.NewDefaultNATManager(s.node.GetLocalIP())
+	s.natManager.OnExternalAddressChanged(func(ip net.IP, mappings []portmap.Mapping) {
+		udpPort := s.natManager.GetMapping(portmap.PROTOCOL_UDP, s.node.GetLocalPort())
+		tcpPort := s.natManager.GetMapping(portmap.PROTOCOL_TCP, s.node.GetTCPPort())
+		if udpPort != 0 {
+			s.node.ApplyPortMapping(ip, udpPort, tcpPort)
+		}
+	})
+	go func() {
+		if !s.natManager.Discover() {
+			return
+		}
+		if _, err := s.natManager.AddMapping(portmap.PROTOCOL_UDP, s.node.GetLocalPort()); err != nil {
+			p2pLogger.Warn("map udp port error: %v", err)
+		}
+		if _, err := s.natManager.AddMapping(portmap.PROTOCOL_TCP, s.node.GetTCPPort()); err != nil {
+			p2pLogger.Warn("map tcp port error: %v", err)
+		}
+		s.natManager.Start()
+	}()
+}
+
+func (s *P2PServer) startLANDiscovery() {
+	kt, ok := s.ktable.(*kad.KTable)
+	if !config.LAN_DISCOVERY_ENABLED || !ok {
+		return
+	}
+	discovery, err := lan.NewDiscovery(s.node, kt)
+	if err == nil {
+		err = discovery.Start()
+	}
+	if err != nil {
+		p2pLogger.Warn("lan discovery is not available: %v", err)
+		return
+	}
+	s.lanDiscovery = discovery
+}
+
+// serve the metrics when config.METRICS_ADDR is set, the state of the components is read on every scrape
+func (s *P2PServer) startMetrics() {
+	if config.METRICS_ADDR == "" {
+		return
+	}
+	if kt, ok := s.ktable.(*kad.KTable); ok {
+		metrics.DefaultRegistry.NewGaugeFunc("p2p_bucket_nodes", "Nodes per kademlia bucket.", []string{"distance"}, func(emit metrics.EmitFunc) {
+			for dist, size := range kt.GetBucketSizes() {
+				emit(float64(size), strconv.Itoa(dist))
+			}
+		})
+	}
+	metrics.DefaultRegistry.NewGaugeFunc("p2p_network_size", "Estimated number of nodes in the network and the bounds of its interval.", []string{"bound"}, func(emit metrics.EmitFunc) {
+		estimate := s.sizeEstimator.GetEstimate()
+		emit(estimate.Size, "estimate")
+		emit(estimate.Low, "low")
+		emit(estimate.High, "high")
+	})
+	metrics.DefaultRegistry.NewGaugeFunc("p2p_tcp_write_queue", "Messages waiting to be written per tcp connection.", []string{"remote", "node"}, func(emit metrics.EmitFunc) {
+		for _, conn := range s.tcpService.GetTCPConnections() {
+			emit(float64(conn.GetWriteQueueLen()), conn.RemoteAddr().String(), conn.GetNodeID())
+		}
+	})
+	metrics.DefaultRegistry.NewGaugeFunc("p2p_multipart_backlog", "Multipart diagrams waiting for their chunks.", nil, func(emit metrics.EmitFunc) {
+		diagrams, _ := tcp.GetMultipartBacklog()
+		emit(float64(diagrams))
+	})
+	metrics.DefaultRegistry.NewGaugeFunc("p2p_multipart_backlog_bytes", "Bytes held for incomplete multipart diagrams.", nil, func(emit metrics.EmitFunc) {
+		_, bytes := tcp.GetMultipartBacklog()
+		emit(float64(bytes))
+	})
+	metrics.DefaultRegistry.NewGaugeFunc("p2p_seen_messages", "Messages remembered for deduplication.", nil, func(emit metrics.EmitFunc) {
+		emit(float64(s.tcpService.GetSeenCache().Len()))
+	})
+	udpService, _ := s.udpService.(*udp.UDPService)
+	metrics.DefaultRegistry.NewCounterFunc("p2p_ratelimit_drops_total", "Messages dropped by the rate limiters.", []string{"transport", "reason"}, func(emit metrics.EmitFunc) {
+		if udpService != nil {
+			for reason, n := range udpService.GetRateLimiter().GetDrops() {
+				emit(float64(n), metrics.TRANSPORT_UDP, reason)
+			}
+		}
+		for reason, n := range s.tcpService.GetRateLimiter().GetDrops() {
+			emit(float64(n), metrics.TRANSPORT_TCP, reason)
+		}
+	})
+	if udpService != nil {
+		metrics.DefaultRegistry.NewCounterFunc("p2p_udp_queue_drops_total", "Udp packets dropped because the queue of their category was full.", []string{"category"}, func(emit metrics.EmitFunc) {
+			for category, stats := range udpService.GetStats() {
+				emit(float64(stats.Dropped), category)
+			}
+		})
+	}
+
+	server, err := metrics.Serve(config.METRICS_ADDR)
+	if err != nil {
+		p2pLogger.Warn("metrics are not available: %v", err)
+		return
+	}
+	s.metricsServer = server
+}
+
+// serve the admin api when config.ADMIN_ADDR is set
+func (s *P2PServer) startAdminAPI() {
+	if config.ADMIN_ADDR == "" {
+		return
+	}
+	api := NewAdminAPI(s, adminToken())
+	if err := api.Start(config.ADMIN_ADDR); err != nil {
+		p2pLogger.Warn("admin api is not available: %v", err)
+		return
+	}
+	s.adminAPI = api
+}
+
+// record the traffic of both services when config.CAPTURE_FILE is set
+func (s *P2PServer) startCapture() {
+	if config.CAPTURE_FILE == "" {
+		return
+	}
+	recorder, err := capture.NewRecorder(config.CAPTURE_FILE)
+	if err != nil {
+		p2pLogger.Warn("capture is not available: %v", err)
+		return
+	}
+	if udpService, ok := s.udpService.(*udp.UDPService); ok {
+		udpService.SetRecorder(recorder)
+	}
+	s.tcpService.SetRecorder(recorder)
+	s.recorder = recorder
+}
+
+// StartReplay readies the node for Replay without going on the network: the packets sent go to sink,
+// capture.DiscardSink when nil, and nothing is bootstrapped, refreshed, mapped or gossiped on its own.
+// The udp callbacks and the middlewares are the ones Start would run. Use instead of Start.
+func (s *P2PServer) StartReplay(sink capture.Sink) {
+	if sink == nil {
+		sink = capture.DiscardSink
+	}
+	if udpService, ok := s.udpService.(*udp.UDPService); ok {
+		udpService.SetSink(sink)
+	}
+	s.tcpService.SetSink(sink)
+	s.regTCPEvents()
+	s.p2pContext = tcp.NewP2PContext(s.tcpService, s.node, s.overlay, nil, s.middlewares)
+	s.startMiddlewares()
+}
+
+// Replay feeds the inbound traffic of a capture file to the udp callbacks and the middlewares,
+// use after StartReplay, or after Start to replay into a live node
+func (s *P2PServer) Replay(path string, filter capture.Filter, speed float64) (int, error) {
+	reader, err := capture.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	// the messages of an earlier replay would be dropped as duplicates
+	s.tcpService.GetSeenCache().Clear()
+	udpInjector, _ := s.udpService.(capture.IInjector)
+	return capture.Replay(reader, filter, udpInjector, s.tcpService, speed)
+}
+
 func (s *P2PServer) regTCPEvents() {
 	s.tcpService.RegisterCallback("default", func(p models.ICallbackParams) {
 		if params, ok := p.(tcp.TCPCallbackParams); ok {
-			ctx := tcp.NewP2PContext(s.tcpService, s.node, s.ktable, &params, s.middlewares)
+			ctx := tcp.NewP2PContext(s.tcpService, s.node, s.overlay, &params, s.middlewares)
 			
 			// p2pLogger.Debug("Length of middlewares is %v", len(s.middlewares))
 			go func() {
 				for _, middleware := range s.middlewares {
+					ctx.SetCurrentMiddleware(middleware)
 					middleware.Handle(ctx)
 					if ctx.GetSkipped() {
 						ctx.ResetSkipped()
@@ -71,6 +298,7 @@ func (s *P2PServer) regTCPEvents() {
 						break
 					}
 				}
+				ctx.ForwardGossip()
 			}()
 		}
 	})
@@ -99,9 +327,64 @@ func (s *P2PServer) Use(m tcp.IMiddleware) {
 	s.middlewares = append(s.middlewares, m)
 }
 
+// use before start, the source takes priority over the config file and the env overrides
+func (s *P2PServer) UseBootstrapSource(src bootstrap.ISource) {
+	if kt, ok := s.ktable.(*kad.KTable); ok {
+		kt.GetBootstrapper().PrependSource(src)
+	}
+}
+
+// Events returns the bus of the peer, connection, address and drop events
+func (s *P2PServer) Events() *events.Bus {
+	return s.node.Events()
+}
+
+// PubSub subscribes to and publishes on topics
+func (s *P2PServer) PubSub() *tcp.PubSub {
+	return s.pubsub
+}
+
+// UsePlumtree broadcasts the diagrams of dTypes along the plumtree instead of to one node per bucket,
+// for the large ones like blocks
+func (s *P2PServer) UsePlumtree(dTypes ...string) {
+	for _, dType := range dTypes {
+		s.tcpService.SetBroadcastStrategy(dType, s.plumtree)
+	}
+}
+
+func (s *P2PServer) Plumtree() *tcp.Plumtree {
+	return s.plumtree
+}
+
+// HyParView returns the membership overlay, ctx.WithNodeProvider(s.HyParView()) broadcasts over it
+// whatever config.BROADCAST_OVERLAY is
+func (s *P2PServer) HyParView() *hyparview.HyParView {
+	return s.hyparview
+}
+
+// GetNetworkSize estimates the number of nodes from the density of the ktable, see netsize.Estimator
+func (s *P2PServer) GetNetworkSize() netsize.Estimate {
+	return s.sizeEstimator.GetEstimate()
+}
+
+// SizeEstimator is for the middlewares tuning their fanout or replication to the size of the network
+func (s *P2PServer) SizeEstimator() *netsize.Estimator {
+	return s.sizeEstimator
+}
+
+// GetTraceCollector returns the propagation trees of the traced messages, see P2PContext.StartTrace
+func (s *P2PServer) GetTraceCollector() *trace.Collector {
+	return s.tcpService.GetTraceCollector()
+}
+
+// whether other nodes can dial us, decided by the dial-backs of the peers
+func (s *P2PServer) GetReachability() autonat.Status {
+	return s.autoNAT.GetStatus()
+}
+
 // NodeID will be set by P2PServer
 func (s *P2PServer) NewP2PContext() *tcp.P2PContext {
-	return tcp.NewP2PContext(s.tcpService, s.node, s.ktable, nil, s.middlewares)
+	return tcp.NewP2PContext(s.tcpService, s.node, s.overlay, nil, s.middlewares)
 }
 
 func (s *P2PServer) GetP2PContext() *tcp.P2PContext {
@@ -109,5 +392,21 @@ func (s *P2PServer) GetP2PContext() *tcp.P2PContext {
 }
 
 func (s *P2PServer) Close() {
-	s.quit <- 1
+	if s.natManager != nil {
+		s.natManager.Close()
+	}
+	if s.lanDiscovery != nil {
+		s.lanDiscovery.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminAPI != nil {
+		s.adminAPI.Close()
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	// Close may run before Start waits, or while a middleware's Start blocks it
+	s.closeOnce.Do(func() { close(s.quit) })
 }
@@ -0,0 +1,37 @@
+package tcp
+
+import (
+	"github.com/symphonyprotocol/p2p/models"
+)
+
+// IBroadcastStrategy takes over P2PContext.Broadcast for the diagrams of the DTypes it is set for
+type IBroadcastStrategy interface {
+	Broadcast(ctx *P2PContext, diag models.IDiagram)
+}
+
+// SetBroadcastStrategy makes Broadcast use s for the diagrams of dType, nil goes back to sending to every peer
+func (tcp *TCPService) SetBroadcastStrategy(dType string, s IBroadcastStrategy) {
+	if s == nil {
+		tcp.broadcastStrategies.Delete(dType)
+		return
+	}
+	tcp.broadcastStrategies.Store(dType, s)
+}
+
+func (tcp *TCPService) GetBroadcastStrategy(dType string) IBroadcastStrategy {
+	if obj, ok := tcp.broadcastStrategies.Load(dType); ok {
+		return obj.(IBroadcastStrategy)
+	}
+	return nil
+}
+
+type iBroadcastStrategyProvider interface {
+	GetBroadcastStrategy(dType string) IBroadcastStrategy
+}
+
+func (ctx *P2PContext) broadcastStrategy(dType string) IBroadcastStrategy {
+	if provider, ok := ctx._network.(iBroadcastStrategyProvider); ok {
+		return provider.GetBroadcastStrategy(dType)
+	}
+	return nil
+}
@@ -32,6 +32,7 @@ func NewFileSyncProvider() *FileSyncProvider {
 }
 
 func (f *FileSyncProvider) SendSyncRequest(network models.INetwork, ln *node.LocalNode, n *node.RemoteNode) bool {
-	network.Send(n.GetRemoteIP(), n.GetRemotePort(), utils.DiagramToBytes(newFileSyncDiagram(ln)), n.GetID())
+	ip, port := n.GetSendEndpoint(ln, node.ENDPOINT_TCP)
+	network.Send(ip, port, utils.DiagramToBytes(newFileSyncDiagram(ln)), n.GetID())
 	return true
 }
@@ -0,0 +1,114 @@
+package tcp
+
+import (
+	"math/rand"
+
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	// peers a gossiped diagram is sent to by every node
+	GOSSIP_FANOUT = 6
+	// hops a gossiped diagram travels from its origin, 1 reaches the peers of the origin only
+	GOSSIP_TTL = 6
+	// the limits applied to the fanout and ttl of the received diagrams
+	GOSSIP_MAX_FANOUT = 16
+	GOSSIP_MAX_TTL    = 16
+	// the nearby nodes the fanout is picked from at random
+	GOSSIP_CANDIDATES = 64
+)
+
+// Gossip sends diag to GOSSIP_FANOUT random peers, the receivers forward it once a middleware accepts it
+func (ctx *P2PContext) Gossip(diag models.IDiagram) {
+	ctx.GossipWithOptions(diag, GOSSIP_FANOUT, GOSSIP_TTL)
+}
+
+// GossipWithOptions gossips diag to fanout peers per hop for ttl hops
+func (ctx *P2PContext) GossipWithOptions(diag models.IDiagram, fanout int, ttl int) {
+	if fanout <= 0 || ttl <= 0 {
+		return
+	}
+	if !ctx.seenCache().Broadcasted(diag.GetID()) {
+		mLogger.Trace("message %v was gossiped already, not again", diag.GetID())
+		return
+	}
+	envelope := ctx.newEnvelope(diag)
+	envelope.GossipTTL = ttl
+	envelope.GossipFanout = fanout
+	ctx.sendGossip(utils.DiagramToBytes(diag), envelope, ctx.LocalNode().GetID())
+}
+
+// Accept marks the diagram read last by GetDiagram as valid, if it was gossiped it is forwarded after the middlewares
+func (ctx *P2PContext) Accept() {
+	ctx._accepted = ctx._decoded
+}
+
+// ForwardGossip passes an accepted gossiped diagram on to the next hop, called once the middlewares handled it
+func (ctx *P2PContext) ForwardGossip() {
+	if ctx._accepted == nil || ctx._envelope == nil || ctx._envelope.GossipTTL <= 1 {
+		return
+	}
+	received := ctx._envelope
+	if !ctx.seenCache().Broadcasted(received.MessageID) {
+		return
+	}
+	envelope := ctx.newEnvelope(&received.TCPDiagram)
+	envelope.MessageID = received.MessageID
+	envelope.GossipTTL = received.GossipTTL - 1
+	if envelope.GossipTTL > GOSSIP_MAX_TTL {
+		envelope.GossipTTL = GOSSIP_MAX_TTL
+	}
+	envelope.GossipFanout = received.GossipFanout
+	if envelope.GossipFanout > GOSSIP_MAX_FANOUT {
+		envelope.GossipFanout = GOSSIP_MAX_FANOUT
+	}
+	bytes := ctx._resolvedData
+	origin := ""
+	if diag, ok := ctx._accepted.(models.IDiagram); ok {
+		origin = diag.GetNodeID()
+	}
+	// re-encoded so that our hop travels on
+	if traced, ok := ctx._accepted.(models.ITraceable); ok && traced.GetTrace() != nil {
+		bytes = utils.DiagramToBytes(traced)
+	}
+	mLogger.Trace("forwarding gossip %v with ttl %v", received.MessageID, envelope.GossipTTL)
+	ctx.sendGossip(bytes, envelope, received.NodeID, origin)
+}
+
+func (ctx *P2PContext) sendGossip(bytes []byte, envelope MultipartTCPDiagram, excluded ...string) {
+	for _, peer := range ctx.gossipPeers(envelope.GossipFanout, excluded) {
+		ip, port := peer.GetSendEndpoint(ctx._localNode, node.ENDPOINT_TCP)
+		peerID := peer.GetID()
+		ctx.chunkBytes(bytes, envelope, func(chunk []byte) {
+			ctx._network.Send(ip, port, chunk, peerID)
+		})
+	}
+}
+
+// fanout random nearby nodes, without ourselves and the excluded ones
+func (ctx *P2PContext) gossipPeers(fanout int, excluded []string) []*node.RemoteNode {
+	candidates := ctx._nodeProvider.GetNearbyNodes(GOSSIP_CANDIDATES)
+	peers := make([]*node.RemoteNode, 0, fanout)
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(peers) >= fanout {
+			break
+		}
+		peer := candidates[i]
+		if peer.GetID() == ctx._localNode.GetID() || containsString(excluded, peer.GetID()) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -8,14 +8,12 @@ import (
 	"github.com/symphonyprotocol/log"
 	"github.com/symphonyprotocol/p2p/node"
 	"github.com/symphonyprotocol/p2p/models"
-	"time"
 )
 
 var mLogger = log.GetLogger("middleware").SetLevel(log.INFO)
 var TCP_CHUNK_SIZE = 500
 var multipartDiagramMap sync.Map
 var _multipartDiagramPartsMap sync.Map
-var msgBroadcasted sync.Map
 
 type P2PContext struct {
 	_skipped    bool
@@ -24,6 +22,15 @@ type P2PContext struct {
 	_nodeProvider	models.INodeProvider
 	_params 	*TCPCallbackParams
 	_middlewares	[]IMiddleware
+	_middleware	string	// the middleware handling the diagram, for the traces
+	_resolved	bool	// the multipart diagram was resolved, by one of the middlewares
+	_resolvedData	[]byte
+	_resolveErr	error
+	_traced	bool	// our hop of the traced diagram was recorded, by the first middleware reading it
+	_trace	*models.TraceContext	// the trace with our hop, handed to the later readers
+	_envelope	*MultipartTCPDiagram	// the chunk which completed the diagram
+	_decoded	interface{}	// the diagram read last by GetDiagram
+	_accepted	interface{}	// the diagram a middleware accepted for gossip forwarding
 }
 
 func NewP2PContext(network models.INetwork, localNode *node.LocalNode, nodeProvider models.INodeProvider, params *TCPCallbackParams, middlewares []IMiddleware) *P2PContext {
@@ -49,7 +56,12 @@ func (ctx *P2PContext) NewTCPDiagram() *models.TCPDiagram {
 	return tDiag
 }
 
+// Broadcast sends diag to one node per bucket, or hands it to the strategy set for its DType
 func (ctx *P2PContext) Broadcast(diag models.IDiagram) {
+	if strategy := ctx.broadcastStrategy(diag.GetDType()); strategy != nil {
+		strategy.Broadcast(ctx, diag)
+		return
+	}
 	ctx.BroadcastWithFilter(diag, func(p *node.RemoteNode) bool { return true })
 }
 
@@ -62,22 +74,14 @@ func (ctx *P2PContext) BroadcastToNearbyNodes(diag models.IDiagram, maxNodeCount
 }
 
 func (ctx *P2PContext) BroadcastToPeers(diag models.IDiagram, peers []*node.RemoteNode, filter func(_p *node.RemoteNode) bool) {
-	if _msg, _ok := msgBroadcasted.Load(diag.GetID()); _ok {
-		if ts, ok := _msg.(time.Time); ok {
-			if time.Since(ts) < time.Hour {
-				mLogger.Trace("This msg was broadcasted in an hour and we will not broadcast it again.")
-				return 
-			} else {
-				mLogger.Warn("Try to broadcast it again after an hour, this should not happend so much.")
-				msgBroadcasted.Delete(diag.GetID())
-			}
-		}
+	if !ctx.seenCache().Broadcasted(diag.GetID()) {
+		mLogger.Trace("message %v was broadcasted already, not again", diag.GetID())
+		return
 	}
 
 	for _, peer := range peers {
 		if filter == nil || filter(peer) {
 			mLogger.Trace("Broadcasting message %v to peer %v (%v:%v)", diag.GetID(), peer.GetID(), peer.GetRemoteIP().String(), peer.GetRemotePort())
-			msgBroadcasted.Store(diag.GetID(), time.Now())
 			ctx.SendToPeer(diag, peer)
 		} else {
 			mLogger.Trace("Node %v filtered to be excluded when broadcasting", peer.GetID())
@@ -87,34 +91,42 @@ func (ctx *P2PContext) BroadcastToPeers(diag models.IDiagram, peers []*node.Remo
 
 func (ctx *P2PContext) SendToPeer(diag models.IDiagram, peer *node.RemoteNode) {
 	ctx.chunkDiagram(diag, func(bytes []byte) {
-		ctx._network.Send(peer.GetRemoteIP(), peer.GetRemotePort(), bytes, peer.GetID())
+		ip, port := peer.GetSendEndpoint(ctx._localNode, node.ENDPOINT_TCP)
+		ctx._network.Send(ip, port, bytes, peer.GetID())
 	})
 }
 
 func (ctx *P2PContext) chunkDiagram(diag models.IDiagram, callback func([]byte)) {
-	bytes := utils.DiagramToBytes(diag)
+	ctx.chunkBytes(utils.DiagramToBytes(diag), ctx.newEnvelope(diag), callback)
+}
+
+// the header of the chunks carrying diag
+func (ctx *P2PContext) newEnvelope(diag models.IDiagram) MultipartTCPDiagram {
+	tDiag := ctx.NewTCPDiagram()
+	tDiag.ID = utils.NewUUID()		// the chunks share one id
+	tDiag.DCategory = diag.GetDCategory()
+	tDiag.DType = diag.GetDType()
+	return MultipartTCPDiagram{
+		TCPDiagram: *tDiag,
+		MessageID: diag.GetID(),
+	}
+}
+
+func (ctx *P2PContext) chunkBytes(bytes []byte, envelope MultipartTCPDiagram, callback func([]byte)) {
 	lenBytes := len(bytes)
 	chunksCount := lenBytes / TCP_CHUNK_SIZE + 1
-	dId := utils.NewUUID()
 	for i := 0; i < chunksCount; i++ {
-		tDiag := ctx.NewTCPDiagram()
-		tDiag.ID = dId		// use same id for the diagrams
-		tDiag.DCategory = diag.GetDCategory()
-		tDiag.DType = diag.GetDType()
-		
 		end := (i+1) * TCP_CHUNK_SIZE
 		if end > lenBytes {
 			end = lenBytes
 		}
-		mDiag := &MultipartTCPDiagram{
-			TCPDiagram: *tDiag,
-			ChunksCount: chunksCount,
-			ChunkNo: i,
-			RawData: bytes[i * TCP_CHUNK_SIZE: end],
-			ChunkSize: end - (i * TCP_CHUNK_SIZE),
-			ChunkTotalSize: lenBytes,
-		}
-		bytesDiag := utils.DiagramToBytes(mDiag)
+		mDiag := envelope
+		mDiag.ChunksCount = chunksCount
+		mDiag.ChunkNo = i
+		mDiag.RawData = bytes[i * TCP_CHUNK_SIZE: end]
+		mDiag.ChunkSize = end - (i * TCP_CHUNK_SIZE)
+		mDiag.ChunkTotalSize = lenBytes
+		bytesDiag := utils.DiagramToBytes(&mDiag)
 		if callback != nil {
 			callback(bytesDiag)
 			// if err != nil {
@@ -146,6 +158,13 @@ func (ctx *P2PContext) NodeProvider() models.INodeProvider {
 	return ctx._nodeProvider
 }
 
+// WithNodeProvider returns a copy of ctx broadcasting to the nodes of nodeProvider, like the hyparview overlay
+func (ctx *P2PContext) WithNodeProvider(nodeProvider models.INodeProvider) *P2PContext {
+	c := *ctx
+	c._nodeProvider = nodeProvider
+	return &c
+}
+
 func (ctx *P2PContext) Params() *TCPCallbackParams {
 	return ctx._params
 }
@@ -167,29 +186,75 @@ func (ctx *P2PContext) GetDiagram(diagRef interface{}) error {
 	var mDiag MultipartTCPDiagram
 	if err := utils.BytesToUDPDiagram(ctx.Params().Data, &mDiag); err == nil && mDiag.GetChunksCount() > 0 {
 		mLogger.Trace("I got a multipart diagram from %v", ctx.Params().GetRemoteAddr().String())
-		result := ctx.ResolveMultipartDiagram(mDiag)
-		if result != nil {
-			mLogger.Trace("multipart diagram constructed from %v, going to convert it \n%v \nto diagram: %v", 
-				ctx.Params().GetRemoteAddr().String(),
-				result,
-				reflect.TypeOf(diagRef).Elem(),
-			)
-			_err := utils.BytesToUDPDiagram(result, diagRef)
-			if _, _ok := msgBroadcasted.Load(mDiag.GetID()); _ok {
-				mLogger.Warn("Got a message that was broadcasted by me ! drop it")
-				return fmt.Errorf("This message is broadcasted by me !!!, DROP IT")
-			}
-			return _err
-		} else {
-			mLogger.Trace("multipart diagram not ready from %v", ctx.Params().GetRemoteAddr().String())
-			return fmt.Errorf("Diagram is multipart, not done yet")
+		result, err := ctx.resolve(mDiag)
+		if err != nil {
+			return err
+		}
+		mLogger.Trace("multipart diagram constructed from %v, going to convert it \n%v \nto diagram: %v", 
+			ctx.Params().GetRemoteAddr().String(),
+			result,
+			reflect.TypeOf(diagRef).Elem(),
+		)
+		_err := utils.BytesToUDPDiagram(result, diagRef)
+		if _err == nil {
+			ctx._decoded = diagRef
+			ctx.traceReceived(diagRef)
 		}
+		return _err
 	} else {
 		mLogger.Trace("diagram is not multipart")
-		return utils.BytesToUDPDiagram(ctx.Params().Data, diagRef)
+		err := utils.BytesToUDPDiagram(ctx.Params().Data, diagRef)
+		if err == nil {
+			ctx._decoded = diagRef
+			ctx.traceReceived(diagRef)
+		}
+		return err
 	}
 }
 
+// resolve the chunk once per context, the middlewares after the first one get the same result
+func (ctx *P2PContext) resolve(mDiag MultipartTCPDiagram) ([]byte, error) {
+	if ctx._resolved {
+		return ctx._resolvedData, ctx._resolveErr
+	}
+	ctx._resolved = true
+	// no need to buffer the chunks of a copy
+	if mDiag.MessageID != "" && ctx.seenCache().Contains(mDiag.MessageID) {
+		ctx._resolveErr = fmt.Errorf("message %v was seen already", mDiag.MessageID)
+		return nil, ctx._resolveErr
+	}
+	result := ctx.ResolveMultipartDiagram(mDiag)
+	if result == nil {
+		mLogger.Trace("multipart diagram not ready from %v", ctx.Params().GetRemoteAddr().String())
+		ctx._resolveErr = fmt.Errorf("Diagram is multipart, not done yet")
+		return nil, ctx._resolveErr
+	}
+	// the chunks of older nodes don't carry the message id
+	msgID := mDiag.MessageID
+	if msgID == "" {
+		msgID = mDiag.GetID()
+	}
+	if !ctx.seenCache().Received(msgID) {
+		mLogger.Trace("message %v was seen already, drop it", msgID)
+		ctx._resolveErr = fmt.Errorf("message %v was seen already", msgID)
+		return nil, ctx._resolveErr
+	}
+	ctx._resolvedData = result
+	ctx._envelope = &mDiag
+	return result, nil
+}
+
+type iSeenCacheProvider interface {
+	GetSeenCache() *SeenCache
+}
+
+func (ctx *P2PContext) seenCache() *SeenCache {
+	if provider, ok := ctx._network.(iSeenCacheProvider); ok {
+		return provider.GetSeenCache()
+	}
+	return nil
+}
+
 func (ctx *P2PContext) ResolveMultipartDiagram(mDiag MultipartTCPDiagram) []byte {
 	mLogger.Trace(
 		"Resolving multipart diagram, chunkSize: %v, chunkNo: %v, chunkTotalSize: %v, chunkCount: %v", 
@@ -252,6 +317,18 @@ func (ctx *P2PContext) ResolveMultipartDiagram(mDiag MultipartTCPDiagram) []byte
 	return nil
 }
 
+// GetMultipartBacklog returns the multipart diagrams waiting for chunks and the bytes held for them
+func GetMultipartBacklog() (diagrams int, bytes int) {
+	multipartDiagramMap.Range(func(k interface{}, v interface{}) bool {
+		diagrams++
+		if b, ok := v.([]byte); ok {
+			bytes += len(b)
+		}
+		return true
+	})
+	return
+}
+
 type IMiddleware interface {
 	models.IDashboardProvider
 	Handle(*P2PContext)
@@ -11,6 +11,9 @@ type MultipartTCPDiagram struct {
 	ChunksCount	int			// size of chunks
 	RawData		[]byte		// part of a TCP Diagram or just rawData
 	ChunkTotalSize	int		// size of all
+	MessageID	string		// id of the diagram split into the chunks, the chunks have their own
+	GossipTTL	int			// hops the gossiped diagram may still travel, 0 when it is not gossiped
+	GossipFanout	int		// peers each hop forwards the gossiped diagram to
 }
 
 func (m *MultipartTCPDiagram) GetChunkSize() int { return m.ChunkSize }
@@ -0,0 +1,387 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	ptLogger = log.GetLogger("plumtree")
+
+	PLUMTREE_CATEGORY = "plumtree"
+	PLUMTREE_GOSSIP   = "/plumtree/gossip"
+	PLUMTREE_IHAVE    = "/plumtree/ihave"
+	PLUMTREE_GRAFT    = "/plumtree/graft"
+	PLUMTREE_PRUNE    = "/plumtree/prune"
+
+	// the neighbours taken from the node provider, refreshed every PLUMTREE_REFRESH_INTERVAL
+	PLUMTREE_PEERS            = 16
+	PLUMTREE_REFRESH_INTERVAL = 10 * time.Second
+	// the announcements to the lazy peers are batched for this long
+	PLUMTREE_IHAVE_INTERVAL = 500 * time.Millisecond
+	// a message announced but not received in this time is asked for, the next announcer is tried after the retry time
+	PLUMTREE_GRAFT_TIMEOUT = time.Second
+	PLUMTREE_GRAFT_RETRY   = 500 * time.Millisecond
+	// the messages kept to answer grafts
+	PLUMTREE_CACHE_SIZE = 1024
+)
+
+// PlumtreeGossipDiagram carries a broadcasted diagram along the tree
+type PlumtreeGossipDiagram struct {
+	models.TCPDiagram
+	MessageID string
+	// hops from the origin
+	Round   int
+	Payload []byte
+}
+
+// PlumtreeControlDiagram announces (IHAVE) or asks for (GRAFT) messages, or drops the sender from the tree (PRUNE)
+type PlumtreeControlDiagram struct {
+	models.TCPDiagram
+	MessageIDs []string
+}
+
+type plumtreeMissing struct {
+	announcers []string
+	timer      *time.Timer
+}
+
+// Plumtree is a broadcast strategy pushing the diagrams along a spanning tree of eager peers, and only
+// announcing them to the lazy ones. A peer sending a copy is made lazy, a lazy peer announcing a message
+// we miss is made eager again, which repairs the tree.
+type Plumtree struct {
+	tcp          *TCPService
+	localNode    *node.LocalNode
+	nodeProvider models.INodeProvider
+	resolver     INodeResolver
+	ctx          *P2PContext
+
+	mux     sync.Mutex
+	eager   map[string]*node.RemoteNode
+	lazy    map[string]*node.RemoteNode
+	missing map[string]*plumtreeMissing
+	// announcements waiting for the next batch, by lazy peer
+	ihaves map[string][]string
+	// payloads of the recent messages by id, oldest first in cacheOrder
+	cache      map[string]*PlumtreeGossipDiagram
+	cacheOrder []string
+}
+
+func NewPlumtree(tcp *TCPService, localNode *node.LocalNode, nodeProvider models.INodeProvider, resolver INodeResolver) *Plumtree {
+	pt := &Plumtree{
+		tcp:          tcp,
+		localNode:    localNode,
+		nodeProvider: nodeProvider,
+		resolver:     resolver,
+		ctx:          NewP2PContext(tcp, localNode, nodeProvider, nil, nil),
+		eager:        make(map[string]*node.RemoteNode),
+		lazy:         make(map[string]*node.RemoteNode),
+		missing:      make(map[string]*plumtreeMissing),
+		ihaves:       make(map[string][]string),
+		cache:        make(map[string]*PlumtreeGossipDiagram),
+	}
+	tcp.RegisterCallback(PLUMTREE_CATEGORY, pt.callback)
+	return pt
+}
+
+// SetNodeProvider changes where the neighbours come from, use before start
+func (pt *Plumtree) SetNodeProvider(provider models.INodeProvider) {
+	pt.nodeProvider = provider
+}
+
+func (pt *Plumtree) Start() {
+	go pt.loop()
+}
+
+// GetPeers returns the ids of the eager and the lazy peers
+func (pt *Plumtree) GetPeers() (eager []string, lazy []string) {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	for id := range pt.eager {
+		eager = append(eager, id)
+	}
+	for id := range pt.lazy {
+		lazy = append(lazy, id)
+	}
+	return
+}
+
+// Broadcast implements IBroadcastStrategy
+func (pt *Plumtree) Broadcast(ctx *P2PContext, diag models.IDiagram) {
+	if !pt.ctx.seenCache().Broadcasted(diag.GetID()) {
+		ptLogger.Trace("message %v was broadcasted already, not again", diag.GetID())
+		return
+	}
+	tDiag := pt.ctx.NewTCPDiagram()
+	tDiag.DCategory = PLUMTREE_CATEGORY
+	tDiag.DType = PLUMTREE_GOSSIP
+	gossip := &PlumtreeGossipDiagram{TCPDiagram: *tDiag, MessageID: diag.GetID(), Payload: utils.DiagramToBytes(diag)}
+	pt.remember(gossip)
+	pt.push(gossip, "")
+}
+
+func (pt *Plumtree) callback(p models.ICallbackParams) {
+	params, ok := p.(TCPCallbackParams)
+	if !ok {
+		return
+	}
+	go pt.handle(&params)
+}
+
+func (pt *Plumtree) handle(params *TCPCallbackParams) {
+	ctx := NewP2PContext(pt.tcp, pt.localNode, pt.nodeProvider, params, nil)
+	switch params.Diagram.GetDType() {
+	case PLUMTREE_GOSSIP:
+		var diag PlumtreeGossipDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			pt.handleGossip(&diag, params)
+		}
+	case PLUMTREE_IHAVE:
+		var diag PlumtreeControlDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			pt.handleIHave(diag.NodeID, diag.MessageIDs)
+		}
+	case PLUMTREE_GRAFT:
+		var diag PlumtreeControlDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			pt.handleGraft(diag.NodeID, diag.MessageIDs)
+		}
+	case PLUMTREE_PRUNE:
+		var diag PlumtreeControlDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			pt.mux.Lock()
+			pt.makeLazy(diag.NodeID)
+			pt.mux.Unlock()
+		}
+	}
+}
+
+func (pt *Plumtree) handleGossip(diag *PlumtreeGossipDiagram, params *TCPCallbackParams) {
+	sender := diag.NodeID
+	if !pt.ctx.seenCache().Received(diag.MessageID) {
+		// a copy, the sender is not needed in the tree
+		ptLogger.Trace("got %v again from %v, prune it", diag.MessageID, sender)
+		pt.mux.Lock()
+		pt.makeLazy(sender)
+		pt.mux.Unlock()
+		pt.sendControl(PLUMTREE_PRUNE, nil, sender)
+		return
+	}
+	pt.mux.Lock()
+	if m, ok := pt.missing[diag.MessageID]; ok {
+		m.timer.Stop()
+		delete(pt.missing, diag.MessageID)
+	}
+	pt.makeEager(sender)
+	pt.mux.Unlock()
+
+	// a fresh id, the seen cache must not drop the copies before they prune the tree
+	fwd := *diag
+	fwd.ID = utils.NewUUID()
+	fwd.NodeID = pt.localNode.GetID()
+	fwd.Round = diag.Round + 1
+	pt.remember(&fwd)
+	pt.deliver(diag, params)
+	pt.push(&fwd, sender)
+}
+
+// hand the payload to the callback of its category as if it came directly from the sender
+func (pt *Plumtree) deliver(diag *PlumtreeGossipDiagram, params *TCPCallbackParams) {
+	var payload models.TCPDiagram
+	if err := utils.BytesToUDPDiagram(diag.Payload, &payload); err != nil {
+		ptLogger.Warn("drop undecodable message %v: %v", diag.MessageID, err)
+		return
+	}
+	pt.tcp.handle(params.Connection, params.RemoteAddr, payload, diag.Payload)
+}
+
+// eager push to the tree, announce to the lazy peers
+func (pt *Plumtree) push(diag *PlumtreeGossipDiagram, sender string) {
+	pt.mux.Lock()
+	var targets []*node.RemoteNode
+	for id, rnode := range pt.eager {
+		if id != sender {
+			targets = append(targets, rnode)
+		}
+	}
+	for id := range pt.lazy {
+		if id != sender {
+			pt.ihaves[id] = append(pt.ihaves[id], diag.MessageID)
+		}
+	}
+	pt.mux.Unlock()
+	for _, rnode := range targets {
+		pt.ctx.SendToPeer(diag, rnode)
+	}
+}
+
+func (pt *Plumtree) handleIHave(sender string, ids []string) {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	for _, id := range ids {
+		if pt.ctx.seenCache().Contains(id) {
+			continue
+		}
+		m, ok := pt.missing[id]
+		if !ok {
+			m = &plumtreeMissing{}
+			pt.missing[id] = m
+			msgID := id
+			m.timer = time.AfterFunc(PLUMTREE_GRAFT_TIMEOUT, func() { pt.graftMissing(msgID) })
+		}
+		m.announcers = append(m.announcers, sender)
+	}
+}
+
+// the message was announced but didn't come through the tree, get it from an announcer which joins the tree
+func (pt *Plumtree) graftMissing(id string) {
+	pt.mux.Lock()
+	m, ok := pt.missing[id]
+	if !ok {
+		pt.mux.Unlock()
+		return
+	}
+	if len(m.announcers) == 0 {
+		delete(pt.missing, id)
+		pt.mux.Unlock()
+		ptLogger.Debug("message %v is lost, no announcer left", id)
+		return
+	}
+	announcer := m.announcers[0]
+	m.announcers = m.announcers[1:]
+	m.timer = time.AfterFunc(PLUMTREE_GRAFT_RETRY, func() { pt.graftMissing(id) })
+	pt.makeEager(announcer)
+	pt.mux.Unlock()
+	ptLogger.Trace("graft %v for the missing message %v", announcer, id)
+	pt.sendControl(PLUMTREE_GRAFT, []string{id}, announcer)
+}
+
+func (pt *Plumtree) handleGraft(sender string, ids []string) {
+	pt.mux.Lock()
+	pt.makeEager(sender)
+	var found []*PlumtreeGossipDiagram
+	for _, id := range ids {
+		if diag, ok := pt.cache[id]; ok {
+			found = append(found, diag)
+		}
+	}
+	rnode := pt.eager[sender]
+	pt.mux.Unlock()
+	if rnode == nil {
+		return
+	}
+	for _, diag := range found {
+		pt.ctx.SendToPeer(diag, rnode)
+	}
+}
+
+func (pt *Plumtree) remember(diag *PlumtreeGossipDiagram) {
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	if _, ok := pt.cache[diag.MessageID]; ok {
+		return
+	}
+	pt.cache[diag.MessageID] = diag
+	pt.cacheOrder = append(pt.cacheOrder, diag.MessageID)
+	for len(pt.cacheOrder) > PLUMTREE_CACHE_SIZE {
+		delete(pt.cache, pt.cacheOrder[0])
+		pt.cacheOrder = pt.cacheOrder[1:]
+	}
+}
+
+// both need the lock
+func (pt *Plumtree) makeEager(id string) {
+	rnode := pt.lazy[id]
+	if rnode == nil {
+		if _, ok := pt.eager[id]; ok {
+			return
+		}
+		if rnode = pt.resolver.Search(id); rnode == nil {
+			return
+		}
+	}
+	delete(pt.lazy, id)
+	pt.eager[id] = rnode
+}
+
+func (pt *Plumtree) makeLazy(id string) {
+	if rnode, ok := pt.eager[id]; ok {
+		delete(pt.eager, id)
+		pt.lazy[id] = rnode
+	}
+}
+
+func (pt *Plumtree) loop() {
+	lastRefresh := time.Time{}
+	for {
+		if time.Since(lastRefresh) >= PLUMTREE_REFRESH_INTERVAL {
+			pt.refreshPeers()
+			lastRefresh = time.Now()
+		}
+		pt.flushIHaves()
+		time.Sleep(PLUMTREE_IHAVE_INTERVAL)
+	}
+}
+
+// the new neighbours start eager, the ones the provider dropped leave the tree
+func (pt *Plumtree) refreshPeers() {
+	neighbours := make(map[string]*node.RemoteNode)
+	for _, rnode := range pt.nodeProvider.GetNearbyNodes(PLUMTREE_PEERS) {
+		if rnode.GetID() != pt.localNode.GetID() {
+			neighbours[rnode.GetID()] = rnode
+		}
+	}
+	pt.mux.Lock()
+	defer pt.mux.Unlock()
+	for id, rnode := range neighbours {
+		if _, ok := pt.lazy[id]; ok {
+			pt.lazy[id] = rnode
+		} else {
+			pt.eager[id] = rnode
+		}
+	}
+	for id := range pt.eager {
+		if _, ok := neighbours[id]; !ok {
+			delete(pt.eager, id)
+		}
+	}
+	for id := range pt.lazy {
+		if _, ok := neighbours[id]; !ok {
+			delete(pt.lazy, id)
+			delete(pt.ihaves, id)
+		}
+	}
+}
+
+func (pt *Plumtree) flushIHaves() {
+	pt.mux.Lock()
+	batches := pt.ihaves
+	pt.ihaves = make(map[string][]string)
+	pt.mux.Unlock()
+	for id, ids := range batches {
+		pt.sendControl(PLUMTREE_IHAVE, ids, id)
+	}
+}
+
+func (pt *Plumtree) sendControl(dType string, ids []string, nodeID string) {
+	pt.mux.Lock()
+	rnode := pt.eager[nodeID]
+	if rnode == nil {
+		rnode = pt.lazy[nodeID]
+	}
+	pt.mux.Unlock()
+	if rnode == nil {
+		if rnode = pt.resolver.Search(nodeID); rnode == nil {
+			return
+		}
+	}
+	tDiag := pt.ctx.NewTCPDiagram()
+	tDiag.DCategory = PLUMTREE_CATEGORY
+	tDiag.DType = dType
+	pt.ctx.SendToPeer(&PlumtreeControlDiagram{TCPDiagram: *tDiag, MessageIDs: ids}, rnode)
+}
@@ -0,0 +1,481 @@
+package tcp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+)
+
+var (
+	psLogger = log.GetLogger("pubsub")
+
+	PUBSUB_CATEGORY  = "pubsub"
+	PUBSUB_SUBSCRIBE = "/pubsub/subscribe"
+	PUBSUB_GRAFT     = "/pubsub/graft"
+	PUBSUB_PRUNE     = "/pubsub/prune"
+	PUBSUB_MESSAGE   = "/pubsub/message"
+
+	// the peers kept in the mesh of a topic, grafted below the low and pruned above the high watermark
+	PUBSUB_MESH_DEGREE = 6
+	PUBSUB_MESH_LOW    = 4
+	PUBSUB_MESH_HIGH   = 12
+	PUBSUB_HEARTBEAT   = time.Second
+	// the topics are announced to the active nodes this often, peers not heard of for 3 intervals are forgotten
+	PUBSUB_ANNOUNCE_INTERVAL = time.Minute
+	PUBSUB_ANNOUNCE_PEERS    = 32
+	// messages waiting in a subscription, more are dropped
+	PUBSUB_SUBSCRIPTION_BUFFER = 64
+)
+
+// PubSubSubscriptionDiagram announces all the topics the sender is subscribed to
+type PubSubSubscriptionDiagram struct {
+	models.TCPDiagram
+	Topics []string
+}
+
+// PubSubControlDiagram asks the receiver to add (graft) or remove (prune) the sender in the mesh of the topic
+type PubSubControlDiagram struct {
+	models.TCPDiagram
+	Topic string
+}
+
+type PubSubMessageDiagram struct {
+	models.TCPDiagram
+	Topic string
+	// the publisher, NodeID is the peer which passed the message on
+	From string
+	Data []byte
+}
+
+// PubSubMessage is a message delivered to the subscriptions of its topic
+type PubSubMessage struct {
+	ID    string
+	Topic string
+	From  string
+	Data  []byte
+	// the mesh peer we got it from, empty when published here
+	ReceivedFrom string
+}
+
+// Subscription receives the messages of one topic until closed
+type Subscription struct {
+	ps        *PubSub
+	topic     string
+	messages  chan *PubSubMessage
+	dropped   uint64
+	closeOnce sync.Once
+}
+
+func (s *Subscription) Topic() string { return s.topic }
+
+func (s *Subscription) Messages() <-chan *PubSubMessage { return s.messages }
+
+// Dropped returns the messages lost because the subscription was not read fast enough
+func (s *Subscription) Dropped() uint64 { return atomic.LoadUint64(&s.dropped) }
+
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		s.ps.unsubscribe(s)
+	})
+}
+
+type pubsubPeer struct {
+	topics   map[string]bool
+	lastSeen time.Time
+}
+
+// PubSub delivers messages by topic. The subscribers of a topic keep a mesh of other subscribers,
+// a message travels along the meshes only so that the nodes get the topics they subscribed to and nothing else.
+type PubSub struct {
+	tcp       *TCPService
+	localNode *node.LocalNode
+	resolver  INodeResolver
+	ctx       *P2PContext
+
+	mux           sync.Mutex
+	subscriptions map[string][]*Subscription
+	peers         map[string]*pubsubPeer     // the topics of the other nodes, by node id
+	mesh          map[string]map[string]bool // topic -> node ids
+	lastAnnounce  time.Time
+}
+
+func NewPubSub(tcp *TCPService, localNode *node.LocalNode, resolver INodeResolver) *PubSub {
+	ps := &PubSub{
+		tcp:           tcp,
+		localNode:     localNode,
+		resolver:      resolver,
+		ctx:           NewP2PContext(tcp, localNode, nil, nil, nil),
+		subscriptions: make(map[string][]*Subscription),
+		peers:         make(map[string]*pubsubPeer),
+		mesh:          make(map[string]map[string]bool),
+	}
+	tcp.RegisterCallback(PUBSUB_CATEGORY, ps.callback)
+	return ps
+}
+
+func (ps *PubSub) Start() {
+	go ps.loop()
+}
+
+// Subscribe starts receiving the messages of topic, the other subscribers learn it with the next announcement
+func (ps *PubSub) Subscribe(topic string) *Subscription {
+	sub := &Subscription{ps: ps, topic: topic, messages: make(chan *PubSubMessage, PUBSUB_SUBSCRIPTION_BUFFER)}
+	ps.mux.Lock()
+	first := len(ps.subscriptions[topic]) == 0
+	ps.subscriptions[topic] = append(ps.subscriptions[topic], sub)
+	if first {
+		ps.mesh[topic] = make(map[string]bool)
+	}
+	ps.mux.Unlock()
+	if first {
+		psLogger.Debug("subscribed to %v", topic)
+		go func() {
+			ps.announce()
+			ps.rebalance(topic)
+		}()
+	}
+	return sub
+}
+
+func (ps *PubSub) unsubscribe(sub *Subscription) {
+	ps.mux.Lock()
+	subs := ps.subscriptions[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	var pruned []string
+	if len(subs) == 0 {
+		delete(ps.subscriptions, sub.topic)
+		for id := range ps.mesh[sub.topic] {
+			pruned = append(pruned, id)
+		}
+		delete(ps.mesh, sub.topic)
+	} else {
+		ps.subscriptions[sub.topic] = subs
+	}
+	ps.mux.Unlock()
+	close(sub.messages)
+	if len(subs) == 0 {
+		psLogger.Debug("unsubscribed from %v", sub.topic)
+		go func() {
+			for _, id := range pruned {
+				ps.sendControl(PUBSUB_PRUNE, sub.topic, id)
+			}
+			ps.announce()
+		}()
+	}
+}
+
+// GetTopics returns the topics subscribed here
+func (ps *PubSub) GetTopics() []string {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	topics := make([]string, 0, len(ps.subscriptions))
+	for topic := range ps.subscriptions {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// GetMesh returns the mesh peers of a topic subscribed here
+func (ps *PubSub) GetMesh(topic string) []string {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	return keys(ps.mesh[topic])
+}
+
+// GetPeers returns the nodes known to be subscribed to topic
+func (ps *PubSub) GetPeers(topic string) []string {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	var ids []string
+	for id, peer := range ps.peers {
+		if peer.topics[topic] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Publish sends data to the mesh of topic, or to some of its subscribers when we are not one of them
+func (ps *PubSub) Publish(topic string, data []byte) error {
+	tDiag := ps.ctx.NewTCPDiagram()
+	tDiag.DCategory = PUBSUB_CATEGORY
+	tDiag.DType = PUBSUB_MESSAGE
+	diag := &PubSubMessageDiagram{TCPDiagram: *tDiag, Topic: topic, From: ps.localNode.GetID(), Data: data}
+	ps.ctx.seenCache().Broadcasted(diag.ID)
+
+	ps.mux.Lock()
+	targets := keys(ps.mesh[topic])
+	if _, subscribed := ps.mesh[topic]; !subscribed {
+		for id, peer := range ps.peers {
+			if peer.topics[topic] {
+				targets = append(targets, id)
+			}
+		}
+		targets = pickRandom(targets, PUBSUB_MESH_DEGREE)
+	}
+	ps.mux.Unlock()
+
+	ps.deliver(diag, "")
+	if len(targets) == 0 {
+		return fmt.Errorf("no peer is subscribed to %v", topic)
+	}
+	for _, id := range targets {
+		ps.sendTo(diag, id)
+	}
+	return nil
+}
+
+func (ps *PubSub) callback(p models.ICallbackParams) {
+	params, ok := p.(TCPCallbackParams)
+	if !ok {
+		return
+	}
+	go ps.handle(&params)
+}
+
+func (ps *PubSub) handle(params *TCPCallbackParams) {
+	ctx := NewP2PContext(ps.tcp, ps.localNode, nil, params, nil)
+	switch params.Diagram.GetDType() {
+	case PUBSUB_SUBSCRIBE:
+		var diag PubSubSubscriptionDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			ps.handleSubscriptions(diag.NodeID, diag.Topics)
+		}
+	case PUBSUB_GRAFT:
+		var diag PubSubControlDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			ps.handleGraft(diag.NodeID, diag.Topic)
+		}
+	case PUBSUB_PRUNE:
+		var diag PubSubControlDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			ps.mux.Lock()
+			delete(ps.mesh[diag.Topic], diag.NodeID)
+			ps.mux.Unlock()
+		}
+	case PUBSUB_MESSAGE:
+		var diag PubSubMessageDiagram
+		if err := ctx.GetDiagram(&diag); err == nil {
+			ps.handleMessage(&diag)
+		}
+	}
+}
+
+func (ps *PubSub) handleSubscriptions(nodeID string, topics []string) {
+	if nodeID == "" || nodeID == ps.localNode.GetID() {
+		return
+	}
+	ps.mux.Lock()
+	_, known := ps.peers[nodeID]
+	peer := &pubsubPeer{topics: make(map[string]bool), lastSeen: time.Now()}
+	for _, topic := range topics {
+		peer.topics[topic] = true
+	}
+	ps.peers[nodeID] = peer
+	for topic, members := range ps.mesh {
+		if members[nodeID] && !peer.topics[topic] {
+			delete(members, nodeID)
+		}
+	}
+	ps.mux.Unlock()
+	// a new peer gets our topics right away instead of with the next announcement
+	if !known {
+		ps.announceTo(nodeID)
+	}
+}
+
+func (ps *PubSub) handleGraft(nodeID string, topic string) {
+	ps.mux.Lock()
+	members, subscribed := ps.mesh[topic]
+	accepted := subscribed && (members[nodeID] || len(members) < PUBSUB_MESH_HIGH)
+	if accepted {
+		members[nodeID] = true
+		if peer, ok := ps.peers[nodeID]; ok {
+			peer.topics[topic] = true
+		}
+	}
+	ps.mux.Unlock()
+	if !accepted {
+		ps.sendControl(PUBSUB_PRUNE, topic, nodeID)
+	}
+}
+
+// deliver the message here and pass it on to the rest of the mesh
+func (ps *PubSub) handleMessage(diag *PubSubMessageDiagram) {
+	ps.mux.Lock()
+	members, subscribed := ps.mesh[diag.Topic]
+	var targets []string
+	for id := range members {
+		if id != diag.NodeID && id != diag.From {
+			targets = append(targets, id)
+		}
+	}
+	ps.mux.Unlock()
+	if !subscribed {
+		// we are in no mesh of the topic, the sender has an outdated view of us
+		ps.sendControl(PUBSUB_PRUNE, diag.Topic, diag.NodeID)
+		return
+	}
+	ps.deliver(diag, diag.NodeID)
+	if !ps.ctx.seenCache().Broadcasted(diag.ID) {
+		return
+	}
+	fwd := *diag
+	fwd.NodeID = ps.localNode.GetID()
+	for _, id := range targets {
+		ps.sendTo(&fwd, id)
+	}
+}
+
+func (ps *PubSub) deliver(diag *PubSubMessageDiagram, receivedFrom string) {
+	msg := &PubSubMessage{ID: diag.ID, Topic: diag.Topic, From: diag.From, Data: diag.Data, ReceivedFrom: receivedFrom}
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	for _, sub := range ps.subscriptions[diag.Topic] {
+		select {
+		case sub.messages <- msg:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+func (ps *PubSub) loop() {
+	for {
+		ps.expirePeers()
+		if time.Since(ps.lastAnnounce) >= PUBSUB_ANNOUNCE_INTERVAL {
+			ps.announce()
+		}
+		for _, topic := range ps.GetTopics() {
+			ps.rebalance(topic)
+		}
+		time.Sleep(PUBSUB_HEARTBEAT)
+	}
+}
+
+func (ps *PubSub) expirePeers() {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	for id, peer := range ps.peers {
+		if time.Since(peer.lastSeen) > 3*PUBSUB_ANNOUNCE_INTERVAL {
+			delete(ps.peers, id)
+			for _, members := range ps.mesh {
+				delete(members, id)
+			}
+		}
+	}
+}
+
+// graft subscribers when the mesh of topic is too small, prune some when it is too big
+func (ps *PubSub) rebalance(topic string) {
+	var grafts, prunes []string
+	ps.mux.Lock()
+	members, subscribed := ps.mesh[topic]
+	if !subscribed {
+		ps.mux.Unlock()
+		return
+	}
+	if len(members) < PUBSUB_MESH_LOW {
+		var candidates []string
+		for id, peer := range ps.peers {
+			if peer.topics[topic] && !members[id] {
+				candidates = append(candidates, id)
+			}
+		}
+		grafts = pickRandom(candidates, PUBSUB_MESH_DEGREE-len(members))
+		for _, id := range grafts {
+			members[id] = true
+		}
+	} else if len(members) > PUBSUB_MESH_HIGH {
+		prunes = pickRandom(keys(members), len(members)-PUBSUB_MESH_DEGREE)
+		for _, id := range prunes {
+			delete(members, id)
+		}
+	}
+	ps.mux.Unlock()
+	for _, id := range grafts {
+		psLogger.Trace("graft %v into the mesh of %v", id, topic)
+		ps.sendControl(PUBSUB_GRAFT, topic, id)
+	}
+	for _, id := range prunes {
+		psLogger.Trace("prune %v from the mesh of %v", id, topic)
+		ps.sendControl(PUBSUB_PRUNE, topic, id)
+	}
+}
+
+// send our topics to the active nodes and to the peers we know to use pubsub
+func (ps *PubSub) announce() {
+	ps.mux.Lock()
+	ps.lastAnnounce = time.Now()
+	targets := make(map[string]bool)
+	for id := range ps.peers {
+		targets[id] = true
+	}
+	ps.mux.Unlock()
+	for i, rnode := range ps.resolver.GetActiveNodes() {
+		if i >= PUBSUB_ANNOUNCE_PEERS {
+			break
+		}
+		targets[rnode.GetID()] = true
+	}
+	for id := range targets {
+		ps.announceTo(id)
+	}
+}
+
+func (ps *PubSub) announceTo(nodeID string) {
+	tDiag := ps.ctx.NewTCPDiagram()
+	tDiag.DCategory = PUBSUB_CATEGORY
+	tDiag.DType = PUBSUB_SUBSCRIBE
+	ps.sendTo(&PubSubSubscriptionDiagram{TCPDiagram: *tDiag, Topics: ps.GetTopics()}, nodeID)
+}
+
+func (ps *PubSub) sendControl(dType string, topic string, nodeID string) {
+	tDiag := ps.ctx.NewTCPDiagram()
+	tDiag.DCategory = PUBSUB_CATEGORY
+	tDiag.DType = dType
+	ps.sendTo(&PubSubControlDiagram{TCPDiagram: *tDiag, Topic: topic}, nodeID)
+}
+
+func (ps *PubSub) sendTo(diag models.IDiagram, nodeID string) {
+	rnode := ps.resolver.Search(nodeID)
+	if rnode == nil {
+		psLogger.Trace("pubsub peer %v is not known, %v not sent", nodeID, diag.GetDType())
+		return
+	}
+	ps.ctx.SendToPeer(diag, rnode)
+}
+
+func keys(set map[string]bool) []string {
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// n random items of list, all of them when it is shorter
+func pickRandom(list []string, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	picked := make([]string, 0, n)
+	for _, i := range rand.Perm(len(list)) {
+		if len(picked) >= n {
+			break
+		}
+		picked = append(picked, list[i])
+	}
+	return picked
+}
@@ -0,0 +1,455 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/config"
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/utils"
+)
+
+var (
+	rLogger = log.GetLogger("relay")
+
+	RELAY_DIAGRAM_CATEGORY    = "relay"
+	RELAY_DIAGRAM_RESERVE     = "/relay/reserve"
+	RELAY_DIAGRAM_RESERVE_RES = "/relay/reserve_res"
+	RELAY_DIAGRAM_DATA        = "/relay/data"
+
+	// the capability tag of nodes serving as relays
+	RELAY_CAPABILITY = "relay"
+
+	RELAY_MAX_RESERVATIONS     = 32
+	RELAY_MAX_CIRCUITS         = 128
+	RELAY_CIRCUIT_IDLE_TIMEOUT = 2 * time.Minute
+	// relayed diagrams are fragmented so that each wrapped one still fits into a single read
+	RELAY_FRAGMENT_SIZE = 512
+	// a direct connection reads a diagram in a single read of this size, a reassembled one may not be larger
+	RELAY_MAX_DIAGRAM_SIZE = 1280
+	// partial diagrams whose next fragment doesn't come within this time are dropped
+	RELAY_FRAGMENT_TIMEOUT = 30 * time.Second
+
+	RELAY_CLIENT_RESERVATIONS = 2
+	RELAY_CLIENT_INTERVAL     = time.Minute
+)
+
+type RelayDiagram struct {
+	models.TCPDiagram
+	Source  string
+	Target  string
+	Payload []byte
+	More    bool // more fragments of the same diagram follow
+}
+
+type RelayReserveDiagram struct {
+	models.TCPDiagram
+	OK     bool
+	Reason string
+}
+
+// INodeResolver finds the records of nodes, implemented by kad.KTable
+type INodeResolver interface {
+	Search(nodeID string) *node.RemoteNode
+	GetActiveNodes() []*node.RemoteNode
+}
+
+// RelayService carries diagrams between peers which can't dial each other.
+// Public nodes accept reservations, private nodes reserve slots on them and advertise the relays in their record.
+type RelayService struct {
+	tcp       *TCPService
+	localNode *node.LocalNode
+	resolver  INodeResolver
+
+	mux          sync.Mutex
+	reservations map[string]*TCPConnection  // server side, by client node id
+	circuits     map[string]time.Time       // server side, "source>target" -> last used
+	relays       map[string]*TCPConnection  // client side, by relay node id
+	fragments    map[string]*relayFragments // receiving side, by relay connection and source
+}
+
+type relayFragments struct {
+	relayConn *TCPConnection
+	data      []byte
+	updated   time.Time
+}
+
+func NewRelayService(tcp *TCPService, localNode *node.LocalNode, resolver INodeResolver) *RelayService {
+	r := &RelayService{
+		tcp:          tcp,
+		localNode:    localNode,
+		resolver:     resolver,
+		reservations: make(map[string]*TCPConnection),
+		circuits:     make(map[string]time.Time),
+		relays:       make(map[string]*TCPConnection),
+		fragments:    make(map[string]*relayFragments),
+	}
+	tcp.RegisterCallback(RELAY_DIAGRAM_CATEGORY, r.callback)
+	tcp.RegisterDialFallback(r.dialFallback)
+	tcp.closeHooks = append(tcp.closeHooks, r.connectionClosed)
+	return r
+}
+
+func (r *RelayService) Start() {
+	go r.loop()
+}
+
+func (r *RelayService) isServer() bool {
+	return config.RELAY_SERVICE_ENABLED && r.localNode.IsPublic()
+}
+
+// GetStats returns the reservations and circuits served and the relays used
+func (r *RelayService) GetStats() (reservations int, circuits int, relays []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for id := range r.relays {
+		relays = append(relays, id)
+	}
+	return len(r.reservations), len(r.circuits), relays
+}
+
+func (r *RelayService) loop() {
+	for {
+		if r.isServer() {
+			r.localNode.AddCapability(RELAY_CAPABILITY)
+			r.expireCircuits()
+		} else if config.RELAY_CLIENT_ENABLED {
+			r.reserve()
+		}
+		r.expireFragments()
+		time.Sleep(RELAY_CLIENT_INTERVAL)
+	}
+}
+
+func (r *RelayService) expireCircuits() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for key, lastUsed := range r.circuits {
+		if time.Since(lastUsed) > RELAY_CIRCUIT_IDLE_TIMEOUT {
+			delete(r.circuits, key)
+		}
+	}
+}
+
+func (r *RelayService) expireFragments() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for key, f := range r.fragments {
+		if time.Since(f.updated) > RELAY_FRAGMENT_TIMEOUT {
+			delete(r.fragments, key)
+		}
+	}
+}
+
+// keep RELAY_CLIENT_RESERVATIONS reservations on relays found in the table
+func (r *RelayService) reserve() {
+	r.mux.Lock()
+	missing := RELAY_CLIENT_RESERVATIONS - len(r.relays)
+	used := make(map[string]bool)
+	for id := range r.relays {
+		used[id] = true
+	}
+	r.mux.Unlock()
+
+	for _, rnode := range r.resolver.GetActiveNodes() {
+		if missing <= 0 {
+			break
+		}
+		record := rnode.GetRecord()
+		if record == nil || !record.HasCapability(RELAY_CAPABILITY) || used[rnode.GetID()] {
+			continue
+		}
+		ip, port := rnode.GetSendEndpoint(r.localNode, node.ENDPOINT_TCP)
+		conn, err := r.tcp.getConnection(ip, port, rnode.GetID(), false)
+		if err != nil {
+			continue
+		}
+		conn.WriteBytes(utils.DiagramToBytes(r.newReserveDiagram(RELAY_DIAGRAM_RESERVE, true, "")))
+		rLogger.Debug("asking %v for a relay reservation", rnode.GetID())
+		missing--
+	}
+}
+
+func (r *RelayService) callback(p models.ICallbackParams) {
+	params, ok := p.(TCPCallbackParams)
+	if !ok {
+		return
+	}
+	switch params.Diagram.GetDType() {
+	case RELAY_DIAGRAM_RESERVE:
+		r.handleReserve(params.Connection)
+	case RELAY_DIAGRAM_RESERVE_RES:
+		var res RelayReserveDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &res); err == nil {
+			r.handleReserveResult(res, params.Connection)
+		}
+	case RELAY_DIAGRAM_DATA:
+		var diag RelayDiagram
+		if err := utils.BytesToUDPDiagram(params.Data, &diag); err == nil {
+			if diag.Target == r.localNode.GetID() {
+				r.deliver(diag, params.Connection)
+			} else {
+				r.forward(diag, params.Connection)
+			}
+		}
+	}
+}
+
+func (r *RelayService) handleReserve(conn *TCPConnection) {
+	ok, reason := true, ""
+	r.mux.Lock()
+	if !r.isServer() {
+		ok, reason = false, "not a relay"
+	} else if _, exists := r.reservations[conn.nodeId]; !exists && len(r.reservations) >= RELAY_MAX_RESERVATIONS {
+		ok, reason = false, "relay is full"
+	} else {
+		r.reservations[conn.nodeId] = conn
+	}
+	r.mux.Unlock()
+	rLogger.Debug("reservation of %v: %v %v", conn.nodeId, ok, reason)
+	conn.WriteBytes(utils.DiagramToBytes(r.newReserveDiagram(RELAY_DIAGRAM_RESERVE_RES, ok, reason)))
+}
+
+func (r *RelayService) handleReserveResult(res RelayReserveDiagram, conn *TCPConnection) {
+	if !res.OK {
+		rLogger.Debug("relay %v refused the reservation: %v", res.NodeID, res.Reason)
+		return
+	}
+	r.mux.Lock()
+	r.relays[res.NodeID] = conn
+	relays := make([]string, 0, len(r.relays))
+	for id := range r.relays {
+		relays = append(relays, id)
+	}
+	r.mux.Unlock()
+	r.localNode.SetRelays(relays)
+	rLogger.Info("got a relay reservation on %v", res.NodeID)
+}
+
+// relay side, pass the diagram on to the target if it has a reservation or a connection with us
+func (r *RelayService) forward(diag RelayDiagram, from *TCPConnection) {
+	if !r.isServer() || diag.Source != from.nodeId {
+		return
+	}
+	key := diag.Source + ">" + diag.Target
+	r.mux.Lock()
+	if _, ok := r.circuits[key]; !ok && len(r.circuits) >= RELAY_MAX_CIRCUITS {
+		r.mux.Unlock()
+		rLogger.Warn("relay circuits exhausted, drop %v", key)
+		return
+	}
+	r.circuits[key] = time.Now()
+	target, ok := r.reservations[diag.Target]
+	r.mux.Unlock()
+	if !ok {
+		if target = r.tcp.GetConnectionByNodeID(diag.Target); target == nil {
+			rLogger.Debug("relay target %v is not connected", diag.Target)
+			return
+		}
+	}
+
+	fwd := r.newRelayDiagram(diag.Source, diag.Target, diag.Payload, diag.More)
+	target.WriteBytes(utils.DiagramToBytes(fwd))
+}
+
+// receiving side, reassemble the fragments and dispatch them as if they came from a direct connection
+func (r *RelayService) deliver(diag RelayDiagram, relayConn *TCPConnection) {
+	key := fmt.Sprintf("%p/%v", relayConn, diag.Source)
+	r.mux.Lock()
+	f, ok := r.fragments[key]
+	if !ok {
+		f = &relayFragments{relayConn: relayConn}
+	}
+	f.data = append(f.data, diag.Payload...)
+	f.updated = time.Now()
+	if len(f.data) > RELAY_MAX_DIAGRAM_SIZE {
+		delete(r.fragments, key)
+		r.mux.Unlock()
+		rLogger.Warn("relayed diagram from %v over %v bytes, drop it", diag.Source, RELAY_MAX_DIAGRAM_SIZE)
+		return
+	}
+	if diag.More {
+		r.fragments[key] = f
+		r.mux.Unlock()
+		return
+	}
+	delete(r.fragments, key)
+	r.mux.Unlock()
+	data := f.data
+
+	conn := r.tcp.GetConnectionByNodeID(diag.Source)
+	if conn == nil || conn.relayID != relayConn.nodeId {
+		conn = r.openCircuit(relayConn, diag.Source)
+	}
+	r.tcp.dispatch(conn, conn.RemoteAddr(), data)
+}
+
+// used by the tcp service when dialing a node fails, go through one of the relays in its record
+func (r *RelayService) dialFallback(ip net.IP, port int, nodeId string) (*TCPConnection, error) {
+	target := r.resolver.Search(nodeId)
+	if target == nil || target.GetRecord() == nil || len(target.GetRecord().Relays) == 0 {
+		return nil, fmt.Errorf("node %v has no relay", nodeId)
+	}
+	for _, relayID := range target.GetRecord().Relays {
+		relay := r.resolver.Search(relayID)
+		if relay == nil {
+			continue
+		}
+		relayIP, relayPort := relay.GetSendEndpoint(r.localNode, node.ENDPOINT_TCP)
+		relayConn, err := r.tcp.getConnection(relayIP, relayPort, relayID, false)
+		if err != nil {
+			continue
+		}
+		rLogger.Debug("connecting to %v through relay %v", nodeId, relayID)
+		return r.openCircuit(relayConn, nodeId), nil
+	}
+	return nil, fmt.Errorf("none of the relays of %v is reachable", nodeId)
+}
+
+// a virtual connection whose writes are wrapped and sent through the relay connection
+func (r *RelayService) openCircuit(relayConn *TCPConnection, peerID string) *TCPConnection {
+	circuit := &relayedConn{
+		service:   r,
+		relayConn: relayConn,
+		peerID:    peerID,
+		closed:    make(chan struct{}),
+	}
+	conn := NewTCPConnection(circuit, relayConn.isInbound)
+	conn.nodeId = peerID
+	conn.relayID = relayConn.nodeId
+	key := circuit.RemoteAddr().String()
+	r.tcp.connections.Store(key, conn)
+	r.tcp.connectionOpened(conn)
+	go r.tcp.handleSendEvent(conn, key)
+	return conn
+}
+
+// drop reservations and circuits when the underlying connection is gone
+func (r *RelayService) connectionClosed(conn *TCPConnection) {
+	r.mux.Lock()
+	for id, c := range r.reservations {
+		if c == conn {
+			delete(r.reservations, id)
+		}
+	}
+	relaysChanged := false
+	for id, c := range r.relays {
+		if c == conn {
+			delete(r.relays, id)
+			relaysChanged = true
+		}
+	}
+	relays := make([]string, 0, len(r.relays))
+	for id := range r.relays {
+		relays = append(relays, id)
+	}
+	for key, f := range r.fragments {
+		if f.relayConn == conn {
+			delete(r.fragments, key)
+		}
+	}
+	r.mux.Unlock()
+	if relaysChanged {
+		r.localNode.SetRelays(relays)
+	}
+
+	if conn.relayID != "" {
+		return
+	}
+	r.tcp.connections.Range(func(k interface{}, v interface{}) bool {
+		if c, ok := v.(*TCPConnection); ok {
+			if circuit, ok := c.Conn.(*relayedConn); ok && circuit.relayConn == conn {
+				go func() { c.stop <- struct{}{} }()
+			}
+		}
+		return true
+	})
+}
+
+func (r *RelayService) newRelayDiagram(source string, target string, payload []byte, more bool) *RelayDiagram {
+	tDiag := models.NewTCPDiagram()
+	tDiag.NodeID = r.localNode.GetID()
+	tDiag.DCategory = RELAY_DIAGRAM_CATEGORY
+	tDiag.DType = RELAY_DIAGRAM_DATA
+	tDiag.Timestamp = time.Now().Unix()
+	return &RelayDiagram{
+		TCPDiagram: *tDiag,
+		Source:     source,
+		Target:     target,
+		Payload:    payload,
+		More:       more,
+	}
+}
+
+func (r *RelayService) newReserveDiagram(dType string, ok bool, reason string) *RelayReserveDiagram {
+	tDiag := models.NewTCPDiagram()
+	tDiag.NodeID = r.localNode.GetID()
+	tDiag.DCategory = RELAY_DIAGRAM_CATEGORY
+	tDiag.DType = dType
+	tDiag.Timestamp = time.Now().Unix()
+	return &RelayReserveDiagram{
+		TCPDiagram: *tDiag,
+		OK:         ok,
+		Reason:     reason,
+	}
+}
+
+type relayAddr struct {
+	relayID string
+	peerID  string
+}
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return "relay/" + a.relayID + "/" + a.peerID }
+
+// relayedConn implements net.Conn on top of a relay connection, reads are dispatched by the relay service
+type relayedConn struct {
+	service   *RelayService
+	relayConn *TCPConnection
+	peerID    string
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *relayedConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, fmt.Errorf("relayed connection closed")
+}
+
+func (c *relayedConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, fmt.Errorf("relayed connection closed")
+	default:
+	}
+	for start := 0; start < len(b); start += RELAY_FRAGMENT_SIZE {
+		end := start + RELAY_FRAGMENT_SIZE
+		if end > len(b) {
+			end = len(b)
+		}
+		diag := c.service.newRelayDiagram(c.service.localNode.GetID(), c.peerID, b[start:end], end < len(b))
+		c.relayConn.WriteBytes(utils.DiagramToBytes(diag))
+	}
+	return len(b), nil
+}
+
+func (c *relayedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *relayedConn) LocalAddr() net.Addr {
+	return relayAddr{relayID: c.relayConn.nodeId, peerID: c.service.localNode.GetID()}
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return relayAddr{relayID: c.relayConn.nodeId, peerID: c.peerID}
+}
+
+func (c *relayedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *relayedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *relayedConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,95 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/capture"
+)
+
+// SetSink hands the diagrams sent to sink instead of the network, the replies to the injected ones
+// included. Nothing is dialed then, it is for a replay. Use before start.
+func (tcp *TCPService) SetSink(sink capture.Sink) {
+	tcp.sink = sink
+}
+
+// Inject dispatches recorded bytes as if they were just read from the connection of peer.
+// The replies written to the connection go to the sink, they are discarded without one.
+func (tcp *TCPService) Inject(data []byte, peer string, nodeID string) error {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", peer)
+	if err != nil {
+		return err
+	}
+	conn := tcp.getReplayConnection(remoteAddr, nodeID)
+	rdata := make([]byte, len(data))
+	copy(rdata, data)
+	tcp.dispatch(conn, remoteAddr, rdata)
+	return nil
+}
+
+// one virtual connection per replayed peer, kept out of the connections so that sending isn't affected
+func (tcp *TCPService) getReplayConnection(remoteAddr *net.TCPAddr, nodeID string) *TCPConnection {
+	key := remoteAddr.String()
+	if obj, ok := tcp.replays.Load(key); ok {
+		return obj.(*TCPConnection)
+	}
+	conn := NewTCPConnection(&replayConn{
+		remoteAddr: remoteAddr,
+		localAddr:  &net.TCPAddr{IP: tcp.ip, Port: tcp.port},
+		nodeID:     nodeID,
+		sink:       tcp.sink,
+		closed:     make(chan struct{}),
+	}, true)
+	conn.nodeId = nodeID
+	if obj, loaded := tcp.replays.LoadOrStore(key, conn); loaded {
+		return obj.(*TCPConnection)
+	}
+	go tcp.drainReplay(conn)
+	return conn
+}
+
+func (tcp *TCPService) drainReplay(conn *TCPConnection) {
+	for {
+		select {
+		case <-conn.stop:
+			return
+		case bytes := <-conn.writeQueue:
+			conn.Write(bytes)
+		}
+	}
+}
+
+// replayConn implements net.Conn for the injected diagrams, nothing is read from or written to the network
+type replayConn struct {
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	nodeID     string
+	sink       capture.Sink
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, fmt.Errorf("replayed connection closed")
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	if c.sink != nil {
+		c.sink(capture.TRANSPORT_TCP, c.remoteAddr, c.nodeID, b)
+	}
+	return len(b), nil
+}
+
+func (c *replayConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *replayConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,9 @@
+//go:build linux && (386 || amd64 || arm)
+// +build linux
+// +build 386 amd64 arm
+
+package tcp
+
+// the syscall package has no SO_REUSEPORT on these architectures, the others take it from there
+// as its value differs, e.g. on mips
+const soReusePort = 0xf
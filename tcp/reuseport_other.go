@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package tcp
+
+import (
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error { return nil }
+
+// without SO_REUSEPORT the dialer can't bind the listening port, no simultaneous open
+func supportsReusePort() bool { return false }
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd || (linux && !386 && !amd64 && !arm)
+// +build darwin freebsd linux,!386,!amd64,!arm
+
+package tcp
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
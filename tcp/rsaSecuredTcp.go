@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"crypto/rand"
 	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/ratelimit"
 )
 
 type RSASecuredTCPService struct {
@@ -15,8 +16,11 @@ func NewRSASecuredTCPService(n *node.LocalNode) *RSASecuredTCPService {
 	tcpService := &TCPService{
 		localNodeId: n.GetID(),
 		ip:          n.GetLocalIP(),
-		port:        n.GetLocalPort(),
+		port:        n.GetTCPPort(),
 		tcpDialer:   &SecuredTCPDialer{},
+		limiter:     ratelimit.NewLimiter(ratelimit.DEFAULT_TCP_POLICY),
+		events:      n.Events(),
+		seen:        NewSeenCache(SEEN_CACHE_SIZE, SEEN_CACHE_TTL),
 	}
 
 	rsaService := &RSASecuredTCPService{
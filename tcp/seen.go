@@ -0,0 +1,137 @@
+package tcp
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+var (
+	// the messages remembered at most, the least recently seen are forgotten first
+	SEEN_CACHE_SIZE = 65536
+	// a message not seen again for this long is forgotten, a copy arriving later is handled again
+	SEEN_CACHE_TTL = 10 * time.Minute
+)
+
+type seenEntry struct {
+	id          string
+	lastSeen    time.Time
+	broadcasted bool
+}
+
+// SeenCache remembers the ids of the messages received and broadcasted recently, bounded in size and time.
+// The ids are the ones of the application diagrams, not of the chunks carrying them.
+type SeenCache struct {
+	mux     sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// front is the most recently seen
+	order *list.List
+}
+
+func NewSeenCache(size int, ttl time.Duration) *SeenCache {
+	return &SeenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Received records a received message, false if it was received or broadcasted before
+func (c *SeenCache) Received(id string) bool {
+	if c == nil {
+		return true
+	}
+	_, isNew := c.touch(id)
+	return isNew
+}
+
+// Broadcasted records that we broadcast a message, false if we did already.
+// A message we received can still be broadcasted once, that's how it is relayed.
+func (c *SeenCache) Broadcasted(id string) bool {
+	if c == nil {
+		return true
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, _ := c.touchLocked(id)
+	if entry.broadcasted {
+		return false
+	}
+	entry.broadcasted = true
+	return true
+}
+
+// Contains checks a message without refreshing it
+func (c *SeenCache) Contains(id string) bool {
+	if c == nil {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.prune(time.Now())
+	_, ok := c.entries[id]
+	return ok
+}
+
+// Clear forgets every message, a replay would drop the ones it replayed before
+func (c *SeenCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func (c *SeenCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.prune(time.Now())
+	return c.order.Len()
+}
+
+func (c *SeenCache) touch(id string) (*seenEntry, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.touchLocked(id)
+}
+
+// refresh the entry of id or add it, true if it was added
+func (c *SeenCache) touchLocked(id string) (*seenEntry, bool) {
+	now := time.Now()
+	c.prune(now)
+	if elem, ok := c.entries[id]; ok {
+		entry := elem.Value.(*seenEntry)
+		entry.lastSeen = now
+		c.order.MoveToFront(elem)
+		return entry, false
+	}
+	entry := &seenEntry{id: id, lastSeen: now}
+	c.entries[id] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return entry, true
+}
+
+// drop the expired entries, they are all at the back
+func (c *SeenCache) prune(now time.Time) {
+	for elem := c.order.Back(); elem != nil; elem = c.order.Back() {
+		if now.Sub(elem.Value.(*seenEntry).lastSeen) < c.ttl {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+func (c *SeenCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*seenEntry).id)
+}
@@ -4,12 +4,18 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 
 	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/capture"
+	"github.com/symphonyprotocol/p2p/events"
+	"github.com/symphonyprotocol/p2p/metrics"
 	"github.com/symphonyprotocol/p2p/node"
 
 	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/ratelimit"
+	"github.com/symphonyprotocol/p2p/trace"
 	"github.com/symphonyprotocol/p2p/utils"
 	"time"
 )
@@ -23,12 +29,17 @@ type TCPConnection struct {
 	nodeId    string // to be filled when confirmed.
 	lastActiveTime	time.Time
 	writeQueue	chan []byte
+	relayID	string	// set when the connection is a circuit through a relay
+	closeReason	string
 }
 
 func (t TCPConnection) GetIsInBound() bool { return t.isInbound }
 func (t TCPConnection) GetNodeID() string { return t.nodeId }
 func (t TCPConnection) GetLastActiveTime() time.Time { return t.lastActiveTime }
 func (t TCPConnection) WriteBytes(bytes []byte) { t.writeQueue <- bytes }
+func (t TCPConnection) GetRelayID() string { return t.relayID }
+func (t TCPConnection) GetIsRelayed() bool { return t.relayID != "" }
+func (t TCPConnection) GetWriteQueueLen() int { return len(t.writeQueue) }
 
 type TCPCallbackParams struct {
 	models.CallbackParams
@@ -82,19 +93,35 @@ type TCPService struct {
 	port        int
 
 	callbacks sync.Map
-	newConnectionHander	func(*TCPConnection)
-	connectionDroppedHandler	func(*TCPConnection)
+	newConnectionHandlers	[]func(*TCPConnection)
+	connectionDroppedHandlers	[]func(*TCPConnection)
+	dialFallbacks	[]DialFallback
+	closeHooks	[]func(*TCPConnection)
+	limiter	*ratelimit.Limiter
+	events	*events.Bus
+	tracer	*trace.Collector
+	recorder	*capture.Recorder
+	seen	*SeenCache	// the messages received and broadcasted, shared by the contexts of this service
+	replays	sync.Map	// map[string]*TCPConnection, the virtual connections of Inject
+	sink	capture.Sink	// takes the diagrams sent in place of the network, when replaying
+	broadcastStrategies	sync.Map	// map[string]IBroadcastStrategy, by DType
 }
 
+// DialFallback is tried in order when dialing a node directly fails, e.g. hole punching
+type DialFallback func(ip net.IP, port int, nodeId string) (*TCPConnection, error)
+
 func NewTCPService(localNode *node.LocalNode) *TCPService {
 	service := &TCPService{
 		localNodeId: localNode.GetID(),
 		ip:          localNode.GetLocalIP(),
-		port:        localNode.GetLocalPort(),
+		port:        localNode.GetTCPPort(),
 		tcpDialer:   &TCPDialer{},
+		limiter:     ratelimit.NewLimiter(ratelimit.DEFAULT_TCP_POLICY),
+		events:      localNode.Events(),
+		seen:        NewSeenCache(SEEN_CACHE_SIZE, SEEN_CACHE_TTL),
 	}
 
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: service.ip, Port: service.port})
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localNode.GetListenIP(), Port: service.port})
 	if err != nil {
 		panic(err)
 	}
@@ -105,7 +132,7 @@ func NewTCPService(localNode *node.LocalNode) *TCPService {
 }
 
 func (tcp *TCPService) getConnectionKey(ip net.IP, port int) string {
-	return fmt.Sprintf("%v:%v", ip.String(), port)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
 }
 
 func (tcp *TCPService) loop() {
@@ -133,9 +160,7 @@ func (tcp *TCPService) loop() {
 		tcpLogger.Trace("Accepting incoming connection with key: %v", the_key)
 		the_conn := NewTCPConnection(conn, true)
 		tcp.connections.Store(the_key, the_conn)
-		if tcp.newConnectionHander != nil {
-			tcp.newConnectionHander(the_conn)
-		}
+		tcp.connectionOpened(the_conn)
 		go tcp.handleConnection(the_conn, the_key)
 		go tcp.handleSendEvent(the_conn, the_key)
 	}
@@ -149,9 +174,19 @@ LOOP_CONN_SEND:
 			tcpLogger.Trace("TCP Connection to %v quit by signal", conn.RemoteAddr().String())
 			// 2. close this connection
 			conn.Close()
-			if tcp.connectionDroppedHandler != nil {
-				tcp.connectionDroppedHandler(conn)
+			for _, handler := range tcp.connectionDroppedHandlers {
+				handler(conn)
+			}
+			for _, hook := range tcp.closeHooks {
+				hook(conn)
 			}
+			tcp.events.Publish(&events.ConnectionClosed{
+				NodeID:     conn.nodeId,
+				RemoteAddr: conn.RemoteAddr().String(),
+				IsInbound:  conn.isInbound,
+				IsRelayed:  conn.GetIsRelayed(),
+				Reason:     conn.closeReason,
+			})
 			// 3. remove from map
 			tcp.connections.Delete(key)
 			break LOOP_CONN_SEND
@@ -160,6 +195,14 @@ LOOP_CONN_SEND:
 			_, err := conn.Write(bytes)
 			if err != nil {
 				tcpLogger.Error("conn: write: %s", err)
+				continue
+			}
+			tcp.recorder.Record(capture.TRANSPORT_TCP, capture.DIRECTION_OUT, conn.RemoteAddr(), conn.nodeId, bytes)
+			if metrics.Enabled() {
+				var diagram models.TCPDiagram
+				if utils.BytesToUDPDiagram(bytes, &diagram) == nil {
+					metrics.CountMessage(metrics.DIRECTION_OUT, metrics.TRANSPORT_TCP, diagram.DCategory, diagram.DType, len(bytes))
+				}
 			}
 		}
 	}
@@ -180,31 +223,19 @@ func (tcp *TCPService) handleConnection(conn *TCPConnection, key string) {
 			n, err := conn.Read(data)
 			if err != nil {
 				tcpLogger.Error("conn: read: %s", err)
+				if conn.closeReason == "" {
+					conn.closeReason = err.Error()
+				}
 				quit = true
 			} else {
-
 				remoteAddr := conn.RemoteAddr()
-				remoteAddrStr := remoteAddr.String()
-				tcpAddr, _ := net.ResolveTCPAddr(remoteAddr.Network(), remoteAddrStr)
-				rdata := data[:n]
-				var diagram models.TCPDiagram
-				utils.BytesToUDPDiagram(rdata, &diagram)
-				tcpLogger.Trace("conn: received: %v bytes from %v, diagram id is: %v", n, remoteAddrStr, diagram.GetID())
-
-				// update nodeID for the connection.
-				conn.nodeId = diagram.NodeID
-				conn.lastActiveTime = time.Now()
-				if obj, ok := tcp.callbacks.Load(diagram.DCategory); ok {
-					callback := obj.(func(models.ICallbackParams))
-					callback(TCPCallbackParams{
-						CallbackParams: models.CallbackParams{
-							RemoteAddr: tcpAddr,
-							Diagram:    diagram,
-							Data:       rdata,
-						},
-						Connection: conn,
-					})
+				tcpAddr, _ := net.ResolveTCPAddr(remoteAddr.Network(), remoteAddr.String())
+				// a flooding peer is dropped before its diagrams reach the middlewares
+				if tcpAddr != nil && !tcp.limiter.AllowIP(tcpAddr.IP) {
+					tcp.dropped("", tcpAddr.IP.String(), "rate limited")
+					continue
 				}
+				tcp.dispatch(conn, tcpAddr, data[:n])
 			}
 		}
 
@@ -216,7 +247,54 @@ func (tcp *TCPService) handleConnection(conn *TCPConnection, key string) {
 	}
 }
 
+// hand one received diagram to the callback of its category
+func (tcp *TCPService) dispatch(conn *TCPConnection, remoteAddr net.Addr, rdata []byte) {
+	tcp.recorder.Record(capture.TRANSPORT_TCP, capture.DIRECTION_IN, remoteAddr, conn.nodeId, rdata)
+	var diagram models.TCPDiagram
+	utils.BytesToUDPDiagram(rdata, &diagram)
+	tcpLogger.Trace("conn: received: %v bytes from %v, diagram id is: %v", len(rdata), conn.RemoteAddr().String(), diagram.GetID())
+
+	var ip net.IP
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok && tcpAddr != nil {
+		ip = tcpAddr.IP
+	}
+	if !tcp.limiter.AllowDiagram(ip, diagram.NodeID, diagram.DCategory) {
+		tcp.dropped(diagram.DCategory, diagram.NodeID, "rate limited")
+		return
+	}
+
+	// update nodeID for the connection.
+	conn.nodeId = diagram.NodeID
+	conn.lastActiveTime = time.Now()
+	// only the categories we handle are counted, the labels of the others come from the wire
+	if tcp.handle(conn, remoteAddr, diagram, rdata) {
+		metrics.CountMessage(metrics.DIRECTION_IN, metrics.TRANSPORT_TCP, diagram.DCategory, diagram.DType, len(rdata))
+	}
+}
+
+// pass a diagram to the callback of its category, false if there is none
+func (tcp *TCPService) handle(conn *TCPConnection, remoteAddr net.Addr, diagram models.TCPDiagram, rdata []byte) bool {
+	if obj, ok := tcp.callbacks.Load(diagram.DCategory); ok {
+		callback := obj.(func(models.ICallbackParams))
+		callback(TCPCallbackParams{
+			CallbackParams: models.CallbackParams{
+				RemoteAddr: remoteAddr,
+				Diagram:    diagram,
+				Data:       rdata,
+			},
+			Connection: conn,
+		})
+		return true
+	}
+	return false
+}
+
 func (tcp *TCPService) GetConnection(ip net.IP, port int, nodeId string) (*TCPConnection, error) {
+	return tcp.getConnection(ip, port, nodeId, true)
+}
+
+// without fallbacks only an existing connection or a direct dial is used
+func (tcp *TCPService) getConnection(ip net.IP, port int, nodeId string, useFallbacks bool) (*TCPConnection, error) {
 	the_key := tcp.getConnectionKey(ip, port)
 	// 1. check if connection in map
 	if _conn, ok := tcp.connections.Load(the_key); ok {
@@ -251,24 +329,108 @@ func (tcp *TCPService) GetConnection(ip net.IP, port int, nodeId string) (*TCPCo
 		return the_conn, nil
 	}
 
+	if tcp.sink != nil {
+		return nil, fmt.Errorf("replaying, %v:%v is not dialed", ip, port)
+	}
+
 	// 2. create new connection
 	// localIP := &net.TCPAddr{ IP: tcp.ip, Port: tcp.port }
 	conn, err := tcp.tcpDialer.DialRemoteServer(ip, port)
+	if err != nil && useFallbacks {
+		for _, fallback := range tcp.dialFallbacks {
+			if fConn, fErr := fallback(ip, port, nodeId); fErr == nil {
+				metrics.CountDial(metrics.DIAL_FALLBACK)
+				return fConn, nil
+			} else {
+				tcpLogger.Debug("dial fallback to %v failed: %v", nodeId, fErr)
+			}
+		}
+	}
 	if err != nil {
+		metrics.CountDial(metrics.DIAL_FAILURE)
 		return nil, err
 	}
+	metrics.CountDial(metrics.DIAL_SUCCESS)
 
 	// 3. add connection to map
 	the_conn = NewTCPConnection(conn, false)
 	tcp.connections.Store(the_key, the_conn)
 
 	// 4. start connection listener
+	tcp.connectionOpened(the_conn)
 	go tcp.handleConnection(the_conn, the_key)
 	go tcp.handleSendEvent(the_conn, the_key)
 
 	return the_conn, nil
 }
 
+// AdoptConnection takes over a connection which was not opened by the listener or the dialer
+func (tcp *TCPService) AdoptConnection(conn net.Conn, isInbound bool, nodeId string) *TCPConnection {
+	tcpAddr, _ := net.ResolveTCPAddr(conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+	the_key := tcp.getConnectionKey(tcpAddr.IP, tcpAddr.Port)
+	the_conn := NewTCPConnection(conn, isInbound)
+	the_conn.nodeId = nodeId
+	tcp.connections.Store(the_key, the_conn)
+	tcp.connectionOpened(the_conn)
+	go tcp.handleConnection(the_conn, the_key)
+	go tcp.handleSendEvent(the_conn, the_key)
+	return the_conn
+}
+
+// GetConnectionByNodeID returns nil if there is no open connection to the node
+func (tcp *TCPService) GetConnectionByNodeID(nodeId string) *TCPConnection {
+	var the_conn *TCPConnection
+	tcp.connections.Range(func(k interface{}, v interface{}) bool {
+		if conn, ok := v.(*TCPConnection); ok && conn.nodeId == nodeId {
+			the_conn = conn
+			return false
+		}
+		return true
+	})
+	return the_conn
+}
+
+// Disconnect closes the connection to the node, false if there is none
+func (tcp *TCPService) Disconnect(nodeId string) bool {
+	conn := tcp.GetConnectionByNodeID(nodeId)
+	if conn == nil {
+		return false
+	}
+	// the failing read stops the connection and runs the drop handlers
+	conn.closeReason = "disconnected locally"
+	conn.Close()
+	if conn.GetIsRelayed() {
+		// nothing reads from a relayed circuit, stop it as connectionClosed does
+		go func() { conn.stop <- struct{}{} }()
+	}
+	return true
+}
+
+// GetSeenCache returns the cache deduplicating the messages of this service
+func (tcp *TCPService) GetSeenCache() *SeenCache {
+	return tcp.seen
+}
+
+// SetRecorder writes every diagram sent and received to the capture, use before start
+func (tcp *TCPService) SetRecorder(r *capture.Recorder) {
+	tcp.recorder = r
+}
+
+// SetRateLimiter replaces the limiter, use before start
+func (tcp *TCPService) SetRateLimiter(l *ratelimit.Limiter) {
+	tcp.limiter = l
+}
+
+func (tcp *TCPService) GetRateLimiter() *ratelimit.Limiter {
+	return tcp.limiter
+}
+
+func (tcp *TCPService) RegisterDialFallback(f DialFallback) {
+	if f != nil {
+		tcp.dialFallbacks = append(tcp.dialFallbacks, f)
+	}
+}
+
 func (tcp *TCPService) closeConnection(ip net.IP, port int) {
 	key := tcp.getConnectionKey(ip, port)
 	if _conn, ok := tcp.connections.Load(key); ok {
@@ -291,6 +453,10 @@ func (c *TCPService) RemoveCallback(category string) {
 }
 
 func (c *TCPService) Send(ip net.IP, port int, bytes []byte, nodeId string) {
+	if c.sink != nil {
+		c.sink(capture.TRANSPORT_TCP, &net.TCPAddr{IP: ip, Port: port}, nodeId, bytes)
+		return
+	}
 	conn, err := c.GetConnection(ip, port, nodeId)
 	if err != nil {
 		tcpLogger.Error("Failed to send packet (%d) to %v:%v", len(bytes), ip.String(), port)
@@ -317,16 +483,35 @@ func (tcp *TCPDialer) DialRemoteServer(ip net.IP, port int) (net.Conn, error) {
 	return conn, nil
 }
 
+// RegisterAcceptConnectionEvent adds a handler of new connections, use before start.
+// Subscribe to the events of the local node to watch the connections from elsewhere.
 func (tcp *TCPService) RegisterAcceptConnectionEvent(f func (*TCPConnection)) {
 	if f != nil {
-		tcp.newConnectionHander = f
+		tcp.newConnectionHandlers = append(tcp.newConnectionHandlers, f)
 	}
 }
 
+// RegisterDropConnectionEvent adds a handler of closed connections, use before start
 func (tcp *TCPService) RegisterDropConnectionEvent(f func (*TCPConnection)) {
 	if f != nil {
-		tcp.connectionDroppedHandler = f
+		tcp.connectionDroppedHandlers = append(tcp.connectionDroppedHandlers, f)
+	}
+}
+
+func (tcp *TCPService) connectionOpened(conn *TCPConnection) {
+	for _, handler := range tcp.newConnectionHandlers {
+		handler(conn)
 	}
+	tcp.events.Publish(&events.ConnectionOpened{
+		NodeID:     conn.nodeId,
+		RemoteAddr: conn.RemoteAddr().String(),
+		IsInbound:  conn.isInbound,
+		IsRelayed:  conn.GetIsRelayed(),
+	})
+}
+
+func (tcp *TCPService) dropped(category string, from string, reason string) {
+	tcp.events.Publish(&events.MessageDropped{Transport: "tcp", Category: category, From: from, Reason: reason})
 }
 
 func (tcp *TCPService) GetTCPConnections() []*TCPConnection {
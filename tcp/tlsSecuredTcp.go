@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/tls"
@@ -10,16 +11,22 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/symphonyprotocol/log"
 	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/ratelimit"
 )
 
-var sTcpLogger = log.GetLogger("TLSSecuredTcp")
+var (
+	sTcpLogger                = log.GetLogger("TLSSecuredTcp")
+	SIMULTANEOUS_OPEN_TIMEOUT = 5 * time.Second
+)
 
 type TLSSecuredTCPService struct {
 	*TCPService
+	tlsConfig *tls.Config
 }
 
 type SecuredTCPDialer struct {
@@ -30,8 +37,11 @@ func NewTLSSecuredTCPService(n *node.LocalNode) *TLSSecuredTCPService {
 	tcpService := &TCPService{
 		localNodeId: n.GetID(),
 		ip:          n.GetLocalIP(),
-		port:        n.GetLocalPort(),
+		port:        n.GetTCPPort(),
 		tcpDialer:   &SecuredTCPDialer{},
+		limiter:     ratelimit.NewLimiter(ratelimit.DEFAULT_TCP_POLICY),
+		events:      n.Events(),
+		seen:        NewSeenCache(SEEN_CACHE_SIZE, SEEN_CACHE_TTL),
 	}
 
 	service := &TLSSecuredTCPService{TCPService: tcpService}
@@ -41,13 +51,16 @@ func NewTLSSecuredTCPService(n *node.LocalNode) *TLSSecuredTCPService {
 		sTcpLogger.Fatal("%v", err)
 	}
 	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cer}}
+	service.tlsConfig = tlsCfg
 
-	listener, err := tls.Listen("tcp", fmt.Sprintf("%v:%v", n.GetLocalIP().String(), n.GetLocalPort()), tlsCfg)
+	listenAddr := &net.TCPAddr{IP: n.GetListenIP(), Port: n.GetTCPPort()}
+	listenCfg := &net.ListenConfig{Control: reusePortControl}
+	listener, err := listenCfg.Listen(context.Background(), "tcp", listenAddr.String())
 	if err != nil {
 		panic(err)
 	}
 
-	service.listener = listener
+	service.listener = tls.NewListener(listener, tlsCfg)
 
 	return service
 }
@@ -85,7 +98,7 @@ func (tcp *TLSSecuredTCPService) genPriv(pri *ecdsa.PrivateKey) string {
 }
 
 func (tcp *SecuredTCPDialer) DialRemoteServer(ip net.IP, port int) (net.Conn, error) {
-	conn, err := tls.DialWithDialer(&net.Dialer{KeepAlive: time.Minute, Timeout: 30 * time.Second}, "tcp", fmt.Sprintf("%v:%v", ip.String(), port), &tls.Config{InsecureSkipVerify: true})
+	conn, err := tls.DialWithDialer(&net.Dialer{KeepAlive: time.Minute, Timeout: 30 * time.Second}, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
 	if err != nil {
 		sTcpLogger.Error("Failed to open secured tcp connection to %v:%v, error: %v", ip.String(), port, err)
 		return nil, err
@@ -93,3 +106,46 @@ func (tcp *SecuredTCPDialer) DialRemoteServer(ip net.IP, port int) (net.Conn, er
 
 	return conn, nil
 }
+
+// Probe checks that a tls server accepts connections at ip:port, the connection is closed right away.
+// Dialed from a fresh port, so a NAT only letting in the peers we talked to fails it.
+func (tcp *TLSSecuredTCPService) Probe(ip net.IP, port int, timeout time.Duration) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// DialSimultaneous dials from the listening port so that both sides of a hole punch
+// open their NAT for each other. The TLS roles are decided by the caller since both sides are dialing.
+func (tcp *TLSSecuredTCPService) DialSimultaneous(ip net.IP, port int, nodeId string, isServer bool) (*TCPConnection, error) {
+	if !supportsReusePort() {
+		return nil, fmt.Errorf("simultaneous open is not supported on this platform")
+	}
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: tcp.port},
+		Control:   reusePortControl,
+		Timeout:   SIMULTANEOUS_OPEN_TIMEOUT,
+		KeepAlive: time.Minute,
+	}
+	rawConn, err := dialer.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *tls.Conn
+	if isServer {
+		conn = tls.Server(rawConn, tcp.tlsConfig)
+	} else {
+		conn = tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true})
+	}
+	conn.SetDeadline(time.Now().Add(SIMULTANEOUS_OPEN_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sTcpLogger.Debug("simultaneous open to %v:%v succeeded, tls server: %v", ip.String(), port, isServer)
+	return tcp.AdoptConnection(conn, isServer, nodeId), nil
+}
@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"reflect"
+
+	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/node"
+	"github.com/symphonyprotocol/p2p/trace"
+)
+
+var (
+	TRACE_CATEGORY = "TRACE"
+	TRACE_REPORT   = "/trace/report"
+)
+
+// TraceReportDiagram carries the path of a traced message back to the origin of the trace
+type TraceReportDiagram struct {
+	models.TCPDiagram
+	MessageID string
+	Path      *models.TraceContext
+}
+
+// SetTraceCollector records the traces of the messages received here and the reports sent to us, use before start
+func (tcp *TCPService) SetTraceCollector(c *trace.Collector) {
+	tcp.tracer = c
+	tcp.RegisterCallback(TRACE_CATEGORY, func(p models.ICallbackParams) {
+		params, ok := p.(TCPCallbackParams)
+		if !ok {
+			return
+		}
+		ctx := NewP2PContext(tcp, nil, nil, &params, nil)
+		var report TraceReportDiagram
+		if err := ctx.GetDiagram(&report); err == nil && report.Path != nil {
+			c.Record(report.MessageID, report.Path)
+		}
+	})
+}
+
+func (tcp *TCPService) GetTraceCollector() *trace.Collector {
+	return tcp.tracer
+}
+
+type iTraceCollectorProvider interface {
+	GetTraceCollector() *trace.Collector
+}
+
+func (ctx *P2PContext) traceCollector() *trace.Collector {
+	if provider, ok := ctx._network.(iTraceCollectorProvider); ok {
+		return provider.GetTraceCollector()
+	}
+	return nil
+}
+
+// SetCurrentMiddleware names the middleware in the hops of the traced diagrams it reads
+func (ctx *P2PContext) SetCurrentMiddleware(m IMiddleware) {
+	if m == nil {
+		ctx._middleware = ""
+		return
+	}
+	t := reflect.TypeOf(m)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ctx._middleware = t.Name()
+}
+
+// StartTrace makes the nodes receiving diag record their hops, report sends them back to us.
+// Pass a pointer to the diagram before it is sent.
+func (ctx *P2PContext) StartTrace(diag models.ITraceable, report bool) *models.TraceContext {
+	t := models.NewTraceContext(ctx._localNode.GetID(), report)
+	diag.SetTrace(t)
+	if c := ctx.traceCollector(); c != nil {
+		c.Record(diag.GetID(), t)
+	}
+	return t
+}
+
+// append our hop to a traced diagram which was just read, it travels on if the diagram is forwarded.
+// Every middleware reads the diagram, the hop is recorded and reported once per context.
+func (ctx *P2PContext) traceReceived(diagRef interface{}) {
+	diag, ok := diagRef.(models.ITraceable)
+	if !ok || diag.GetTrace() == nil || ctx._localNode == nil {
+		return
+	}
+	if ctx._traced {
+		diag.SetTrace(ctx._trace)
+		return
+	}
+	ctx._traced = true
+	t := diag.GetTrace()
+	ctx._trace = t
+	t.AddHop(ctx._localNode.GetID(), ctx._middleware)
+	if c := ctx.traceCollector(); c != nil {
+		c.Record(diag.GetID(), t)
+	}
+	if !t.Report || t.Origin == ctx._localNode.GetID() {
+		return
+	}
+	origin := ctx.searchNode(t.Origin)
+	if origin == nil {
+		mLogger.Trace("origin %v of trace %v is not known, the hop is not reported", t.Origin, t.TraceID)
+		return
+	}
+	tDiag := ctx.NewTCPDiagram()
+	tDiag.DCategory = TRACE_CATEGORY
+	tDiag.DType = TRACE_REPORT
+	ctx.SendToPeer(&TraceReportDiagram{TCPDiagram: *tDiag, MessageID: diag.GetID(), Path: t.Copy()}, origin)
+}
+
+type iNodeSearcher interface {
+	Search(nodeID string) *node.RemoteNode
+}
+
+func (ctx *P2PContext) searchNode(nodeID string) *node.RemoteNode {
+	if searcher, ok := ctx._nodeProvider.(iNodeSearcher); ok {
+		return searcher.Search(nodeID)
+	}
+	return nil
+}
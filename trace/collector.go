@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/symphonyprotocol/p2p/models"
+)
+
+var (
+	// traced messages kept by a collector, the oldest is forgotten first
+	MAX_TRACES = 1024
+)
+
+// hop of a message as seen by the collector, the earliest arrival at a node decides its parent
+type hop struct {
+	models.TraceHop
+	parent string
+	// later arrivals of the message at this node, e.g. from other peers
+	duplicates int
+}
+
+type messageTrace struct {
+	messageID string
+	traceID   string
+	origin    string
+	hops      map[string]*hop
+	updated   time.Time
+}
+
+// Collector merges the paths of traced messages, received locally or reported by other nodes, into propagation trees
+type Collector struct {
+	mux    sync.Mutex
+	traces map[string]*messageTrace
+}
+
+func NewCollector() *Collector {
+	return &Collector{traces: make(map[string]*messageTrace)}
+}
+
+// Record takes the path a message went along to reach the last hop of the trace
+func (c *Collector) Record(messageID string, t *models.TraceContext) {
+	if t == nil || len(t.Hops) == 0 {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	mt, ok := c.traces[messageID]
+	if !ok {
+		if len(c.traces) >= MAX_TRACES {
+			c.evictOldest()
+		}
+		mt = &messageTrace{messageID: messageID, traceID: t.TraceID, origin: t.Origin, hops: make(map[string]*hop)}
+		c.traces[messageID] = mt
+	}
+	mt.updated = time.Now()
+	for i, h := range t.Hops {
+		parent := ""
+		if i > 0 {
+			parent = t.Hops[i-1].NodeID
+		}
+		existing, ok := mt.hops[h.NodeID]
+		if !ok {
+			mt.hops[h.NodeID] = &hop{TraceHop: h, parent: parent}
+			continue
+		}
+		if existing.parent == parent && existing.Time == h.Time {
+			// the same hop reported again as part of a longer path
+			continue
+		}
+		if i == len(t.Hops)-1 {
+			existing.duplicates++
+		}
+		if h.Time < existing.Time && parent != "" {
+			existing.TraceHop, existing.parent = h, parent
+		}
+	}
+}
+
+func (c *Collector) evictOldest() {
+	var oldest *messageTrace
+	for _, mt := range c.traces {
+		if oldest == nil || mt.updated.Before(oldest.updated) {
+			oldest = mt
+		}
+	}
+	if oldest != nil {
+		delete(c.traces, oldest.messageID)
+	}
+}
+
+// GetMessageIDs returns the traced messages, the latest first
+func (c *Collector) GetMessageIDs() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	traces := make([]*messageTrace, 0, len(c.traces))
+	for _, mt := range c.traces {
+		traces = append(traces, mt)
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].updated.After(traces[j].updated) })
+	ids := make([]string, 0, len(traces))
+	for _, mt := range traces {
+		ids = append(ids, mt.messageID)
+	}
+	return ids
+}
+
+// TreeNode is a node the message reached, Delay is the time since its parent had it
+type TreeNode struct {
+	NodeID     string      `json:"nodeId"`
+	Middleware string      `json:"middleware,omitempty"`
+	Time       time.Time   `json:"time"`
+	Delay      string      `json:"delay,omitempty"`
+	Duplicates int         `json:"duplicates,omitempty"`
+	Children   []*TreeNode `json:"children,omitempty"`
+}
+
+// Tree is the propagation tree of one message
+type Tree struct {
+	MessageID string    `json:"messageId"`
+	TraceID   string    `json:"traceId"`
+	Root      *TreeNode `json:"root"`
+	// the nodes reached, the root included
+	Reached int `json:"reached"`
+	// nodes whose parent never reported, their subtrees hang here
+	Orphans []*TreeNode `json:"orphans,omitempty"`
+}
+
+// GetTree returns nil if the message was not traced
+func (c *Collector) GetTree(messageID string) *Tree {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	mt, ok := c.traces[messageID]
+	if !ok {
+		return nil
+	}
+	nodes := make(map[string]*TreeNode)
+	for id, h := range mt.hops {
+		nodes[id] = &TreeNode{NodeID: id, Middleware: h.Middleware, Time: h.GetTime(), Duplicates: h.duplicates}
+	}
+	tree := &Tree{MessageID: messageID, TraceID: mt.traceID, Reached: len(nodes)}
+	// sorted so that the children are ordered by arrival
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return mt.hops[ids[i]].Time < mt.hops[ids[j]].Time })
+	for _, id := range ids {
+		h, n := mt.hops[id], nodes[id]
+		if id == mt.origin {
+			tree.Root = n
+			continue
+		}
+		parent, ok := nodes[h.parent]
+		if !ok {
+			tree.Orphans = append(tree.Orphans, n)
+			continue
+		}
+		n.Delay = n.Time.Sub(parent.Time).String()
+		parent.Children = append(parent.Children, n)
+	}
+	return tree
+}
+
+// ExportJSON writes the tree of the message as json
+func (c *Collector) ExportJSON(messageID string, w io.Writer) error {
+	tree := c.GetTree(messageID)
+	if tree == nil {
+		return ErrUnknownMessage
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(tree)
+}
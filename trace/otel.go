@@ -0,0 +1,159 @@
+package trace
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrUnknownMessage = errors.New("the message was not traced")
+
+	// the service.name of the exported spans
+	OTEL_SERVICE_NAME = "symphony-p2p"
+)
+
+// the OTLP/JSON layout, as written by the file exporter of the OpenTelemetry collector
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+const (
+	spanKindProducer = 4
+	spanKindConsumer = 5
+)
+
+func stringAttr(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int) otlpAttribute {
+	v := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &v}}
+}
+
+// span ids are derived from the trace and the node, so that every node computes the same ones
+func spanID(traceID string, nodeID string) string {
+	sum := sha256.Sum256([]byte(traceID + "/" + nodeID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// one span per hop, from the arrival at the parent to the arrival at the node
+func (t *Tree) spans() []otlpSpan {
+	traceID := t.TraceID
+	if len(traceID) != 32 {
+		sum := sha256.Sum256([]byte(t.TraceID))
+		traceID = hex.EncodeToString(sum[:16])
+	}
+	spans := make([]otlpSpan, 0, t.Reached)
+	var walk func(n *TreeNode, parent *TreeNode)
+	walk = func(n *TreeNode, parent *TreeNode) {
+		span := otlpSpan{
+			TraceID:         traceID,
+			SpanID:          spanID(t.TraceID, n.NodeID),
+			Name:            "p2p.receive",
+			Kind:            spanKindConsumer,
+			EndTimeUnixNano: strconv.FormatInt(n.Time.UnixNano(), 10),
+			Attributes: []otlpAttribute{
+				stringAttr("p2p.node_id", n.NodeID),
+				stringAttr("p2p.message_id", t.MessageID),
+				intAttr("p2p.duplicates", n.Duplicates),
+			},
+		}
+		if n.Middleware != "" {
+			span.Attributes = append(span.Attributes, stringAttr("p2p.middleware", n.Middleware))
+		}
+		switch {
+		case parent != nil:
+			span.ParentSpanID = spanID(t.TraceID, parent.NodeID)
+			span.StartTimeUnixNano = strconv.FormatInt(parent.Time.UnixNano(), 10)
+		case n == t.Root:
+			span.Name = "p2p.send"
+			span.Kind = spanKindProducer
+			span.StartTimeUnixNano = span.EndTimeUnixNano
+		default:
+			// an orphan, the viewers show it as a separate root
+			span.StartTimeUnixNano = span.EndTimeUnixNano
+		}
+		spans = append(spans, span)
+		for _, child := range n.Children {
+			walk(child, n)
+		}
+	}
+	if t.Root != nil {
+		walk(t.Root, nil)
+	}
+	for _, orphan := range t.Orphans {
+		walk(orphan, nil)
+	}
+	return spans
+}
+
+// ExportSpans appends the tree of the message to the file as one line of OTLP/JSON,
+// which the OpenTelemetry collector's otlpjsonfile receiver can read
+func (c *Collector) ExportSpans(messageID string, path string) error {
+	tree := c.GetTree(messageID)
+	if tree == nil {
+		return ErrUnknownMessage
+	}
+	export := otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttr("service.name", OTEL_SERVICE_NAME)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/symphonyprotocol/p2p/trace"},
+			Spans: tree.spans(),
+		}},
+	}}}
+	data, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,161 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/symphonyprotocol/p2p/models"
+)
+
+var (
+	// packets waiting per category, more are dropped
+	UDP_QUEUE_SIZE = 256
+	// callbacks of one category run on this many goroutines
+	UDP_WORKERS_PER_CATEGORY = 4
+	// categories whose callbacks must not run concurrently, the ktable was written for a single reader
+	UDP_CATEGORY_WORKERS = map[string]int{
+		"KTABKE": 1,
+	}
+)
+
+// the read buffers are pooled, a packet owns its buffer until the callback returns
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, UDP_READ_BUFFER_SIZE)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if len(*buf) != UDP_READ_BUFFER_SIZE {
+		// the size was changed after the pool was filled
+		b := make([]byte, UDP_READ_BUFFER_SIZE)
+		buf = &b
+	}
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
+
+type packet struct {
+	buf        *[]byte
+	n          int
+	remoteAddr *net.UDPAddr
+	diagram    models.UDPDiagram
+}
+
+// UDPStats counts the packets of one category
+type UDPStats struct {
+	Received uint64
+	Handled  uint64
+	// the queue of the category was full
+	Dropped uint64
+	// the callback panicked
+	Failed uint64
+}
+
+type categoryStats struct {
+	received uint64
+	handled  uint64
+	dropped  uint64
+	failed   uint64
+}
+
+func (s *categoryStats) snapshot() UDPStats {
+	return UDPStats{
+		Received: atomic.LoadUint64(&s.received),
+		Handled:  atomic.LoadUint64(&s.handled),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Failed:   atomic.LoadUint64(&s.failed),
+	}
+}
+
+// dispatcher runs the callback of one category on a bounded worker pool,
+// so that a slow category can't stall the others
+type dispatcher struct {
+	category string
+	callback func(models.ICallbackParams)
+	queue    chan *packet
+	quit     chan struct{}
+	stats    *categoryStats
+}
+
+func newDispatcher(category string, callback func(models.ICallbackParams), stats *categoryStats) *dispatcher {
+	d := &dispatcher{
+		category: category,
+		callback: callback,
+		queue:    make(chan *packet, UDP_QUEUE_SIZE),
+		quit:     make(chan struct{}),
+		stats:    stats,
+	}
+	workers := UDP_WORKERS_PER_CATEGORY
+	if n, ok := UDP_CATEGORY_WORKERS[category]; ok {
+		workers = n
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// returns false if the packet is dropped, the caller keeps the buffer then
+func (d *dispatcher) enqueue(p *packet) bool {
+	atomic.AddUint64(&d.stats.received, 1)
+	select {
+	case <-d.quit:
+		return false
+	default:
+	}
+	select {
+	case d.queue <- p:
+		return true
+	default:
+		atomic.AddUint64(&d.stats.dropped, 1)
+		return false
+	}
+}
+
+func (d *dispatcher) work() {
+	for {
+		select {
+		case <-d.quit:
+			// release what is left, nobody else reads the queue
+			for {
+				select {
+				case p := <-d.queue:
+					putBuffer(p.buf)
+				default:
+					return
+				}
+			}
+		case p := <-d.queue:
+			d.handle(p)
+		}
+	}
+}
+
+func (d *dispatcher) handle(p *packet) {
+	defer putBuffer(p.buf)
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddUint64(&d.stats.failed, 1)
+			logger.Error("udp callback of %v failed on a packet from %v: %v", d.category, p.remoteAddr, err)
+		}
+	}()
+	d.callback(models.UDPCallbackParams{
+		CallbackParams: models.CallbackParams{
+			RemoteAddr: p.remoteAddr,
+			Diagram:    p.diagram,
+			Data:       (*p.buf)[:p.n],
+		},
+	})
+	atomic.AddUint64(&d.stats.handled, 1)
+}
+
+func (d *dispatcher) stop() {
+	close(d.quit)
+}
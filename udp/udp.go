@@ -1,22 +1,62 @@
 package udp
 
 import (
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/capture"
+	"github.com/symphonyprotocol/p2p/events"
+	"github.com/symphonyprotocol/p2p/metrics"
 	"github.com/symphonyprotocol/p2p/models"
+	"github.com/symphonyprotocol/p2p/ratelimit"
 	"github.com/symphonyprotocol/p2p/utils"
 )
 
-var logger = log.GetLogger("udp")
+var (
+	logger = log.GetLogger("udp")
+	// the largest payload we send, the ipv6 minimum MTU of 1280 without the ipv6 and udp headers,
+	// so that packets are never fragmented. Bigger messages must be split by their senders.
+	MAX_UDP_PAYLOAD = 1232
+	// bigger than MAX_UDP_PAYLOAD to still take packets of older nodes, a full buffer means truncated
+	UDP_READ_BUFFER_SIZE = 8192
+)
+
+type PayloadTooLargeError struct {
+	Size int
+}
+
+func (e PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("udp payload of %v bytes exceeds the limit of %v bytes", e.Size, MAX_UDP_PAYLOAD)
+}
+
+// CheckPayload fails if data can't be sent in one packet
+func CheckPayload(data []byte) error {
+	if len(data) > MAX_UDP_PAYLOAD {
+		return PayloadTooLargeError{Size: len(data)}
+	}
+	return nil
+}
 
 type UDPService struct {
 	listener    *net.UDPConn
 	localNodeID string
 	port        int
 	ip          net.IP
-	callbacks   sync.Map
+	callbacks   sync.Map // map[string]*dispatcher
+	stats       sync.Map // map[string]*categoryStats
+	// packets which could not be decoded or have no callback
+	malformed uint64
+	unhandled uint64
+	// packets refused at send time for exceeding MAX_UDP_PAYLOAD
+	oversized uint64
+	limiter   *ratelimit.Limiter
+	events    *events.Bus
+	recorder  *capture.Recorder
+	// takes the packets sent in place of the network, when replaying
+	sink capture.Sink
 }
 
 func NewUDPService(localNodeID string, ip net.IP, port int) *UDPService {
@@ -24,6 +64,7 @@ func NewUDPService(localNodeID string, ip net.IP, port int) *UDPService {
 		localNodeID: localNodeID,
 		port:        port,
 		ip:          ip,
+		limiter:     ratelimit.NewLimiter(ratelimit.DEFAULT_UDP_POLICY),
 	}
 	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
 	if err != nil {
@@ -33,50 +74,188 @@ func NewUDPService(localNodeID string, ip net.IP, port int) *UDPService {
 	return client
 }
 
+// RegisterCallback runs the callback on the worker pool of the category.
+// The data passed to the callback is reused once it returns, copy it to keep it.
 func (c *UDPService) RegisterCallback(category string, callback func(models.ICallbackParams)) {
-	c.callbacks.Store(category, callback)
+	obj, _ := c.stats.LoadOrStore(category, &categoryStats{})
+	if old, loaded := c.callbacks.Load(category); loaded {
+		old.(*dispatcher).stop()
+	}
+	c.callbacks.Store(category, newDispatcher(category, callback, obj.(*categoryStats)))
 }
 
 func (c *UDPService) RemoveCallback(category string) {
-	c.callbacks.Delete(category)
+	if obj, ok := c.callbacks.Load(category); ok {
+		c.callbacks.Delete(category)
+		obj.(*dispatcher).stop()
+	}
+}
+
+// GetStats returns the packet counters by category
+func (c *UDPService) GetStats() map[string]UDPStats {
+	res := make(map[string]UDPStats)
+	c.stats.Range(func(k interface{}, v interface{}) bool {
+		res[k.(string)] = v.(*categoryStats).snapshot()
+		return true
+	})
+	return res
+}
+
+// GetDropped returns the packets dropped because a category was overloaded
+func (c *UDPService) GetDropped() uint64 {
+	var dropped uint64
+	for _, stats := range c.GetStats() {
+		dropped += stats.Dropped
+	}
+	return dropped
+}
+
+// GetUnhandled returns the packets which could not be decoded or had no callback
+func (c *UDPService) GetUnhandled() (malformed uint64, unhandled uint64) {
+	return atomic.LoadUint64(&c.malformed), atomic.LoadUint64(&c.unhandled)
+}
+
+// SetRateLimiter replaces the limiter, use before start
+func (c *UDPService) SetRateLimiter(l *ratelimit.Limiter) {
+	c.limiter = l
+}
+
+func (c *UDPService) GetRateLimiter() *ratelimit.Limiter {
+	return c.limiter
+}
+
+// SetEventBus publishes the dropped packets on the bus, use before start
+func (c *UDPService) SetEventBus(bus *events.Bus) {
+	c.events = bus
+}
+
+// SetRecorder writes every packet sent and received to the capture, use before start
+func (c *UDPService) SetRecorder(r *capture.Recorder) {
+	c.recorder = r
+}
+
+// SetSink hands the packets sent to sink instead of the network, for a replay. Use before start.
+func (c *UDPService) SetSink(sink capture.Sink) {
+	c.sink = sink
+}
+
+func (c *UDPService) dropped(category string, from *net.UDPAddr, reason string) {
+	c.events.Publish(&events.MessageDropped{Transport: "udp", Category: category, From: from.String(), Reason: reason})
+}
+
+// GetOversized returns the packets refused at send time for exceeding MAX_UDP_PAYLOAD
+func (c *UDPService) GetOversized() uint64 {
+	return atomic.LoadUint64(&c.oversized)
 }
 
 func (c *UDPService) loop() {
 	logger.Trace("start listenning udp...")
-	data := make([]byte, 1280)
 	for {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Trace("UPDServer loop err:%v", err)
-			}
-		}()
-		n, remoteAddr, err := c.listener.ReadFromUDP(data)
+		buf := getBuffer()
+		n, remoteAddr, err := c.listener.ReadFromUDP(*buf)
 		if err != nil {
+			putBuffer(buf)
 			logger.Error("error during read: %v", err)
+			continue
 		}
-		rdata := data[:n]
-		var diagram models.UDPDiagram
-		utils.BytesToUDPDiagram(rdata, &diagram)
-		if obj, ok := c.callbacks.Load(diagram.DCategory); ok {
-			callback := obj.(func(models.ICallbackParams))
-			callback(models.UDPCallbackParams{
-				CallbackParams: models.CallbackParams{
-					RemoteAddr: remoteAddr,
-					Diagram:    diagram,
-					Data:       rdata,
-				},
-			})
+		c.recorder.Record(capture.TRANSPORT_UDP, capture.DIRECTION_IN, remoteAddr, "", (*buf)[:n])
+		// drop floods before spending any time on decoding
+		if !c.limiter.AllowIP(remoteAddr.IP) {
+			putBuffer(buf)
+			c.dropped("", remoteAddr, "rate limited")
+			continue
+		}
+		if n == len(*buf) {
+			putBuffer(buf)
+			atomic.AddUint64(&c.malformed, 1)
+			c.dropped("", remoteAddr, "truncated")
+			logger.Warn("drop truncated packet from %v", remoteAddr)
+			continue
 		}
+		if !c.dispatch(buf, n, remoteAddr) {
+			putBuffer(buf)
+		}
+	}
+}
+
+// hand the packet to the worker pool of its category, false if the buffer wasn't taken
+func (c *UDPService) dispatch(buf *[]byte, n int, remoteAddr *net.UDPAddr) (taken bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddUint64(&c.malformed, 1)
+			logger.Trace("drop malformed packet from %v: %v", remoteAddr, err)
+			c.dropped("", remoteAddr, "malformed")
+			taken = false
+		}
+	}()
+	var diagram models.UDPDiagram
+	if err := utils.BytesToUDPDiagram((*buf)[:n], &diagram); err != nil {
+		atomic.AddUint64(&c.malformed, 1)
+		c.dropped("", remoteAddr, "malformed")
+		return false
+	}
+	if !c.limiter.AllowDiagram(remoteAddr.IP, diagram.NodeID, diagram.DCategory) {
+		c.dropped(diagram.DCategory, remoteAddr, "rate limited")
+		return false
 	}
+	obj, ok := c.callbacks.Load(diagram.DCategory)
+	if !ok {
+		atomic.AddUint64(&c.unhandled, 1)
+		c.dropped(diagram.DCategory, remoteAddr, "no handler")
+		return false
+	}
+	// only the categories we handle are counted, the labels of the others come from the wire
+	metrics.CountMessage(metrics.DIRECTION_IN, metrics.TRANSPORT_UDP, diagram.DCategory, diagram.DType, n)
+	if !obj.(*dispatcher).enqueue(&packet{buf: buf, n: n, remoteAddr: remoteAddr, diagram: diagram}) {
+		c.dropped(diagram.DCategory, remoteAddr, "queue full")
+		return false
+	}
+	return true
 }
 
 func (c *UDPService) Send(ip net.IP, port int, bytes []byte, nodeId string) {
 	dstAddr := &net.UDPAddr{IP: ip, Port: port}
+	if err := CheckPayload(bytes); err != nil {
+		// a bug of the sender, it must split the message
+		atomic.AddUint64(&c.oversized, 1)
+		logger.Error("refuse to send to %v (node %v): %v", dstAddr, nodeId, err)
+		return
+	}
+	if c.sink != nil {
+		c.sink(capture.TRANSPORT_UDP, dstAddr, nodeId, bytes)
+		return
+	}
 	//logger.Trace("send udp data to %v", dstAddr)
 	_, err := c.listener.WriteToUDP(bytes, dstAddr)
 	if err != nil {
 		logger.Error("send UDP to target %v error:%v", dstAddr, err)
+		return
+	}
+	c.recorder.Record(capture.TRANSPORT_UDP, capture.DIRECTION_OUT, dstAddr, nodeId, bytes)
+	if metrics.Enabled() {
+		var diagram models.UDPDiagram
+		if utils.BytesToUDPDiagram(bytes, &diagram) == nil {
+			metrics.CountMessage(metrics.DIRECTION_OUT, metrics.TRANSPORT_UDP, diagram.DCategory, diagram.DType, len(bytes))
+		}
+	}
+}
+
+// Inject dispatches a recorded packet as if it was just received from peer
+func (c *UDPService) Inject(data []byte, peer string, nodeID string) error {
+	remoteAddr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	if len(data) >= UDP_READ_BUFFER_SIZE {
+		return fmt.Errorf("packet of %v bytes exceeds the read buffer", len(data))
+	}
+	buf := getBuffer()
+	n := copy(*buf, data)
+	if !c.dispatch(buf, n, remoteAddr) {
+		putBuffer(buf)
+		return fmt.Errorf("packet was dropped")
 	}
+	return nil
 }
 
 func (c *UDPService) Start() {
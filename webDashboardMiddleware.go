@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/symphonyprotocol/log"
+	"github.com/symphonyprotocol/p2p/netsize"
+	"github.com/symphonyprotocol/p2p/tcp"
+)
+
+var (
+	wdLogger = log.GetLogger("webDashboard")
+	// how often the browsers get a new snapshot
+	WEB_DASHBOARD_INTERVAL = time.Second
+)
+
+// DashboardSnapshot is everything the web dashboard shows at one moment
+type DashboardSnapshot struct {
+	Time        time.Time        `json:"time"`
+	Node        NodeInfo         `json:"node"`
+	Peers       []PeerInfo       `json:"peers"`
+	Connections []ConnectionInfo `json:"connections"`
+	Middlewares []MiddlewareInfo `json:"middlewares"`
+	// missing when the middleware has no estimator
+	NetworkSize *netsize.Estimate `json:"networkSize,omitempty"`
+}
+
+func getDashboardSnapshot(ctx *tcp.P2PContext, estimator *netsize.Estimator) DashboardSnapshot {
+	peers := make([]PeerInfo, 0)
+	for _, bucket := range getBucketsInfo(ctx) {
+		peers = append(peers, bucket.Nodes...)
+	}
+	return DashboardSnapshot{
+		Time:        time.Now(),
+		Node:        getNodeInfo(ctx),
+		Peers:       peers,
+		Connections: getConnectionsInfo(ctx),
+		Middlewares: getMiddlewaresInfo(ctx),
+		NetworkSize: getNetworkSize(estimator),
+	}
+}
+
+func getNetworkSize(estimator *netsize.Estimator) *netsize.Estimate {
+	if estimator == nil {
+		return nil
+	}
+	estimate := estimator.GetEstimate()
+	return &estimate
+}
+
+// WebDashboardMiddleware serves the panels of DashboardMiddleware to browsers, updated over Server-Sent Events.
+// Unlike DashboardMiddleware it doesn't take the terminal, so it runs on headless servers.
+type WebDashboardMiddleware struct {
+	addr      string
+	estimator *netsize.Estimator
+	server    *http.Server
+}
+
+// the dashboard has no authentication, keep addr on a loopback address or behind a proxy.
+// estimator is P2PServer.SizeEstimator(), the network size is left out when it is nil
+func NewWebDashboardMiddleware(addr string, estimator *netsize.Estimator) *WebDashboardMiddleware {
+	return &WebDashboardMiddleware{addr: addr, estimator: estimator}
+}
+
+func (d *WebDashboardMiddleware) Handle(ctx *tcp.P2PContext) {
+	ctx.Next()
+}
+
+func (d *WebDashboardMiddleware) Start(ctx *tcp.P2PContext) {
+	listener, err := net.Listen("tcp", d.addr)
+	if err != nil {
+		wdLogger.Error("web dashboard is not available: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(webDashboardPage))
+	})
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(getDashboardSnapshot(ctx, d.estimator))
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		d.serveEvents(ctx, w, r)
+	})
+	d.server = &http.Server{Handler: mux}
+	go func() {
+		if err := d.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			wdLogger.Error("web dashboard stopped: %v", err)
+		}
+	}()
+	wdLogger.Info("serving the web dashboard at http://%v/", listener.Addr())
+}
+
+// push a snapshot every WEB_DASHBOARD_INTERVAL until the browser goes away
+func (d *WebDashboardMiddleware) serveEvents(ctx *tcp.P2PContext, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(WEB_DASHBOARD_INTERVAL)
+	defer ticker.Stop()
+	for {
+		data, err := json.Marshal(getDashboardSnapshot(ctx, d.estimator))
+		if err != nil {
+			wdLogger.Error("marshal dashboard snapshot: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *WebDashboardMiddleware) Close() {
+	if d.server != nil {
+		d.server.Close()
+	}
+}
+
+func (d *WebDashboardMiddleware) AcceptConnection(*tcp.TCPConnection) {
+
+}
+func (d *WebDashboardMiddleware) DropConnection(*tcp.TCPConnection) {
+
+}
+
+func (d *WebDashboardMiddleware) DashboardData() interface{} {
+	return [][]string{
+		[]string{"Address:", d.addr},
+	}
+}
+
+func (d *WebDashboardMiddleware) DashboardType() string {
+	return "table"
+}
+
+func (d *WebDashboardMiddleware) DashboardTitle() string {
+	return "Middleware - Web Dashboard"
+}
+
+func (d *WebDashboardMiddleware) DashboardTableHasColumnTitles() bool {
+	return false
+}
+
+func (d *WebDashboardMiddleware) Name() string {
+	return "WebDashboard"
+}
@@ -0,0 +1,167 @@
+package p2p
+
+// the single page of WebDashboardMiddleware, it renders the snapshots pushed on /events
+const webDashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Symphony P2P Dashboard</title>
+<style>
+body { font-family: monospace; margin: 16px; background: #1e1e1e; color: #ddd; }
+h2 { font-size: 14px; margin: 20px 0 6px; color: #9cdcfe; }
+table { border-collapse: collapse; width: 100%; font-size: 12px; }
+th, td { border: 1px solid #444; padding: 3px 6px; text-align: left; white-space: nowrap; }
+th { background: #333; }
+th.sortable { cursor: pointer; }
+th.sortable:hover { background: #444; }
+th.asc:after { content: " \25B2"; }
+th.desc:after { content: " \25BC"; }
+tr.inactive td { color: #f48771; }
+#status { float: right; font-size: 12px; }
+#status.offline { color: #f48771; }
+.panels { display: flex; flex-wrap: wrap; gap: 16px; }
+.panels > div { flex: 1 1 45%; min-width: 400px; }
+</style>
+</head>
+<body>
+<span id="status">connecting...</span>
+<h2>Local Node</h2>
+<table id="node"></table>
+<h2>UDP Peers (<span id="peerCount">0</span>)</h2>
+<table id="peers"></table>
+<h2>TCP Connections (<span id="connCount">0</span>)</h2>
+<table id="conns"></table>
+<div class="panels" id="middlewares"></div>
+<script>
+var PEER_COLUMNS = [
+	["id", "Id"], ["distance", "Distance"], ["remoteAddr", "RemoteAddr"], ["localAddr", "LocalAddr"],
+	["latency", "Latency(ms)"], ["lastActiveTime", "LastActiveTime"], ["introducedBy", "IntroducedBy"]
+];
+var CONN_COLUMNS = [
+	["localAddr", "LocalAddr"], ["remoteAddr", "RemoteAddr"], ["isInbound", "IsInbound"], ["isRelayed", "IsRelayed"],
+	["nodeId", "NodeId"], ["writeQueue", "WriteQueue"], ["lastActiveTime", "LastActiveTime"]
+];
+// the sort column and order of each table survive the updates
+var sorts = { peers: { key: "id", asc: true }, conns: { key: "nodeId", asc: true } };
+var last = null;
+
+function el(tag, text) {
+	var e = document.createElement(tag);
+	if (text !== undefined) { e.textContent = text; }
+	return e;
+}
+
+function fmt(v) {
+	if (v === null || v === undefined) { return ""; }
+	if (typeof v === "string" && /^\d{4}-\d\d-\d\dT/.test(v)) {
+		var d = new Date(v);
+		return d.getFullYear() < 1900 ? "never" : d.toLocaleString();
+	}
+	return String(v);
+}
+
+function compare(a, b) {
+	if (typeof a === "number" && typeof b === "number") { return a - b; }
+	return String(a).localeCompare(String(b));
+}
+
+function renderSortable(id, columns, rows, rowClass) {
+	var table = document.getElementById(id);
+	var sort = sorts[id];
+	rows = rows.slice().sort(function (a, b) {
+		var c = compare(a[sort.key], b[sort.key]);
+		return sort.asc ? c : -c;
+	});
+	table.innerHTML = "";
+	var head = el("tr");
+	columns.forEach(function (col) {
+		var th = el("th", col[1]);
+		th.className = "sortable" + (col[0] === sort.key ? (sort.asc ? " asc" : " desc") : "");
+		th.onclick = function () {
+			sorts[id] = { key: col[0], asc: sort.key === col[0] ? !sort.asc : true };
+			render(last);
+		};
+		head.appendChild(th);
+	});
+	table.appendChild(head);
+	rows.forEach(function (row) {
+		var tr = el("tr");
+		if (rowClass) { tr.className = rowClass(row); }
+		columns.forEach(function (col) { tr.appendChild(el("td", fmt(row[col[0]]))); });
+		table.appendChild(tr);
+	});
+}
+
+function renderNode(n, size) {
+	var table = document.getElementById("node");
+	table.innerHTML = "";
+	[["Id:", n.id], ["PubKey:", n.publicKey], ["Local Address:", n.localAddr], ["Local IPs:", (n.localIPs || []).join(", ")],
+	 ["Remote Address:", n.remoteAddr], ["Reachability:", n.reachability], ["Up time:", n.upTime],
+	 ["Network size:", fmtSize(size)]].forEach(function (r) {
+		var tr = el("tr");
+		tr.appendChild(el("th", r[0]));
+		tr.appendChild(el("td", fmt(r[1])));
+		table.appendChild(tr);
+	});
+}
+
+// the estimate with its interval, only a lower bound once every bucket is full
+function fmtSize(e) {
+	if (!e) { return ""; }
+	if (e.saturated) { return ">= " + Math.round(e.size); }
+	return Math.round(e.size) + " (" + Math.round(e.low) + " - " + Math.round(e.high) + ", " + Math.round(e.confidence * 100) + "%)";
+}
+
+// the panels of the middlewares, "table" data is [][]string and "list" data is []string
+function renderMiddlewares(middlewares) {
+	var box = document.getElementById("middlewares");
+	box.innerHTML = "";
+	(middlewares || []).forEach(function (m) {
+		var div = el("div");
+		div.appendChild(el("h2", m.title));
+		var table = el("table");
+		var rows = m.data || [];
+		if (m.type !== "table") { rows = rows.map(function (r) { return [r]; }); }
+		rows.forEach(function (row, i) {
+			var tr = el("tr");
+			(row || []).forEach(function (cell) {
+				tr.appendChild(el(i === 0 && m.hasColumnTitles ? "th" : "td", fmt(cell)));
+			});
+			table.appendChild(tr);
+		});
+		div.appendChild(table);
+		box.appendChild(div);
+	});
+}
+
+function render(s) {
+	if (!s) { return; }
+	last = s;
+	renderNode(s.node, s.networkSize);
+	document.getElementById("peerCount").textContent = s.peers.length;
+	document.getElementById("connCount").textContent = s.connections.length;
+	renderSortable("peers", PEER_COLUMNS, s.peers, function (p) { return p.latency === -1 ? "inactive" : ""; });
+	renderSortable("conns", CONN_COLUMNS, s.connections);
+	renderMiddlewares(s.middlewares);
+}
+
+function connect() {
+	var status = document.getElementById("status");
+	var source = new EventSource("events");
+	source.addEventListener("snapshot", function (e) {
+		status.className = "";
+		status.textContent = "updated " + new Date().toLocaleTimeString();
+		render(JSON.parse(e.data));
+	});
+	// EventSource reconnects by itself
+	source.onerror = function () {
+		status.className = "offline";
+		status.textContent = "disconnected, retrying...";
+	};
+}
+
+connect();
+</script>
+</body>
+</html>
+`